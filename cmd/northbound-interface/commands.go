@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/go-zoo/bone"
+
+	"github.com/sking2600/coap-gateway/pkg/commands"
+	"github.com/sking2600/coap-gateway/pkg/payload"
+	"github.com/sking2600/coap-gateway/pkg/registry"
+	"github.com/sking2600/coap-gateway/pkg/routing"
+	"github.com/sking2600/coap-gateway/pkg/webhooks"
+)
+
+var (
+	envCommandRetention = "COMMAND_RETENTION"
+
+	defaultCommandRetention = 24 * time.Hour
+	defaultCommandTTL       = time.Hour
+	maxCommandTTL           = 7 * 24 * time.Hour
+	//commandLease is how long a delivery may take before the command can be claimed again
+	commandLease = 30 * time.Second
+)
+
+//CommandStatus is the response of GET /requests/:id. Payload is the response of the device once the command is completed
+type CommandStatus struct {
+	ID          string      `json:"id"`
+	DeviceID    string      `json:"di,omitempty"`
+	Method      string      `json:"method,omitempty"`
+	Href        string      `json:"href,omitempty"`
+	Status      string      `json:"status,omitempty"`
+	CreatedAt   *time.Time  `json:"createdat,omitempty"`
+	ExpiresAt   time.Time   `json:"expiresat"`
+	CompletedAt *time.Time  `json:"completedat,omitempty"`
+	Result      int         `json:"result,omitempty"`
+	Payload     interface{} `json:"payload,omitempty"`
+}
+
+//newCommandQueue returns the queue of the asynchronous commands. results are kept for COMMAND_RETENTION seconds (a day by default)
+func newCommandQueue() commands.Queue {
+	retention := defaultCommandRetention
+	if v := os.Getenv(envCommandRetention); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds < 0 {
+			log.Printf("Invalid value '%v' of env variable '%v'", v, envCommandRetention)
+		} else {
+			retention = time.Duration(seconds) * time.Second
+		}
+	}
+	if os.Getenv(envRegistryBackend) == "memory" {
+		return commands.NewMemoryQueue(retention)
+	}
+	client := redis.NewClient(&redis.Options{
+		Addr:     os.Getenv("CACHE_URI"),
+		Password: os.Getenv("CACHE_PASSWORD"),
+	})
+	return commands.NewRedisQueue(client, retention)
+}
+
+/*enqueueCommand handles <method> /:deviceUUID/:href?async=true&ttl=<seconds>. it responds 202 Accepted with the id of the command,
+which is delivered right away if the device is connected or when it signs in otherwise, unless it expires first (after an hour
+by default)
+*/
+func enqueueCommand(w http.ResponseWriter, r *http.Request, db registry.Registry, router Router, queue commands.Queue, deviceUUID, href string, body []byte) {
+	ttl := defaultCommandTTL
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > maxCommandTTL {
+			log.Println("invalid ttl of async request: ", v)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("ttl must be a number of seconds between 1 and " + strconv.Itoa(int(maxCommandTTL/time.Second))))
+			return
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+	//the body is converted up front, a command the device can't be sent would only sit in the queue until it expires
+	contentType := r.Header.Get("Content-Type")
+	body, err := payload.ToCBOR(contentType, body)
+	if err == payload.ErrUnsupportedMediaType {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		log.Println("invalid body of async request: ", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("the body must be JSON or CBOR"))
+		return
+	}
+	if payload.MediaType(contentType) != payload.CBOR {
+		contentType = payload.OCFCBOR
+	}
+	id, err := registry.GenerateRandomString(16)
+	if err != nil {
+		log.Println("err generating command id: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	c := commands.Command{ID: id, DeviceID: deviceUUID, Method: r.Method, Href: href, Query: deviceQuery(r), ContentType: contentType, Body: body, ExpiresAt: time.Now().Add(ttl)}
+	err = queue.Enqueue(c)
+	if err != nil {
+		log.Println("err enqueuing command for ", deviceUUID, ": ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	go deliverCommand(db, router, queue, c)
+	response, err := json.Marshal(CommandStatus{ID: id, ExpiresAt: c.ExpiresAt})
+	if err != nil {
+		log.Println("error marshalling response body: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/requests/"+id)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(response)
+}
+
+//deliverCommand sends the command to the device if it's connected. it stays in the queue if it isn't or if the coap-interface
+//couldn't reach the device, the pod the device signs in to next delivers it
+func deliverCommand(db registry.Registry, router Router, queue commands.Queue, c commands.Command) {
+	ctx, cancel := context.WithDeadline(context.Background(), c.ExpiresAt)
+	defer cancel()
+	route, err := db.LookupRoute(ctx, c.DeviceID)
+	if err != nil || route.PodAddr == routing.UnspecifiedAddress {
+		return
+	}
+	err = queue.Claim(c.ID, commandLease)
+	if err != nil {
+		return
+	}
+	res, err := router.Forward(ctx, route, DeviceRequest{
+		Method:      c.Method,
+		DeviceID:    c.DeviceID,
+		Href:        c.Href,
+		Query:       c.Query,
+		ContentType: c.ContentType,
+		Accept:      payload.JSON,
+		Body:        c.Body,
+	})
+	//the pod rejecting the command itself (ex: 415 for its body) completes it, retrying it would block the ones after it
+	transient := res.Status == http.StatusNotFound || res.Status == http.StatusConflict || res.Status == http.StatusBadGateway
+	if err != nil || (!res.DeviceResponded && transient) {
+		log.Println("command ", c.ID, " wasn't delivered to ", c.DeviceID, ", it stays queued: ", res.Status, " ", err)
+		err = queue.Release(c.ID)
+		if err != nil {
+			log.Println("err releasing command ", c.ID, ": ", err)
+		}
+		return
+	}
+	err = queue.Complete(c.ID, res.Status, res.Body)
+	if err != nil {
+		log.Println("err completing command ", c.ID, ": ", err)
+		return
+	}
+	events.Emit(context.Background(), webhooks.CommandCompleted, c.DeviceID, webhooks.CommandResult{ID: c.ID, DeviceID: c.DeviceID, Href: c.Href, Result: res.Status, Payload: webhooks.JSONPayload(res.Body)})
+}
+
+//handleCommandStatus handles GET /requests/:id
+func handleCommandStatus(queue commands.Queue) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		//todo: verify that the access token authorizes the client to control the command's device
+		c, err := queue.Get(bone.GetValue(r, "id"))
+		if err == commands.ErrCommandNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println("err getting command: ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		status := CommandStatus{
+			ID:        c.ID,
+			DeviceID:  c.DeviceID,
+			Method:    c.Method,
+			Href:      c.Href,
+			Status:    c.Status,
+			CreatedAt: &c.CreatedAt,
+			ExpiresAt: c.ExpiresAt,
+			Result:    c.Result,
+			Payload:   webhooks.JSONPayload(c.Payload),
+		}
+		if !c.CompletedAt.IsZero() {
+			status.CompletedAt = &c.CompletedAt
+		}
+		response, err := json.Marshal(status)
+		if err != nil {
+			log.Println("error marshalling response body: ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response)
+	}
+}
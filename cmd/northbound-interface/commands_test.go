@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sking2600/coap-gateway/pkg/commands"
+	"github.com/sking2600/coap-gateway/pkg/registry"
+	"github.com/sking2600/coap-gateway/pkg/routing"
+)
+
+//statusRouter answers every request with the pod's own status
+type statusRouter int
+
+func (s statusRouter) Forward(ctx context.Context, route routing.Route, req DeviceRequest) (DeviceResponse, error) {
+	return DeviceResponse{Status: int(s)}, nil
+}
+
+func (s statusRouter) Observe(ctx context.Context, route routing.Route, req DeviceRequest) (DeviceStream, error) {
+	return DeviceStream{}, errObserveUnsupported
+}
+
+func TestDeliverCommandOutcome(t *testing.T) {
+	db := registry.NewMemoryRegistry()
+	db.Routes.SetRoute("device-test-uuid", "10.0.0.1", time.Hour)
+	for _, tc := range []struct {
+		status int
+		want   string
+	}{
+		{http.StatusUnsupportedMediaType, commands.StatusCompleted},
+		{http.StatusBadGateway, commands.StatusPending},
+		{http.StatusNotFound, commands.StatusPending},
+	} {
+		queue := commands.NewMemoryQueue(time.Hour)
+		c := commands.Command{ID: "1", DeviceID: "device-test-uuid", Method: http.MethodPost, Href: "light", ExpiresAt: time.Now().Add(time.Hour)}
+		queue.Enqueue(c)
+		deliverCommand(db, statusRouter(tc.status), queue, c)
+		got, err := queue.Get("1")
+		if err != nil || got.Status != tc.want {
+			t.Fatalf("a command the pod answered %v to should be %v: %+v %v", tc.status, tc.want, got, err)
+		}
+	}
+}
@@ -1,14 +1,16 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
 
 	"github.com/kelseyhightower/envconfig"
@@ -16,7 +18,10 @@ import (
 	"github.com/go-redis/redis"
 	"github.com/go-zoo/bone"
 
+	"github.com/sking2600/coap-gateway/pkg/commands"
 	"github.com/sking2600/coap-gateway/pkg/registry"
+	"github.com/sking2600/coap-gateway/pkg/routing"
+	"github.com/sking2600/coap-gateway/pkg/webhooks"
 )
 
 //TODO: break up main and handlers
@@ -32,7 +37,7 @@ POST /oic/sec/tokenrefresh {userID, deviceID, refresh token} returns (access tok
 POST /provision/client {mediator token, deviceID} returns {mediated token}
 POST /provision/device {mediator token, deviceID} returns {mediated token}
 GET /oic/res?param1=A&param2=B {access token in authorization header}
-POST {device-UUID}/{device-specific href} {TODO: should payload be CBOR or JSON encoded? I could just store that info in the relevant header}
+POST {device-UUID}/{device-specific href} {payload as JSON or CBOR, per the Content-Type header}
 DELETE /oic/sec/account {access token, userID OR device/clientID}
 POST /oic/sec/account {deviceID, access token, authProvider (optional)} returns {access token, userID, refresh token, expires in, redirect URI (optional)}
 
@@ -58,61 +63,255 @@ type Account struct {
 }
 
 type dbconfig struct {
-	dbName        string `envconfig:"DB_NAME" required:"true"`
-	dbUsername    string `envconfig:"DB_USERNAME" required:"true"`
-	dbPassword    string `envconfig:"DB_PASSWORD" required:"true"`
-	dbAddress     string `envconfig:"DB_URI" required:"true"`
-	redisPassword string `envconfig:"CACHE_PASSWORD" required:"true"`
-	redisAddress  string `envconfig:"CACHE_URI" required:"true"`
-	redisNumber   int    `envconfig:"CACHE_NUMBER" default:"0"`
+	DBName     string `envconfig:"DB_NAME" required:"true"`
+	DBUsername string `envconfig:"DB_USERNAME" required:"true"`
+	DBPassword string `envconfig:"DB_PASSWORD" required:"true"`
+	DBAddress  string `envconfig:"DB_URI" required:"true"`
+}
+
+type cacheconfig struct {
+	RedisPassword string `envconfig:"CACHE_PASSWORD" required:"true"`
+	RedisAddress  string `envconfig:"CACHE_URI" required:"true"`
+	RedisNumber   int    `envconfig:"CACHE_NUMBER" default:"0"`
+}
+
+//mysqlDSN returns the data source name of the mysql db. DB_URI is everything between the password and the db name (ex: @tcp(host:3306)/)
+func (c dbconfig) mysqlDSN() string {
+	return fmt.Sprintf("%s:%s%s%s?parseTime=true", c.DBUsername, c.DBPassword, c.DBAddress, c.DBName)
 }
 
 var (
+	envRegistryBackend = "REGISTRY_BACKEND"
+	envTokenPepper     = "TOKEN_PEPPER"
+	envShutdownTimeout = "SHUTDOWN_TIMEOUT"
+
 	tokenEntropy   int = 32   //the actual tokens will be longer due to base64 encoding
 	accessTokenTTL     = 6000 //TTL is seconds. TODO: make this configurable
 
 )
 
 func main() {
-	var dbc dbconfig
-	err := envconfig.Process("db", &dbc)
-	err = envconfig.Process("cache", &dbc)
-	if err != nil {
-		log.Fatal(err.Error())
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		err := runMigrations(os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
-	dbURI := fmt.Sprintf("%s:%s%s%s?parseTime=true", dbc.dbUsername, dbc.dbPassword, dbc.dbAddress, dbc.dbName)
-
-	fmt.Println(dbURI)
-	sql, err := sql.Open("mysql", dbURI)
+	if len(os.Args) > 1 && os.Args[1] == "reap" {
+		err := runReaper()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	db, err := newRegistry()
 	if err != nil {
 		log.Fatal(err)
 	}
-	redisdb := redis.NewClient(&redis.Options{
-		Addr:     dbc.redisAddress,
-		Password: dbc.redisPassword,
-		DB:       dbc.redisNumber,
-	})
-	db := registry.MysqlRedisRegistry{sql, redisdb}
-	err = db.Ping()
+	deviceRouter, err := newRouter()
 	if err != nil {
-		log.Fatal("err pinging sql db: ", err)
+		log.Fatal(err)
 	}
-	fmt.Println("db connection successful")
+	queue := newCommandQueue()
+	store := newWebhookStore()
+	events = webhooks.NewDispatcher(store, db, "/northbound-interface")
 	router := bone.New()
+	router.Get("/readyz", http.HandlerFunc(handleReadiness))
+	router.Get("/requests/:id", http.HandlerFunc(handleCommandStatus(queue)))
+	router.Post("/webhooks", http.HandlerFunc(handleRegisterWebhook(db, store)))
+	router.Get("/webhooks", http.HandlerFunc(handleListWebhooks(db, store)))
+	router.Delete("/webhooks/:id", http.HandlerFunc(handleDeleteWebhook(db, store)))
+	router.Get("/webhooks/:id/deadletters", http.HandlerFunc(handleDeadLetters(db, store)))
 	router.Post("/register/user", http.HandlerFunc(handleRegisterUser(db)))
 	router.Post("/provision/mediator", http.HandlerFunc(provisionMediator(db)))
 	router.Post("/oic/sec/tokenrefresh", http.HandlerFunc(tokenRefresh(db)))
 	router.Post("/provision/client", http.HandlerFunc(handleProvisionClient(db)))
 	router.Post("/provision/device", http.HandlerFunc(handleProvisionDevice(db)))
-	router.Post("/:deviceUUID/:href", http.HandlerFunc(handleClientRequest(db)))
-	router.Delete("/oic/sec/account", http.HandlerFunc(handleDelete))
+	router.Delete("/oic/sec/account", http.HandlerFunc(handleDelete(db, deviceRouter)))
 	router.Post("/oic/sec/account", http.HandlerFunc(handleRegisterClient(db)))
-	router.Get("/oic/res", http.HandlerFunc(handleResourceDiscovery))
-	_, err = registry.InitDB(context.TODO(), sql)
+	router.Get("/oic/res", http.HandlerFunc(handleResourceDiscovery(db)))
+	//requests to /<deviceUUID>/<href> are matched before the router, since the href can have any number of segments
+	clientRequest := http.HandlerFunc(handleClientRequest(db, deviceRouter, queue))
+	devices := routing.DeviceMux(router, map[string]http.Handler{
+		http.MethodGet:    http.HandlerFunc(handleObserve(db, deviceRouter, queue)),
+		http.MethodPost:   clientRequest,
+		http.MethodPut:    clientRequest,
+		http.MethodDelete: clientRequest,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	err = serve(&http.Server{Addr: ":8080", Handler: cancelOnShutdown(ctx, devices)}, cancel)
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+//newRegistry connects to the backend selected by REGISTRY_BACKEND ("memory", "postgres" or "mysql" which is the default)
+//and brings the schema up to date. running the migrate subcommand in an init container beforehand makes this a no-op
+func newRegistry() (registry.Registry, error) {
+	if os.Getenv(envRegistryBackend) == "memory" {
+		log.Println("using in-memory registry. nothing will be persisted")
+		return registry.NewMemoryRegistry(), nil
+	}
+	hasher, err := newTokenHasher()
+	if err != nil {
+		return nil, err
+	}
+	driver, sql, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	version, err := registry.MigrateUp(context.TODO(), sql, driver)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("schema is at version ", version)
+	_, err = registry.HashLegacyTokens(context.TODO(), sql, driver, hasher)
+	if err != nil {
+		return nil, err
+	}
+	if driver == "postgres" {
+		redisdb := redis.NewClient(&redis.Options{
+			Addr:     os.Getenv("CACHE_URI"),
+			Password: os.Getenv("CACHE_PASSWORD"),
+		})
+		return registry.PostgresRedisRegistry{DB: sql, Routes: routing.NewRedisRouteTable(redisdb), Hasher: hasher}, nil
+	}
+	var cc cacheconfig
+	err = envconfig.Process("cache", &cc)
+	if err != nil {
+		return nil, err
+	}
+	redisdb := redis.NewClient(&redis.Options{
+		Addr:     cc.RedisAddress,
+		Password: cc.RedisPassword,
+		DB:       cc.RedisNumber,
+	})
+	return registry.MysqlRedisRegistry{DB: sql, Routes: routing.NewRedisRouteTable(redisdb), Hasher: hasher}, nil
+}
+
+//newTokenHasher keys the token hashes with TOKEN_PEPPER, which has to be the same for the coap-interface. an empty pepper is refused,
+//the hashes would be as good as plaintext to anyone who can read the database
+func newTokenHasher() (registry.TokenHasher, error) {
+	pepper := os.Getenv(envTokenPepper)
+	if pepper == "" {
+		return registry.TokenHasher{}, fmt.Errorf("%v is not set", envTokenPepper)
+	}
+	return registry.NewTokenHasher([]byte(pepper)), nil
+}
+
+//openDB opens and pings the sql database selected by REGISTRY_BACKEND and returns the driver name along with it
+func openDB() (string, *sql.DB, error) {
+	if os.Getenv(envRegistryBackend) == "postgres" {
+		//for postgres DB_URI is just host[:port]
+		dbURI := registry.PostgresURI(os.Getenv("DB_USERNAME"), os.Getenv("DB_PASSWORD"), os.Getenv("DB_URI"), os.Getenv("DB_NAME"), os.Getenv("DB_SSLMODE"))
+		db, err := sql.Open("postgres", dbURI)
+		if err != nil {
+			return "", nil, err
+		}
+		err = db.Ping()
+		if err != nil {
+			log.Println("err pinging postgres db: ", err)
+			return "", nil, err
+		}
+		fmt.Println("db connection successful")
+		return "postgres", db, nil
+	}
+	var dbc dbconfig
+	err := envconfig.Process("db", &dbc)
+	if err != nil {
+		return "", nil, err
+	}
+	db, err := sql.Open("mysql", dbc.mysqlDSN())
+	if err != nil {
+		return "", nil, err
+	}
+	err = db.Ping()
 	if err != nil {
-		panic(err)
+		log.Println("err pinging sql db: ", err)
+		return "", nil, err
 	}
-	log.Fatal(http.ListenAndServe(":8080", router))
+	fmt.Println("db connection successful")
+	return "mysql", db, nil
+}
+
+/*runMigrations implements the migrate subcommand so the schema can be migrated from an init container:
+	northbound-interface migrate            applies every pending migration
+	northbound-interface migrate down N     reverts migrations until the schema is at version N
+	northbound-interface migrate version    prints the current schema version
+*/
+func runMigrations(args []string) error {
+	driver, db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ctx := context.TODO()
+	var version int
+	switch {
+	case len(args) == 0 || args[0] == "up":
+		version, err = registry.MigrateUp(ctx, db, driver)
+		if err != nil {
+			return err
+		}
+		var hasher registry.TokenHasher
+		hasher, err = newTokenHasher()
+		if err != nil {
+			return err
+		}
+		var hashed int
+		hashed, err = registry.HashLegacyTokens(ctx, db, driver, hasher)
+		if hashed > 0 {
+			fmt.Println("hashed ", hashed, " plaintext tokens")
+		}
+	case args[0] == "down" && len(args) == 2:
+		target, convErr := strconv.Atoi(args[1])
+		if convErr != nil {
+			return fmt.Errorf("invalid target version %q: %v", args[1], convErr)
+		}
+		version, err = registry.MigrateDown(ctx, db, driver, target)
+	case args[0] == "version":
+		version, err = registry.SchemaVersion(ctx, db, driver)
+	default:
+		return fmt.Errorf("usage: %s migrate [up | down <version> | version]", os.Args[0])
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println("schema version: ", version)
+	return nil
+}
+
+/*runReaper implements the reap subcommand. it deletes the routes of coap-interface pods that stopped sending heartbeats
+(ex: their node failed before they could drain) and marks those devices as logged out. it's meant to be run periodically by a
+CronJob that doesn't allow concurrent runs, so only one reaper is ever running
+*/
+func runReaper() error {
+	db, err := newRegistry()
+	if err != nil {
+		return err
+	}
+	reaped, err := db.ReapStaleRoutes(context.Background())
+	if err != nil {
+		return err
+	}
+	fmt.Println("reaped ", len(reaped), " stale routes")
+	return nil
+}
+
+//statusFromError maps the registry's sentinel errors to HTTP status codes. anything unexpected is a 500
+func statusFromError(err error) int {
+	switch err {
+	case registry.ErrMediatorTokenNotFound:
+		return http.StatusForbidden
+	case registry.ErrDuplicateDevice, registry.ErrDuplicateClient:
+		return http.StatusConflict
+	case registry.ErrInvalidToken, registry.ErrTokenExpired:
+		return http.StatusUnauthorized
+	case registry.ErrDeviceNotFound:
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
 }
 
 //TODO implement this properly once the TG agrees on auth
@@ -129,7 +328,7 @@ func handleRegisterUser(db registry.Registry) func(w http.ResponseWriter, r *htt
 			log.Println("err from handleRegisterUser: ", err)
 			w.WriteHeader(http.StatusInternalServerError)
 		}
-		userToken, err := db.RegisterUser(account.UserID, account.AuthProvider)
+		userToken, err := db.RegisterUser(r.Context(), account.UserID, account.AuthProvider)
 		if err != nil {
 			log.Println("err from handleRegisterUser: ", err)
 			w.WriteHeader(http.StatusInternalServerError) //TODO parse the error and return different status code if it's caused by a duplicate entry
@@ -160,10 +359,11 @@ func provisionMediator(db registry.Registry) func(w http.ResponseWriter, r *http
 			log.Println("err from provisionMediator: ", err)
 			w.WriteHeader(http.StatusInternalServerError)
 		}
-		mediatorToken, err := db.ProvisionMediator(account.UserID, account.AccessToken)
+		mediatorToken, err := db.ProvisionMediator(r.Context(), account.UserID, account.AccessToken)
 		if err != nil {
 			log.Println("err from provisionMediator: ", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			w.WriteHeader(statusFromError(err))
+			return
 		}
 		response, err := json.Marshal(Account{AccessToken: mediatorToken})
 		if err != nil {
@@ -187,10 +387,11 @@ func tokenRefresh(db registry.Registry) func(w http.ResponseWriter, r *http.Requ
 			log.Println("err from tokenRefresh json.unmarshal: ", err)
 			w.WriteHeader(http.StatusInternalServerError)
 		}
-		accessToken, refreshToken, ttl, err := db.RefreshToken(account.DeviceID, account.UserID, account.RefreshToken)
+		accessToken, refreshToken, ttl, err := db.RefreshToken(r.Context(), account.DeviceID, account.UserID, account.RefreshToken)
 		if err != nil {
 			log.Println("err from tokenRefresh: ", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			w.WriteHeader(statusFromError(err))
+			return
 		}
 		response, err := json.Marshal(Account{AccessToken: accessToken, RefreshToken: refreshToken, TokenTTL: ttl})
 		if err != nil {
@@ -223,10 +424,10 @@ func handleProvisionClient(db registry.Registry) func(http.ResponseWriter, *http
 		}
 		fmt.Println("client provision request with mediator token: ", mediatorToken, " for uuid: ", account.DeviceID)
 
-		mediatedToken, err := db.ProvisionClient(context.TODO(), account.DeviceID, mediatorToken)
+		mediatedToken, err := db.ProvisionClient(r.Context(), account.DeviceID, mediatorToken)
 		if err != nil {
 			log.Println("error provisioning client: ", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			w.WriteHeader(statusFromError(err))
 			return
 		}
 		response, err := json.Marshal(Account{AccessToken: mediatedToken})
@@ -263,10 +464,11 @@ func handleProvisionDevice(db registry.Registry) func(w http.ResponseWriter, r *
 		fmt.Println("device provision request with mediator token: ", mediatorToken, " for uuid: ", account.DeviceID)
 
 		//TODO verify token with auth provider
-		mediatedToken, err := db.ProvisionDevice(context.TODO(), account.DeviceID, mediatorToken)
+		mediatedToken, err := db.ProvisionDevice(r.Context(), account.DeviceID, mediatorToken)
 		if err != nil {
 			log.Println("err from provisioning device: ", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			w.WriteHeader(statusFromError(err))
+			return
 		}
 		response, err := json.Marshal(Account{AccessToken: mediatedToken})
 		if err != nil {
@@ -279,53 +481,145 @@ func handleProvisionDevice(db registry.Registry) func(w http.ResponseWriter, r *
 	}
 }
 
-func handleClientRequest(db registry.Registry) func(w http.ResponseWriter, r *http.Request) {
+func handleClientRequest(db registry.Registry, router Router, queue commands.Queue) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		//todo: verify access token in relation to deviceUUID
 		accessToken := r.Header.Get("Authorization")
 		fmt.Println("todo: verify that the access token authorizes the client to control this device\naccessToken: ", accessToken)
-		deviceUUID := bone.GetValue(r, "deviceUUID")
-		href := bone.GetValue(r, "href")
+		deviceUUID, href, _ := routing.SplitDevicePath(r.URL.Path)
 		b, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			log.Println("error parsing request body", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte("STATUS CODE 500:\ncouldn't read body"))
 		}
-		ip, err := db.LookupPrivateIP(deviceUUID)
-		if err != nil {
-			if err == redis.Nil {
-				log.Println("client requested deviceUUID: ", deviceUUID, " but it was not found")
-				w.WriteHeader(http.StatusNotFound)
-				w.Write([]byte("that deviceUUID was not found. it may not be connected or it may have never been registered"))
-			}
+		if r.URL.Query().Get("async") == "true" {
+			enqueueCommand(w, r, db, router, queue, deviceUUID, href, b)
+			return
+		}
+		route, ok := lookupDeviceRoute(w, r, db, deviceUUID)
+		if !ok {
+			return
 		}
-		ip = strings.Replace(ip, ".", "-", -1)
-		fmt.Println("client requested to send to ", deviceUUID, " at ip address ", ip, "\nand this href: ", href, " and this body:\n", string(b))
-		//TODO implement use of k8s dns by making the url 1-2-3-4.default.pod.cluster.local {replace 1-2-3-4 with podIP but gotta change the dots to dashes}
-		//TODO what is the best way of making this app aware of the namespace of the coap pod?
-		endpoint := fmt.Sprintf("http://%s.default.pod.cluster.local:8081/%s/%s", ip, deviceUUID, href)
-		res, err := http.Post(endpoint, "application/json", bytes.NewBuffer(b))
+		log.Println("forwarding ", r.Method, " ", href, " of ", deviceUUID, " to ", route.PodAddr)
+		res, err := router.Forward(r.Context(), route, DeviceRequest{
+			Method:      r.Method,
+			DeviceID:    deviceUUID,
+			Href:        href,
+			Query:       deviceQuery(r),
+			ContentType: r.Header.Get("Content-Type"),
+			Accept:      r.Header.Get("Accept"),
+			Body:        b,
+		})
 		if err != nil {
 			log.Println("err sending request to coap gateway: ", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		response, err := ioutil.ReadAll(res.Body)
-		fmt.Println("len of coap-gateway response: ", len(response))
+		if res.Status == http.StatusConflict && !res.DeviceResponded {
+			log.Println("conflicting ownership of the route of ", deviceUUID, " (", route, "): ", string(res.Body))
+		}
+		if res.ContentType != "" {
+			w.Header().Set("Content-Type", res.ContentType)
+		}
+		w.WriteHeader(res.Status)
+		w.Write(res.Body)
+	}
+}
 
-		if err != nil {
-			log.Println("err reading response from coap gateway: ", err)
-			w.WriteHeader(http.StatusInternalServerError)
+//gatewayParams are the query params that are meant for the gateway rather than the device
+var gatewayParams = []string{"async", "ttl"}
+
+//deviceQuery returns the query string of the request without the gatewayParams. the rest is forwarded to the device as is
+func deviceQuery(r *http.Request) string {
+	query := r.URL.Query()
+	found := false
+	for _, p := range gatewayParams {
+		if _, ok := query[p]; ok {
+			found = true
+			query.Del(p)
 		}
-		fmt.Println("response from coap-gateway: ", string(response))
-		w.Write(response) //TODO convert payload from cbor to json. maybe this is best done on the coap-gateway side?
 	}
+	if !found {
+		return r.URL.RawQuery
+	}
+	return query.Encode()
 }
 
-//TODO implement this
-func handleDelete(w http.ResponseWriter, r *http.Request) {
+//routeEpochHeader carries the epoch of the route the request was forwarded with, so that the coap-interface can tell whether
+//the session it holds for the device is the one that owns the route
+const routeEpochHeader = "Route-Epoch"
+
+//lookupDeviceRoute returns the route of the device. if the device isn't connected, it writes the error response and returns false
+func lookupDeviceRoute(w http.ResponseWriter, r *http.Request, db registry.Registry, deviceUUID string) (routing.Route, bool) {
+	route, err := db.LookupRoute(r.Context(), deviceUUID)
+	if err == routing.ErrRouteNotFound || (err == nil && route.PodAddr == routing.UnspecifiedAddress) {
+		log.Println("client requested deviceUUID: ", deviceUUID, " but it was not found")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("that deviceUUID was not found. it may not be connected or it may have never been registered"))
+		return route, false
+	}
+	if err != nil {
+		log.Println("err looking up route of ", deviceUUID, ": ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return route, false
+	}
+	return route, true
+}
+
+//setRouteEpoch adds the route's epoch to a request forwarded to the coap-interface. routes written before epochs existed have none
+func setRouteEpoch(req *http.Request, route routing.Route) {
+	if route.Epoch > 0 {
+		req.Header.Set(routeEpochHeader, strconv.FormatInt(route.Epoch, 10))
+	}
+}
+
+/*handleDelete handles DELETE /oic/sec/account?di=<device or client UUID>&uid=<userID>&accesstoken=<token>
+the access token can also be sent in the authorization header. a client can delete itself, its device (with the device's
+or its own access token) or any other device of the same user. deleted devices are disconnected from the coap-interface
+*/
+func handleDelete(db registry.Registry, router Router) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		deviceID, userID, accessToken := query.Get("di"), query.Get("uid"), query.Get("accesstoken")
+		if accessToken == "" {
+			accessToken = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		}
+		if deviceID == "" || accessToken == "" {
+			log.Println("mandatory fields were left unpopulated in DELETE /oic/sec/account")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		//the route is purged by DeleteDevice so the pod has to be looked up first
+		route, lookupErr := db.LookupRoute(r.Context(), deviceID)
+		err := db.DeleteDevice(r.Context(), deviceID, userID, accessToken)
+		if err == registry.ErrDeviceNotFound {
+			err = db.DeleteClient(r.Context(), deviceID, accessToken)
+			if err != nil {
+				log.Println("err deleting client ", deviceID, ": ", err)
+				w.WriteHeader(statusFromError(err))
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if err != nil {
+			log.Println("err deleting device ", deviceID, ": ", err)
+			w.WriteHeader(statusFromError(err))
+			return
+		}
+		if lookupErr == nil && route.PodAddr != routing.UnspecifiedAddress {
+			closeDeviceSession(router, route, deviceID)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
 
+func closeDeviceSession(router Router, route routing.Route, deviceID string) {
+	_, err := router.Forward(context.Background(), route, DeviceRequest{Method: http.MethodDelete, DeviceID: deviceID})
+	if err != nil {
+		log.Println("err closing session of ", deviceID, ": ", err)
+	}
 }
 
 func handleRegisterClient(db registry.Registry) func(w http.ResponseWriter, r *http.Request) {
@@ -350,10 +644,10 @@ func handleRegisterClient(db registry.Registry) func(w http.ResponseWriter, r *h
 			w.WriteHeader(http.StatusUnauthorized) //TODO ensure this is the correct response code
 		}
 		log.Println("in handleMediatedToken accessToken: ", account.AccessToken)
-		accessToken, refreshToken, redirectURI, expiresIn, err := db.RegisterClient(context.TODO(), account.UserID, account.DeviceID, account.AccessToken, account.AuthProvider)
+		accessToken, refreshToken, redirectURI, expiresIn, err := db.RegisterClient(r.Context(), account.UserID, account.DeviceID, account.AccessToken, account.AuthProvider)
 		if err != nil {
 			log.Println("err from registering client: ", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			w.WriteHeader(statusFromError(err))
 			return
 		}
 		if redirectURI != "" {
@@ -372,17 +666,90 @@ func handleRegisterClient(db registry.Registry) func(w http.ResponseWriter, r *h
 	}
 }
 
-//select * from mediator where mediator_token like '%%'
-// ^^ this is a good jumping off point for handling parameters that aren't specified
-//TODO implement this
-func handleResourceDiscovery(w http.ResponseWriter, r *http.Request) {
-	//get token from auth header
-	err := r.ParseForm()
-	if err != nil {
-		log.Println("err parsing form from handleResourceDirectory: ", err)
-		w.WriteHeader(http.StatusInternalServerError)
+/*handleResourceDiscovery handles GET /oic/res?di=A&rt=B... the bearer token in the authorization header identifies the user
+and only the links of that user's devices are returned. supported filters are di, rt, if, href and anchor
+*/
+func handleResourceDiscovery(db registry.Registry) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accessToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if accessToken == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		userID, err := db.LookupUser(r.Context(), accessToken)
+		if err != nil {
+			log.Println("err looking up the user of GET /oic/res: ", err)
+			w.WriteHeader(statusFromError(err))
+			return
+		}
+		links, err := db.FindDevice(r.Context(), userID, r.URL.Query())
+		if err != nil {
+			log.Println("err from FindDevice: ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(links))
 	}
+}
 
-	//TODO figure out request formatting required in order to correctly/efficiently identify userID based on token?
-
+/*handleObserve handles GET /:deviceUUID/:href with "Accept: text/event-stream". the coap-interface pod that's connected to the device
+observes the resource and every notification is streamed back as a Server-Sent Event until the client disconnects.
+other GETs retrieve the resource once, like any other request
+*/
+func handleObserve(db registry.Registry, router Router, queue commands.Queue) func(w http.ResponseWriter, r *http.Request) {
+	retrieve := handleClientRequest(db, router, queue)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+			retrieve(w, r)
+			return
+		}
+		//todo: verify access token in relation to deviceUUID
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			log.Println("response writer doesn't support flushing, can't stream notifications")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		deviceUUID, href, _ := routing.SplitDevicePath(r.URL.Path)
+		route, ok := lookupDeviceRoute(w, r, db, deviceUUID)
+		if !ok {
+			return
+		}
+		stream, err := router.Observe(r.Context(), route, DeviceRequest{Method: http.MethodGet, DeviceID: deviceUUID, Href: href, Accept: r.Header.Get("Accept")})
+		if err == errObserveUnsupported {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		if err != nil {
+			log.Println("err sending observe request to coap gateway: ", err)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer stream.Body.Close()
+		if stream.Status == http.StatusConflict {
+			log.Println("conflicting ownership of the route of ", deviceUUID, " (", route, ")")
+		}
+		w.Header().Set("Content-Type", stream.ContentType)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(stream.Status)
+		flusher.Flush()
+		buf := make([]byte, 4096)
+		for {
+			n, err := stream.Body.Read(buf)
+			if n > 0 {
+				_, writeErr := w.Write(buf[:n])
+				if writeErr != nil {
+					return
+				}
+				flusher.Flush()
+			}
+			if err != nil {
+				if err != io.EOF && r.Context().Err() == nil {
+					log.Println("err reading notifications of ", href, " of ", deviceUUID, ": ", err)
+				}
+				return
+			}
+		}
+	}
 }
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+func TestMysqlDSN(t *testing.T) {
+	os.Setenv("DB_NAME", "coapgateway")
+	os.Setenv("DB_USERNAME", "gateway")
+	os.Setenv("DB_PASSWORD", "secret")
+	os.Setenv("DB_URI", "@tcp(mysql:3306)/")
+	var dbc dbconfig
+	err := envconfig.Process("db", &dbc)
+	if err != nil {
+		t.Fatalf("cannot process env: %v", err)
+	}
+	want := "gateway:secret@tcp(mysql:3306)/coapgateway?parseTime=true"
+	if dsn := dbc.mysqlDSN(); dsn != want {
+		t.Fatalf("unexpected dsn: %v != %v", dsn, want)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+
+	"github.com/sking2600/coap-gateway/pkg/registry"
+	"github.com/sking2600/coap-gateway/pkg/routing"
+)
+
+var (
+	envRouter       = "ROUTER"
+	envPodNamespace = "POD_NAMESPACE"
+
+	//podNamespace is the namespace the coap-interface pods run in
+	podNamespace = "default"
+	//streamReplyTimeout is how long the stream router waits for the pod to reply
+	streamReplyTimeout = 10 * time.Second
+	//errReplyTimeout is returned when the pod didn't reply in time (ex: it died after the route was looked up)
+	errReplyTimeout = errors.New("timed out waiting for the coap-interface to reply")
+	//errObserveUnsupported is returned by routers that can't stream notifications
+	errObserveUnsupported = errors.New("router doesn't support observing resources")
+)
+
+//DeviceRequest is a request forwarded to the coap-interface pod that's connected to the device
+type DeviceRequest struct {
+	Method      string //GET, POST, PUT or DELETE on href. a DELETE without href closes the device's session instead
+	DeviceID    string
+	Href        string
+	Query       string //raw query string, sent to the device as uri-query options
+	ContentType string //of Body, JSON is converted to CBOR by the coap-interface
+	Accept      string //media types the response can be sent in, a CBOR response is converted to JSON unless CBOR is asked for
+	Body        []byte
+}
+
+//DeviceResponse is what the coap-interface pod responded with
+type DeviceResponse struct {
+	Status      int
+	ContentType string
+	Body        []byte
+	//DeviceResponded is false if the pod answered by itself, ex: 404 when the device isn't connected to it or 409 when it no
+	//longer owns the route
+	DeviceResponded bool
+}
+
+//DeviceStream is the notification stream of an observed resource. Body stays open until the observation ends or ctx is done
+type DeviceStream struct {
+	Status      int
+	ContentType string
+	Body        io.ReadCloser
+}
+
+/*Router forwards requests to the coap-interface pod that holds the route. the epoch of the route is sent along so that the pod
+answers 409 Conflict if it no longer owns it
+*/
+type Router interface {
+	Forward(ctx context.Context, route routing.Route, req DeviceRequest) (DeviceResponse, error)
+	//Observe streams the notifications of req.Href as server-sent events until ctx is done. returns errObserveUnsupported if the
+	//router can't stream
+	Observe(ctx context.Context, route routing.Route, req DeviceRequest) (DeviceStream, error)
+}
+
+//deviceRespondedHeader is set by the coap-interface on the responses that come from the device
+const deviceRespondedHeader = "Device-Responded"
+
+//newRouter returns the router selected by ROUTER ("redis-stream" or "http" which is the default)
+func newRouter() (Router, error) {
+	if ns := os.Getenv(envPodNamespace); ns != "" {
+		podNamespace = ns
+	}
+	if os.Getenv(envRouter) != "redis-stream" {
+		return httpRouter{client: http.DefaultClient}, nil
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	//restarted instances get a new reply stream, so they can't pick up replies meant for their predecessor
+	suffix, err := registry.GenerateRandomString(6)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(&redis.Options{
+		Addr:     os.Getenv("CACHE_URI"),
+		Password: os.Getenv("CACHE_PASSWORD"),
+	})
+	log.Println("routing requests to the coap-interface through redis streams")
+	return newStreamRouter(client, hostname+"-"+suffix), nil
+}
+
+//podEndpoint returns the URL of path on the coap-interface pod with that ip
+func podEndpoint(ip, path string) string {
+	return fmt.Sprintf("http://%s.%s.pod.cluster.local:8081/%s", strings.Replace(ip, ".", "-", -1), podNamespace, path)
+}
+
+//httpRouter sends the requests straight to the pod through its cluster DNS name
+type httpRouter struct {
+	client *http.Client
+}
+
+func (h httpRouter) Forward(ctx context.Context, route routing.Route, r DeviceRequest) (DeviceResponse, error) {
+	path := r.DeviceID
+	if r.Href != "" {
+		path += "/" + r.Href
+	}
+	if r.Query != "" {
+		path += "?" + r.Query
+	}
+	req, err := http.NewRequest(r.Method, podEndpoint(route.PodAddr, path), bytes.NewBuffer(r.Body))
+	if err != nil {
+		return DeviceResponse{}, err
+	}
+	if r.ContentType != "" {
+		req.Header.Set("Content-Type", r.ContentType)
+	}
+	if r.Accept != "" {
+		req.Header.Set("Accept", r.Accept)
+	}
+	setRouteEpoch(req, route)
+	res, err := h.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return DeviceResponse{}, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	return DeviceResponse{
+		Status:          res.StatusCode,
+		ContentType:     res.Header.Get("Content-Type"),
+		Body:            body,
+		DeviceResponded: res.Header.Get(deviceRespondedHeader) == "true",
+	}, err
+}
+
+//Observe keeps the request to the pod open, the pod cancels the observation once it goes away
+func (h httpRouter) Observe(ctx context.Context, route routing.Route, r DeviceRequest) (DeviceStream, error) {
+	req, err := http.NewRequest(http.MethodGet, podEndpoint(route.PodAddr, r.DeviceID+"/"+r.Href), nil)
+	if err != nil {
+		return DeviceStream{}, err
+	}
+	req.Header.Set("Accept", r.Accept)
+	setRouteEpoch(req, route)
+	res, err := h.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return DeviceStream{}, err
+	}
+	return DeviceStream{Status: res.StatusCode, ContentType: res.Header.Get("Content-Type"), Body: res.Body}, nil
+}
+
+/*streamRouter publishes the requests to the stream the pod consumes and waits for the reply on a stream of its own.
+a single goroutine reads the replies and hands each one to the request with the same correlation id
+*/
+type streamRouter struct {
+	client  *redis.Client
+	replyTo string
+	mutex   sync.Mutex
+	pending map[string]chan routing.StreamReply
+}
+
+func newStreamRouter(client *redis.Client, instanceID string) *streamRouter {
+	s := &streamRouter{
+		client:  client,
+		replyTo: routing.ReplyStream(instanceID),
+		pending: make(map[string]chan routing.StreamReply),
+	}
+	go s.readReplies()
+	return s
+}
+
+func (s *streamRouter) Forward(ctx context.Context, route routing.Route, r DeviceRequest) (DeviceResponse, error) {
+	id, err := registry.GenerateRandomString(16)
+	if err != nil {
+		return DeviceResponse{}, err
+	}
+	reply := make(chan routing.StreamReply, 1)
+	s.mutex.Lock()
+	s.pending[id] = reply
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.pending, id)
+		s.mutex.Unlock()
+	}()
+	err = routing.PublishRequest(s.client, route.PodAddr, routing.StreamRequest{
+		ID:          id,
+		ReplyTo:     s.replyTo,
+		Method:      r.Method,
+		DeviceID:    r.DeviceID,
+		Href:        r.Href,
+		Query:       r.Query,
+		Epoch:       route.Epoch,
+		ContentType: r.ContentType,
+		Accept:      r.Accept,
+		Body:        r.Body,
+	})
+	if err != nil {
+		return DeviceResponse{}, err
+	}
+	timer := time.NewTimer(streamReplyTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-reply:
+		return DeviceResponse{Status: res.Status, ContentType: res.ContentType, Body: res.Body, DeviceResponded: res.DeviceResponded}, nil
+	case <-timer.C:
+		return DeviceResponse{}, errReplyTimeout
+	case <-ctx.Done():
+		return DeviceResponse{}, ctx.Err()
+	}
+}
+
+//Observe isn't supported, a stream request gets a single reply
+func (s *streamRouter) Observe(ctx context.Context, route routing.Route, r DeviceRequest) (DeviceStream, error) {
+	return DeviceStream{}, errObserveUnsupported
+}
+
+//readReplies reads the reply stream for as long as the process runs
+func (s *streamRouter) readReplies() {
+	//the stream is new, so reading it from the start can't return replies to other instances
+	lastID := "0"
+	for {
+		replies, next, err := routing.ReadReplies(s.client, s.replyTo, lastID, 5*time.Second)
+		if err != nil {
+			log.Println("err reading replies from ", s.replyTo, ": ", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		lastID = next
+		for _, reply := range replies {
+			s.mutex.Lock()
+			ch, ok := s.pending[reply.ID]
+			s.mutex.Unlock()
+			if !ok {
+				log.Println("dropping reply ", reply.ID, " since nobody is waiting for it anymore")
+				continue
+			}
+			//the channel is buffered for the one reply, duplicates are dropped
+			select {
+			case ch <- reply:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+//defaultShutdownTimeout leaves some room before kubernetes' default terminationGracePeriodSeconds of 30 kills the pod
+const defaultShutdownTimeout = 25 * time.Second
+
+//draining is set to 1 once the pod received SIGTERM/SIGINT, accessed atomically
+var draining int32
+
+//shutdownTimeout returns SHUTDOWN_TIMEOUT (in seconds) or defaultShutdownTimeout
+func shutdownTimeout() time.Duration {
+	v := os.Getenv(envShutdownTimeout)
+	if v == "" {
+		return defaultShutdownTimeout
+	}
+	seconds, err := strconv.Atoi(v)
+	if err != nil || seconds < 0 {
+		log.Printf("Invalid value '%v' of env variable '%v'", v, envShutdownTimeout)
+		return defaultShutdownTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+//cancelOnShutdown cancels the context of every in-flight request once ctx is done, so that the registry calls they're
+//making give up instead of holding the shutdown past its deadline
+func cancelOnShutdown(ctx context.Context, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqCtx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		go func() {
+			select {
+			case <-ctx.Done():
+				cancel()
+			case <-reqCtx.Done():
+			}
+		}()
+		h.ServeHTTP(w, r.WithContext(reqCtx))
+	})
+}
+
+/*serve runs the server until SIGTERM or SIGINT. it then reports not ready, stops accepting connections and waits up to
+SHUTDOWN_TIMEOUT for the in-flight requests, which are cancelled (through cancel) if they're still running by then
+*/
+func serve(server *http.Server, cancel context.CancelFunc) error {
+	errs := make(chan error, 1)
+	go func() { errs <- server.ListenAndServe() }()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-sigs:
+		log.Println("received ", sig, ", shutting down")
+	}
+	atomic.StoreInt32(&draining, 1)
+	ctx, done := context.WithTimeout(context.Background(), shutdownTimeout())
+	defer done()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.Println("in-flight requests didn't finish before the shutdown deadline: ", err)
+		cancel()
+		return server.Close()
+	}
+	cancel()
+	return nil
+}
+
+//handleReadiness reports not ready once the pod started shutting down
+func handleReadiness(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&draining) == 1 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("shutting down"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
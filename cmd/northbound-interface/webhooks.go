@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"github.com/go-zoo/bone"
+
+	"github.com/sking2600/coap-gateway/pkg/registry"
+	"github.com/sking2600/coap-gateway/pkg/webhooks"
+)
+
+//events delivers the command results to the webhooks of the devices' owners. nil emits nothing
+var events *webhooks.Dispatcher
+
+//newWebhookStore returns the store of the webhook subscriptions, shared with the coap-interface
+func newWebhookStore() webhooks.Store {
+	if os.Getenv(envRegistryBackend) == "memory" {
+		return webhooks.NewMemoryStore()
+	}
+	return webhooks.NewRedisStore(redis.NewClient(&redis.Options{
+		Addr:     os.Getenv("CACHE_URI"),
+		Password: os.Getenv("CACHE_PASSWORD"),
+	}))
+}
+
+//WebhookRequest is the body of POST /webhooks. the subscription belongs to the mediator if MediatorToken is set and to the user
+//of the client access token in the authorization header otherwise
+type WebhookRequest struct {
+	URL           string   `json:"url"`
+	Secret        string   `json:"secret,omitempty"`
+	Mode          string   `json:"mode,omitempty"`
+	Types         []string `json:"types,omitempty"`
+	MediatorToken string   `json:"mediatortoken,omitempty"`
+}
+
+//bearerUser returns the user of the access token in the authorization header. it writes the error response and returns false otherwise
+func bearerUser(w http.ResponseWriter, r *http.Request, db registry.Registry) (string, bool) {
+	accessToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if accessToken == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return "", false
+	}
+	userID, err := db.LookupUser(r.Context(), accessToken)
+	if err != nil {
+		log.Println("err looking up user of access token: ", err)
+		w.WriteHeader(statusFromError(err))
+		return "", false
+	}
+	return userID, true
+}
+
+/*handleRegisterWebhook handles POST /webhooks {url, secret, mode, types, mediatortoken}. mode is "structured" (the default) or
+"binary", an empty types subscribes to every event. a secret is generated if none is given. responds with the subscription
+*/
+func handleRegisterWebhook(db registry.Registry, store webhooks.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req WebhookRequest
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Println("err from reading body from POST /webhooks: ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		err = json.Unmarshal(body, &req)
+		if err != nil {
+			log.Println("err unmarshalling body from POST /webhooks: ", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		err = webhooks.ValidateURL(r.Context(), req.URL)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if req.Mode == "" {
+			req.Mode = webhooks.ModeStructured
+		}
+		if req.Mode != webhooks.ModeStructured && req.Mode != webhooks.ModeBinary {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("mode must be structured or binary"))
+			return
+		}
+		s := webhooks.Subscription{URL: req.URL, Secret: req.Secret, Mode: req.Mode, Types: req.Types}
+		if req.MediatorToken != "" {
+			s.MediatorID, s.UserID, err = db.LookupMediator(r.Context(), req.MediatorToken)
+			if err != nil {
+				log.Println("err looking up mediator of webhook: ", err)
+				w.WriteHeader(statusFromError(err))
+				return
+			}
+		} else {
+			var ok bool
+			s.UserID, ok = bearerUser(w, r, db)
+			if !ok {
+				return
+			}
+		}
+		s.ID, err = registry.GenerateRandomString(16)
+		if err == nil && s.Secret == "" {
+			s.Secret, err = registry.GenerateRandomString(tokenEntropy)
+		}
+		if err != nil {
+			log.Println("err generating webhook id or secret: ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		err = store.AddSubscription(s)
+		if err != nil {
+			log.Println("err storing webhook: ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		response, err := json.Marshal(s)
+		if err != nil {
+			log.Println("error marshalling response body: ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(response)
+	}
+}
+
+//handleListWebhooks handles GET /webhooks. it responds with the subscriptions of the user of the access token, without their secrets
+func handleListWebhooks(db registry.Registry, store webhooks.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := bearerUser(w, r, db)
+		if !ok {
+			return
+		}
+		subscriptions, err := store.Subscriptions(userID)
+		if err != nil {
+			log.Println("err getting webhooks of ", userID, ": ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		for i := range subscriptions {
+			subscriptions[i].Secret = ""
+		}
+		if subscriptions == nil {
+			subscriptions = []webhooks.Subscription{}
+		}
+		response, err := json.Marshal(subscriptions)
+		if err != nil {
+			log.Println("error marshalling response body: ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response)
+	}
+}
+
+//userWebhook returns the subscription in the :id path param if it belongs to the user of the access token.
+//it writes the error response and returns false otherwise
+func userWebhook(w http.ResponseWriter, r *http.Request, db registry.Registry, store webhooks.Store) (webhooks.Subscription, bool) {
+	userID, ok := bearerUser(w, r, db)
+	if !ok {
+		return webhooks.Subscription{}, false
+	}
+	s, err := store.Subscription(bone.GetValue(r, "id"))
+	if err == webhooks.ErrSubscriptionNotFound || (err == nil && s.UserID != userID) {
+		w.WriteHeader(http.StatusNotFound)
+		return s, false
+	}
+	if err != nil {
+		log.Println("err getting webhook: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return s, false
+	}
+	return s, true
+}
+
+//handleDeleteWebhook handles DELETE /webhooks/:id
+func handleDeleteWebhook(db registry.Registry, store webhooks.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, ok := userWebhook(w, r, db, store)
+		if !ok {
+			return
+		}
+		err := store.DeleteSubscription(s.ID)
+		if err != nil {
+			log.Println("err deleting webhook ", s.ID, ": ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+//handleDeadLetters handles GET /webhooks/:id/deadletters. it responds with the events that couldn't be delivered, newest first
+func handleDeadLetters(db registry.Registry, store webhooks.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, ok := userWebhook(w, r, db, store)
+		if !ok {
+			return
+		}
+		letters, err := store.DeadLetters(s.ID)
+		if err != nil {
+			log.Println("err getting dead letters of webhook ", s.ID, ": ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		response, err := json.Marshal(letters)
+		if err != nil {
+			log.Println("error marshalling response body: ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response)
+	}
+}
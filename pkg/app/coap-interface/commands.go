@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+
+	"github.com/sking2600/coap-gateway/pkg/commands"
+	"github.com/sking2600/coap-gateway/pkg/payload"
+	"github.com/sking2600/coap-gateway/pkg/webhooks"
+)
+
+var (
+	envCommandRetention = "COMMAND_RETENTION"
+
+	defaultCommandRetention = 24 * time.Hour
+	//commandLease is how long a delivery may take before the command can be claimed again
+	commandLease = 30 * time.Second
+
+	//commandQueue holds the asynchronous commands that the northbound-interface couldn't deliver
+	commandQueue commands.Queue = commands.NewMemoryQueue(defaultCommandRetention)
+)
+
+//newCommandQueue returns the queue shared with the northbound-interface. results are kept for COMMAND_RETENTION seconds
+func newCommandQueue() commands.Queue {
+	retention := defaultCommandRetention
+	if v := os.Getenv(envCommandRetention); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds < 0 {
+			log.Printf("Invalid value '%v' of env variable '%v'", v, envCommandRetention)
+		} else {
+			retention = time.Duration(seconds) * time.Second
+		}
+	}
+	if os.Getenv(envRegistryBackend) == "memory" {
+		return commands.NewMemoryQueue(retention)
+	}
+	client := redis.NewClient(&redis.Options{
+		Addr:     redisAddress,
+		Password: redisPassword,
+	})
+	return commands.NewRedisQueue(client, retention)
+}
+
+//deliverCommands sends the queued commands of a device that just signed in, oldest first. the ones that can't be delivered
+//(the device went away or didn't respond) stay queued for its next session, the ones the pod rejects are completed with its status
+func deliverCommands(deviceID string) {
+	pending, err := commandQueue.Pending(deviceID)
+	if err != nil {
+		log.Println("err getting queued commands of ", deviceID, ": ", err)
+		return
+	}
+	for _, c := range pending {
+		err := commandQueue.Claim(c.ID, commandLease)
+		if err != nil {
+			continue
+		}
+		status, _, result, err := forwardToDevice(deviceID, c.Method, c.Href, c.Query, c.ContentType, payload.JSON, c.Body)
+		if err == errorDeviceNotConnected || status == http.StatusBadGateway {
+			log.Println("command ", c.ID, " wasn't delivered to ", deviceID, ", it stays queued")
+			err = commandQueue.Release(c.ID)
+			if err != nil {
+				log.Println("err releasing command ", c.ID, ": ", err)
+			}
+			return
+		}
+		//the command itself is invalid (ex: 415 for its body), retrying it would block the ones after it
+		if err != nil {
+			log.Println("command ", c.ID, " for ", deviceID, " failed with ", status, ": ", err)
+		}
+		err = commandQueue.Complete(c.ID, status, result)
+		if err != nil {
+			log.Println("err completing command ", c.ID, ": ", err)
+			continue
+		}
+		go events.Emit(inFlight, webhooks.CommandCompleted, deviceID, webhooks.CommandResult{ID: c.ID, DeviceID: deviceID, Href: c.Href, Result: status, Payload: webhooks.JSONPayload(result)})
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"log"
+
+	"github.com/go-ocf/go-coap"
+	"github.com/sking2600/coap-gateway/pkg/payload"
+	"github.com/ugorji/go/codec"
+)
+
+//contentHandle returns the codec of a content format the registration endpoints accept and respond with, nil if it isn't one of them
+func contentHandle(mediaType coap.MediaType) codec.Handle {
+	switch mediaType {
+	case coap.AppOcfCbor, coap.AppCBOR:
+		h := new(codec.CborHandle)
+		h.BasicHandle.Canonical = true
+		return h
+	case coap.AppJSON:
+		return new(codec.JsonHandle)
+	}
+	return nil
+}
+
+/*decodePayload decodes the payload of the request into v according to its content format: vnd.ocf+cbor, cbor or json.
+it responds with 4.15 if the content format is missing or unsupported and with 4.00 if the payload can't be decoded, in which
+case it returns false
+*/
+func decodePayload(w coap.ResponseWriter, req *coap.Request, v interface{}) bool {
+	mediaType, ok := req.Msg.Option(coap.ContentFormat).(coap.MediaType)
+	h := contentHandle(mediaType)
+	if !ok || h == nil {
+		log.Println("unsupported content format of request to ", req.Msg.PathString(), ": ", req.Msg.Option(coap.ContentFormat))
+		err := w.WriteMsg(w.NewResponse(coap.UnsupportedMediaType))
+		if err != nil {
+			log.Println("err from writing response about unsupported content format: ", err)
+		}
+		return false
+	}
+	err := codec.NewDecoderBytes(req.Msg.Payload(), h).Decode(v)
+	if err != nil {
+		log.Println("err decoding payload of request to ", req.Msg.PathString(), ": ", err)
+		err := w.WriteMsg(w.NewResponse(coap.BadRequest))
+		if err != nil {
+			log.Println("err from writing response about error decoding payload: ", err)
+		}
+		return false
+	}
+	return true
+}
+
+//responseFormat returns the content format the accept option of the request asks for, vnd.ocf+cbor if it has none.
+//ok is false if the format isn't supported
+func responseFormat(req *coap.Request) (mediaType coap.MediaType, ok bool) {
+	accept := req.Msg.Option(coap.Accept)
+	if accept == nil {
+		return coap.AppOcfCbor, true
+	}
+	mediaType, ok = accept.(coap.MediaType)
+	return mediaType, ok && contentHandle(mediaType) != nil
+}
+
+//writePayload responds with code and v encoded in the content format the request accepts, or with 4.06 if it isn't supported
+func writePayload(w coap.ResponseWriter, req *coap.Request, code coap.COAPCode, v interface{}) error {
+	mediaType, ok := responseFormat(req)
+	if !ok {
+		return w.WriteMsg(w.NewResponse(coap.NotAcceptable))
+	}
+	buf := new(bytes.Buffer)
+	err := codec.NewEncoder(buf, contentHandle(mediaType)).Encode(v)
+	if err != nil {
+		w.WriteMsg(w.NewResponse(coap.InternalServerError))
+		return err
+	}
+	return writeEncoded(w, code, mediaType, buf.Bytes())
+}
+
+//writeJSONPayload is writePayload for a document the registry already encoded as json
+func writeJSONPayload(w coap.ResponseWriter, req *coap.Request, code coap.COAPCode, doc string) error {
+	mediaType, ok := responseFormat(req)
+	if !ok {
+		return w.WriteMsg(w.NewResponse(coap.NotAcceptable))
+	}
+	if mediaType == coap.AppJSON {
+		return writeEncoded(w, code, mediaType, []byte(doc))
+	}
+	b, err := payload.JSONToCBOR([]byte(doc))
+	if err != nil {
+		w.WriteMsg(w.NewResponse(coap.InternalServerError))
+		return err
+	}
+	return writeEncoded(w, code, mediaType, b)
+}
+
+func writeEncoded(w coap.ResponseWriter, code coap.COAPCode, mediaType coap.MediaType, b []byte) error {
+	res := w.NewResponse(code)
+	res.SetOption(coap.ContentFormat, mediaType)
+	res.SetPayload(b)
+	return w.WriteMsg(res)
+}
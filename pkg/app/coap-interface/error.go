@@ -1,6 +1,12 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-ocf/go-coap"
+	"github.com/sking2600/coap-gateway/pkg/registry"
+)
 
 // Error errors type of coap-gateway
 type Error string
@@ -14,3 +20,58 @@ func ErrEnvNotSet(param string) error {
 
 //ErrEmptyCARootPool ca root pool is empty
 const ErrEmptyCARootPool = Error("CA Root pool is empty.")
+
+//codeFromError maps the registry's sentinel errors to CoAP response codes. anything unexpected is an internal server error
+func codeFromError(err error) coap.COAPCode {
+	switch err {
+	case registry.ErrInvalidToken, registry.ErrTokenExpired:
+		return coap.Unauthorized
+	case registry.ErrMediatorTokenNotFound:
+		return coap.Forbidden
+	case registry.ErrDeviceNotFound:
+		return coap.NotFound
+	case registry.ErrInvalidPublication:
+		return coap.BadRequest
+	}
+	return coap.InternalServerError
+}
+
+//statusFromCode maps the response code of a device to an HTTP status, following RFC 8075. 2.02 Deleted and 2.04 Changed carry no
+//representation, so they become 200 OK just like 2.03 Valid and 2.05 Content
+func statusFromCode(code coap.COAPCode) int {
+	switch code {
+	case coap.Created:
+		return http.StatusCreated
+	case coap.Deleted, coap.Valid, coap.Changed, coap.Content, coap.Continue:
+		return http.StatusOK
+	case coap.BadRequest, coap.BadOption:
+		return http.StatusBadRequest
+	case coap.Unauthorized:
+		return http.StatusUnauthorized
+	case coap.Forbidden:
+		return http.StatusForbidden
+	case coap.NotFound:
+		return http.StatusNotFound
+	case coap.MethodNotAllowed:
+		return http.StatusMethodNotAllowed
+	case coap.NotAcceptable:
+		return http.StatusNotAcceptable
+	case coap.RequestEntityIncomplete:
+		return http.StatusBadRequest
+	case coap.PreconditionFailed:
+		return http.StatusPreconditionFailed
+	case coap.RequestEntityTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case coap.UnsupportedMediaType:
+		return http.StatusUnsupportedMediaType
+	case coap.NotImplemented:
+		return http.StatusNotImplemented
+	case coap.BadGateway, coap.ProxyingNotSupported:
+		return http.StatusBadGateway
+	case coap.ServiceUnavailable:
+		return http.StatusServiceUnavailable
+	case coap.GatewayTimeout:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
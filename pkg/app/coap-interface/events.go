@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+
+	"github.com/go-redis/redis"
+
+	"github.com/sking2600/coap-gateway/pkg/registry"
+	"github.com/sking2600/coap-gateway/pkg/webhooks"
+)
+
+//events delivers the device events to the webhooks of their owners. nil until main sets it up, which emits nothing
+var events *webhooks.Dispatcher
+
+//newDispatcher returns the dispatcher of the webhooks registered through the northbound-interface
+func newDispatcher(db registry.Registry) *webhooks.Dispatcher {
+	if os.Getenv(envRegistryBackend) == "memory" {
+		return webhooks.NewDispatcher(webhooks.NewMemoryStore(), db, "/coap-interface/"+podAddr)
+	}
+	client := redis.NewClient(&redis.Options{
+		Addr:     redisAddress,
+		Password: redisPassword,
+	})
+	return webhooks.NewDispatcher(webhooks.NewRedisStore(client), db, "/coap-interface/"+podAddr)
+}
+
+//sessionEvent is the data of the signed in/out events
+type sessionEvent struct {
+	DeviceID string `json:"di"`
+	LoggedIn bool   `json:"login"`
+}
+
+//notificationEvent is the data of the observe notification events
+type notificationEvent struct {
+	DeviceID string      `json:"di"`
+	Href     string      `json:"href"`
+	Payload  interface{} `json:"payload"`
+}
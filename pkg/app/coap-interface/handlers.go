@@ -5,10 +5,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/go-ocf/go-coap"
 	"github.com/sking2600/coap-gateway/pkg/registry"
+	"github.com/sking2600/coap-gateway/pkg/routing"
+	"github.com/sking2600/coap-gateway/pkg/webhooks"
 	"github.com/ugorji/go/codec"
 )
 
@@ -16,7 +21,6 @@ import (
 //TODO: figure out usage of a redirect URI
 //TODO: find a better name than "Account" even though it's an oic.r.account resource
 //TODO: coap.message.payload should implement the writer interface?
-//TODO: make sure that device can't access certain resources unless it's logged in
 //TODO: more thorough check for malformed requests (invalid json and missing arguments?)
 
 //this struct kinda covers all payloads besides links. maybe I should break this up more?
@@ -42,6 +46,7 @@ type Link struct {
 	Interface    []string   `json:"if"`
 	Policy       Bitmask    `json:"p"` //OCF core spec 7.8.2.1
 	Endpoints    []Endpoint `json:"eps"`
+	InstanceID   int64      `json:"ins,omitempty"` //assigned by the resource directory, anything the device sends is overwritten
 }
 
 type Bitmask struct {
@@ -60,28 +65,120 @@ type Endpoint struct {
 
 type deviceMap struct {
 	devices map[string]*coap.ClientCommander
+	routes  map[string]routing.Route //the route each device claimed when it signed in over its session
 	mutex   sync.Mutex
 }
 
-func (c *deviceMap) addDevice(deviceID string, client *coap.ClientCommander) {
+func (c *deviceMap) addDevice(deviceID string, client *coap.ClientCommander, route routing.Route) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 	c.devices[deviceID] = client
+	c.routes[deviceID] = route
 }
 
+//removeDevice forgets the device and ends its observations
 func (c *deviceMap) removeDevice(deviceID string) {
+	c.mutex.Lock()
+	delete(c.devices, deviceID)
+	delete(c.routes, deviceID)
+	c.mutex.Unlock()
+	observations.closeDevice(deviceID)
+}
+
+//removeSessionDevice forgets the device if it signed in over the session of client (rather than another one since) and returns its route
+func (c *deviceMap) removeSessionDevice(deviceID string, client *coap.ClientCommander) (routing.Route, bool) {
+	c.mutex.Lock()
+	cc, ok := c.devices[deviceID]
+	if !ok || !cc.Equal(client) {
+		c.mutex.Unlock()
+		return routing.Route{}, false
+	}
+	route := c.routes[deviceID]
+	delete(c.devices, deviceID)
+	delete(c.routes, deviceID)
+	c.mutex.Unlock()
+	observations.closeDevice(deviceID)
+	return route, true
+}
+
+//removeSession forgets every device that signed in over the session and returns their routes. called once the session has ended
+func (c *deviceMap) removeSession(client *coap.ClientCommander) map[string]routing.Route {
+	removed := make(map[string]routing.Route)
+	c.mutex.Lock()
+	for deviceID, cc := range c.devices {
+		if cc.Equal(client) {
+			removed[deviceID] = c.routes[deviceID]
+			delete(c.devices, deviceID)
+			delete(c.routes, deviceID)
+		}
+	}
+	c.mutex.Unlock()
+	for deviceID := range removed {
+		observations.closeDevice(deviceID)
+	}
+	return removed
+}
+
+//sessionRoutes returns the routes of the devices that signed in over the session
+func (c *deviceMap) sessionRoutes(client *coap.ClientCommander) map[string]routing.Route {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
+	routes := make(map[string]routing.Route)
+	for deviceID, cc := range c.devices {
+		if cc.Equal(client) {
+			routes[deviceID] = c.routes[deviceID]
+		}
+	}
+	return routes
+}
+
+//allRoutes returns the routes of every device connected to this pod
+func (c *deviceMap) allRoutes() map[string]routing.Route {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	routes := make(map[string]routing.Route, len(c.routes))
+	for deviceID, route := range c.routes {
+		routes[deviceID] = route
+	}
+	return routes
+}
+
+//route returns the route the device claimed, if it is connected to this pod
+func (c *deviceMap) route(deviceID string) (routing.Route, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	route, ok := c.routes[deviceID]
+	return route, ok
+}
+
+//client returns the session of the device, if it is connected to this pod
+func (c *deviceMap) client(deviceID string) (*coap.ClientCommander, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	client, ok := c.devices[deviceID]
+	return client, ok
+}
+
+//closeDevice removes the device and aborts its session, if this pod is connected to it
+func (c *deviceMap) closeDevice(deviceID string) {
+	c.mutex.Lock()
+	client, ok := c.devices[deviceID]
 	delete(c.devices, deviceID)
+	delete(c.routes, deviceID)
+	c.mutex.Unlock()
+	observations.closeDevice(deviceID)
+	if !ok {
+		return
+	}
+	abortSession(client, "device deregistered")
 }
 
 func (c *deviceMap) exchange(deviceID string, m coap.Message) (coap.Message, error) {
 	return c.devices[deviceID].Exchange(m)
 }
 
-//TODO potential bug: am I properly removing these devices from the map when they disconnect?
 var (
-	deviceContainer = &deviceMap{devices: make(map[string]*coap.ClientCommander)}
+	deviceContainer = &deviceMap{devices: make(map[string]*coap.ClientCommander), routes: make(map[string]routing.Route)}
 )
 
 func decodeMsg(resp coap.Message, tag string) {
@@ -121,79 +218,87 @@ func DefaultHandler(s coap.ResponseWriter, req *coap.Request) {
 
 //TODO: the coap mux should discriminate between message codes. I should be able to have
 //different handlers for UPDATE and DELETE
-//todo: check media type for being json, cbor or vnd.ocf+cbor
 //TODO: verify that error response codes are correct
-//maybe also use these mediatypes || mediaType == coap.AppCBOR || coap.AppJSON
 //POTENTIAL SECURITY VULN: do i need to verify whether this is a mediated token or just an access token in the same field? it seems like a bad idea for the the access token to be able to be used to provision new refresh tokens
 func handleAccountUpdateOrDelete(db registry.Registry) func(coap.ResponseWriter, *coap.Request) {
 
 	return func(w coap.ResponseWriter, req *coap.Request) {
-		//TODO support these mediatypes: mediaType == coap.AppCBOR || coap.AppJSON
-		if mediaType := req.Msg.Option(coap.ContentFormat).(coap.MediaType); mediaType != coap.AppOcfCbor {
-			w.WriteMsg(w.NewResponse(coap.UnsupportedMediaType))
-			return
-		}
 		code := req.Msg.Code()
 		if code == coap.PUT || code == coap.POST { //TODO: figure out whether it should be POST or PUT for the OCF spec
 			fmt.Println("code was POST or PUT")
 			var a Account
-			err := codec.NewDecoderBytes(req.Msg.Payload(), new(codec.CborHandle)).Decode(&a)
-			if err != nil {
-				err := w.WriteMsg(w.NewResponse(coap.BadRequest))
-				if err != nil {
-					log.Println("err from writing response about error decoding payload: ", err)
-					return
-				}
+			if !decodePayload(w, req, &a) || !sameDevice(w, req, a.DeviceID) || !certifiedDevice(w, req, a.DeviceID) {
 				return
 			}
 			fmt.Println("decoded vals:\n deviceID: ", a.DeviceID, "\naccessToken: ", a.AccessToken)
 			var body Account
-			body.AccessToken, body.UserID, body.RefreshToken, body.TokenTTL, err = db.RegisterDevice(a.DeviceID, a.AccessToken)
+			var err error
+			body.AccessToken, body.UserID, body.RefreshToken, body.TokenTTL, err = db.RegisterDevice(inFlight, a.DeviceID, a.AccessToken)
 			if err != nil {
-				w.WriteMsg(w.NewResponse(coap.InternalServerError))
-				log.Fatal("err registering device: ", err)
+				//ErrInvalidToken means that the arguments supplied to db.RegisterDevice were not valid together (ex: the mediated token was already used)
+				w.WriteMsg(w.NewResponse(codeFromError(err)))
+				log.Println("err registering device: ", err)
 				return
 			}
-			if body.AccessToken == "" {
-				//this means that the arguments supplied to db.RegisterDevice were not valid together (ex: token associated with a different userID)
-				w.WriteMsg(w.NewResponse(coap.InternalServerError))
-				log.Println("err registering device. probably because of invalid deviceID+token: ", err)
-				return
-			}
-			res := w.NewResponse(coap.Created)
-			res.SetOption(coap.ContentFormat, coap.AppOcfCbor)
-
-			buf := new(bytes.Buffer)
-			h := new(codec.CborHandle)
-			h.BasicHandle.Canonical = true
-			enc := codec.NewEncoder(buf, h)
-			err = enc.Encode(body)
+			go events.Emit(inFlight, webhooks.DeviceRegistered, a.DeviceID, Account{DeviceID: a.DeviceID, UserID: body.UserID})
+			err = writePayload(w, req, coap.Created, body)
 			if err != nil {
-				w.WriteMsg(w.NewResponse(coap.InternalServerError))
-				log.Println("error encoding body: ", err) //TODO make sure this error handling is correct
-			}
-			res.SetPayload(buf.Bytes())
-			w.WriteMsg(res)
-
-			if err != nil {
-				w.WriteMsg(w.NewResponse(coap.InternalServerError))
-				log.Println("error sending response to device == ", a.DeviceID, ": ", err) //TODO make sure this error handling is correct
-				return
+				log.Println("error sending response to device == ", a.DeviceID, ": ", err)
 			}
 			return
 			//todo figure out what the status code and stuff should be for response upon success/failure
 
 		}
 		if code == coap.DELETE {
-			//TODO implement delete the user, client or device if the token is valid, return 403/404 otherwise?
-		} else {
-			err := w.WriteMsg(w.NewResponse(coap.MethodNotAllowed))
-			//TODO send some error about an unsupported code
-			if err != nil {
-				log.Println("error writing METHOD_NOT_ALLOWED response code: ", err)
-			}
+			handleAccountDelete(db, w, req)
+			return
 		}
+		err := w.WriteMsg(w.NewResponse(coap.MethodNotAllowed))
+		//TODO send some error about an unsupported code
+		if err != nil {
+			log.Println("error writing METHOD_NOT_ALLOWED response code: ", err)
+		}
+	}
+}
+
+//handleAccountDelete deregisters the device. DELETE has no payload, so di, uid (optional) and accesstoken are sent as uri-query options.
+//responds with 2.02 Deleted and then closes the session, 4.01 if the token is invalid or 4.04 if the device doesn't exist
+func handleAccountDelete(db registry.Registry, w coap.ResponseWriter, req *coap.Request) {
+	query := parseQuery(req.Msg.Query())
+	deviceID, userID, accessToken := query.Get("di"), query.Get("uid"), query.Get("accesstoken")
+	if deviceID == "" || accessToken == "" {
+		log.Println("missing di or accesstoken from DELETE /oic/sec/account")
+		w.WriteMsg(w.NewResponse(coap.Unauthorized))
+		return
+	}
+	if !sameDevice(w, req, deviceID) || !certifiedDevice(w, req, deviceID) {
+		return
+	}
+	err := db.DeleteDevice(inFlight, deviceID, userID, accessToken)
+	if err != nil {
+		log.Println("err deleting device ", deviceID, ": ", err)
+		err := w.WriteMsg(w.NewResponse(codeFromError(err)))
+		if err != nil {
+			log.Println("error sending error code in response to DELETE /oic/sec/account: ", err)
+		}
+		return
+	}
+	deviceContainer.removeDevice(deviceID)
+	err = w.WriteMsg(w.NewResponse(coap.Deleted))
+	if err != nil {
+		log.Println("error sending response to DELETE /oic/sec/account: ", err)
 	}
+	//the device is no longer registered, so there is no reason to keep its session open
+	abortSession(req.Client, "device deregistered")
+}
+
+//parseQuery turns the uri-query options (ex: ["di=123", "accesstoken=abc"]) into url.Values
+func parseQuery(options []string) url.Values {
+	query, err := url.ParseQuery(strings.Join(options, "&"))
+	if err != nil {
+		log.Println("err parsing uri-query: ", err)
+	}
+	return query
 }
 
 //TODO ensure access token isn't expired
@@ -206,108 +311,168 @@ func handleSessionUpdate(db registry.Registry) func(coap.ResponseWriter, *coap.R
 		}
 		fmt.Println("code was POST")
 		var a Account
-		err := codec.NewDecoderBytes(req.Msg.Payload(), new(codec.CborHandle)).Decode(&a)
-		if err != nil {
-			err := w.WriteMsg(w.NewResponse(coap.BadRequest))
-			if err != nil {
-				log.Println("err from writing response about error decoding payload: ", err)
-				return
-			}
+		if !decodePayload(w, req, &a) || !sameDevice(w, req, a.DeviceID) || !certifiedDevice(w, req, a.DeviceID) {
+			return
 		}
 		fmt.Println("deviceID: ", a.DeviceID, "\nuserID: ", a.UserID, "\naccessToken: ", a.AccessToken, "\nlogin: ", a.LoggedIn)
-		expiresIn, err := db.UpdateSession(a.DeviceID, a.UserID, a.AccessToken, podAddr, a.LoggedIn)
+		if !a.LoggedIn {
+			handleSignOut(db, w, req, a)
+			return
+		}
+		expiresIn, route, err := db.UpdateSession(inFlight, a.DeviceID, a.UserID, a.AccessToken, routing.Route{PodAddr: podAddr}, true)
 		if err != nil {
 			log.Println("err from registry.UpdateSession: ", err)
-			//todo: send internal server error
+			err := w.WriteMsg(w.NewResponse(codeFromError(err)))
+			if err != nil {
+				log.Println("error sending error code in response to UPDATE /oic/sec/session: ", err)
+			}
 			return
 		}
-		if a.LoggedIn {
-			log.Println("recieved request to /oic/sec/session with loggedin=true")
-			b, err := Account{TokenTTL: expiresIn}.MarshalCBOR()
+		log.Println("recieved request to /oic/sec/session with loggedin=true")
+		log.Println("about to add to deviceContainer this device: ", a.DeviceID)
+		//the session is signed in before the response goes out, the device may send /oic/rd right after it
+		clientContainer.signIn(req.Client, sessionState{deviceID: a.DeviceID, userID: a.UserID, expiresAt: tokenExpiry(expiresIn)})
+		deviceContainer.addDevice(a.DeviceID, req.Client, route)
+		//todo: confirm correct response code
+		err = writePayload(w, req, coap.Created, Account{TokenTTL: expiresIn})
+		if err != nil {
+			log.Println("error sending token TTL in response to UPDATE /oic/sec/session\n", err)
+		}
+		go deliverCommands(a.DeviceID)
+		go events.Emit(inFlight, webhooks.DeviceSignedIn, a.DeviceID, sessionEvent{DeviceID: a.DeviceID, LoggedIn: true})
+	}
+
+}
+
+//handleSignOut signs the device out of the session. the device and its route are only dropped if the device signed in over this
+//session, it may have signed in over another one (on this pod or another) since
+func handleSignOut(db registry.Registry, w coap.ResponseWriter, req *coap.Request, a Account) {
+	log.Println("recieved request to /oic/sec/session with loggedin=false")
+	if route, ok := deviceContainer.removeSessionDevice(a.DeviceID, req.Client); ok {
+		_, _, err := db.UpdateSession(inFlight, a.DeviceID, a.UserID, a.AccessToken, route, false)
+		if err != nil {
+			log.Println("err from registry.UpdateSession: ", err)
+			err := w.WriteMsg(w.NewResponse(codeFromError(err)))
 			if err != nil {
-				log.Println("error converting struct to cbor when responding to UPDATE /oic/sec/session:\n", err)
-				return
+				log.Println("error sending error code in response to UPDATE /oic/sec/session: ", err)
 			}
+			return
+		}
+		go events.Emit(inFlight, webhooks.DeviceSignedOut, a.DeviceID, sessionEvent{DeviceID: a.DeviceID})
+	}
+	clientContainer.signOut(req.Client)
+	//TODO should I be setting any payload on this response?
+	err := w.WriteMsg(w.NewResponse(coap.Changed))
+	if err != nil {
+		log.Println("error from sending response to delete device request: ", err)
+	}
+}
 
-			fmt.Println("response payload is ", len(b), " bytes long")
-			res := w.NewResponse(coap.Created) //todo: confirm correct response code
-			res.SetPayload(b)
-			res.SetOption(coap.ContentFormat, coap.AppOcfCbor)
-			err = w.WriteMsg(res)
+//handleResourceDirectory handles /oic/rd. UPDATE publishes links incrementally, RETRIEVE returns what the device has published
+//and DELETE removes links by instance id. every other method gets 4.05
+func handleResourceDirectory(db registry.Registry) func(coap.ResponseWriter, *coap.Request) {
+	return func(w coap.ResponseWriter, req *coap.Request) {
+		switch req.Msg.Code() {
+		case coap.POST:
+			handleRDUpdate(db, w, req)
+		case coap.GET:
+			handleRDRetrieve(db, w, req)
+		case coap.DELETE:
+			handleRDDelete(db, w, req)
+		default:
+			err := w.WriteMsg(w.NewResponse(coap.MethodNotAllowed))
 			if err != nil {
-				log.Println("error sending token TTL in response to UPDATE /oic/sec/session\n", err)
-				w.WriteMsg(w.NewResponse(coap.InternalServerError))
+				log.Println("error writing METHOD_NOT_ALLOWED response code: ", err)
 			}
-			log.Println("about to add to deviceContainer this device: ", a.DeviceID)
-			deviceContainer.addDevice(a.DeviceID, req.Client)
-			return
 		}
-		log.Println("recieved request to /oic/sec/session with loggedin=false")
-		deviceContainer.removeDevice(a.DeviceID)
-		res := w.NewResponse(coap.Changed)
-		//TODO should I be setting any payload on this response?
-		err = w.WriteMsg(res)
+	}
+}
+
+//handleRDUpdate publishes the links in the payload. links with an href the device already published are replaced and the
+//rest are added. responds with the published links, which now carry their instance id ("ins")
+//the di of the payload has to be the device the session signed in as
+func handleRDUpdate(db registry.Registry, w coap.ResponseWriter, req *coap.Request) {
+	var rp ResourcePublication
+	if !decodePayload(w, req, &rp) || !sameDevice(w, req, rp.DeviceID) {
+		return
+	}
+	out, err := json.Marshal(rp)
+	if err != nil {
+		log.Println("error marshalling payload to json: ", err)
+		w.WriteMsg(w.NewResponse(coap.InternalServerError))
+		return
+	}
+	published, err := db.PublishResource(inFlight, string(out), rp.DeviceID)
+	if err != nil {
+		log.Println("error publishing resources of ", rp.DeviceID, ": ", err)
+		err := w.WriteMsg(w.NewResponse(codeFromError(err)))
 		if err != nil {
-			log.Println("error from sending response to delete device request: ", err)
+			log.Println("error sending error message to device: ", err)
 		}
 		return
-		//TODO: implement device logging out. this should include deleting its redis entry
-
 	}
+	writePublication(w, req, coap.Created, published)
+	go events.Emit(inFlight, webhooks.ResourcesPublished, rp.DeviceID, json.RawMessage(published))
+}
 
+//handleRDRetrieve responds with every link the device has published. the device is selected with the di uri-query option
+func handleRDRetrieve(db registry.Registry, w coap.ResponseWriter, req *coap.Request) {
+	deviceID := parseQuery(req.Msg.Query()).Get("di")
+	if deviceID == "" {
+		w.WriteMsg(w.NewResponse(coap.BadRequest))
+		return
+	}
+	if !sameDevice(w, req, deviceID) {
+		return
+	}
+	publication, err := db.RetrievePublishedResources(inFlight, deviceID)
+	if err != nil {
+		log.Println("err retrieving resources published by ", deviceID, ": ", err)
+		w.WriteMsg(w.NewResponse(codeFromError(err)))
+		return
+	}
+	writePublication(w, req, coap.Content, publication)
 }
 
-//TODO this isn't complete.
-//TODO potential bug: I am determining the device UUID from the "di" field of the payload rather than the "di" field from the UPDATE /oic/sec/session request
-func handleRDUpdate(db registry.Registry) func(coap.ResponseWriter, *coap.Request) {
-	return func(w coap.ResponseWriter, req *coap.Request) {
-		//TODO: make sure device has logged in/has issued an UPDATE request to oic/sec/session
-		if mediaType := req.Msg.Option(coap.ContentFormat).(coap.MediaType); mediaType != coap.AppOcfCbor {
-			w.WriteMsg(w.NewResponse(coap.UnsupportedMediaType))
+//handleRDDelete removes the links whose instance ids are sent as ins uri-query options, or every link of the device if there
+//are none. ex: DELETE /oic/rd?di=123&ins=1&ins=3
+func handleRDDelete(db registry.Registry, w coap.ResponseWriter, req *coap.Request) {
+	query := parseQuery(req.Msg.Query())
+	deviceID := query.Get("di")
+	if deviceID == "" {
+		w.WriteMsg(w.NewResponse(coap.BadRequest))
+		return
+	}
+	if !sameDevice(w, req, deviceID) {
+		return
+	}
+	var instanceIDs []int64
+	for _, v := range query["ins"] {
+		ins, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			log.Println("invalid ins in DELETE /oic/rd: ", v)
+			w.WriteMsg(w.NewResponse(coap.BadRequest))
 			return
 		}
-		code := req.Msg.Code()
-		if code == coap.POST {
-			fmt.Println("code was POST")
-			var rp ResourcePublication
-			err := codec.NewDecoderBytes(req.Msg.Payload(), new(codec.CborHandle)).Decode(&rp)
-			if err != nil {
-				err := w.WriteMsg(w.NewResponse(coap.BadRequest))
-				if err != nil {
-					log.Println("err from writing response about error decoding payload: ", err)
-					return
-				}
-			}
-			fmt.Println("deviceID from payload: ", rp.DeviceID, "\nlinks from payload:\n", rp.Links)
-			out, err := json.Marshal(rp)
-			if err != nil {
-				log.Println("error marshalling payload to json: ", err)
-				err := w.WriteMsg(w.NewResponse(coap.InternalServerError))
-				if err != nil {
-					log.Println("error sending error message to device: ", err)
-				}
-			}
-			fmt.Println("raw payload:\n", string(out))
-			err = db.PublishResource(string(out), rp.DeviceID)
-			if err != nil {
-				err := w.WriteMsg(w.NewResponse(coap.InternalServerError))
-				if err != nil {
-					log.Println("error sending error message to device: ", err)
-					return
-				}
-				log.Println("error publishing resource: ", err)
-				return
-			}
-			log.Println("error from db.publishresource: ", err)
+		instanceIDs = append(instanceIDs, ins)
+	}
+	err := db.UnpublishResources(inFlight, deviceID, instanceIDs)
+	if err != nil {
+		log.Println("err deleting resources published by ", deviceID, ": ", err)
+		w.WriteMsg(w.NewResponse(codeFromError(err)))
+		return
+	}
+	err = w.WriteMsg(w.NewResponse(coap.Deleted))
+	if err != nil {
+		log.Println("error sending response to DELETE /oic/rd: ", err)
+	}
+}
 
-			//TODO implement: do i need to set the response payload to show the published resources? probably
-			err = w.WriteMsg(w.NewResponse(coap.Created))
-			if err != nil {
-				log.Println("error sending error message to device: ", err)
-			}
-			return
-		}
-		//TODO implement handling non-post (aka not allowed) request types
+//writePublication responds with the json publication in the content format the device accepts
+func writePublication(w coap.ResponseWriter, req *coap.Request, code coap.COAPCode, publication string) {
+	err := writeJSONPayload(w, req, code, publication)
+	if err != nil {
+		log.Println("error sending resource publication to device: ", err)
 	}
 }
 
@@ -315,13 +480,9 @@ func handleRDUpdate(db registry.Registry) func(coap.ResponseWriter, *coap.Reques
 func handleTokenRefresh(db registry.Registry) func(coap.ResponseWriter, *coap.Request) {
 	return func(w coap.ResponseWriter, req *coap.Request) {
 		//SELECT user.username, device_uuid,token.refresh_token FROM device INNER JOIN user ON device.user_id = user.user_id INNER JOIN token ON device.token_id = token.token_id;
-		a, err := UnmarshalCBOR(req.Msg.Payload())
-		if err != nil {
-			log.Println("err from handleTokenRefresh: ", err)
-			err := w.WriteMsg(w.NewResponse(coap.InternalServerError))
-			if err != nil {
-				log.Println("error trying to respond with error code to device trying to refresh token: ", err)
-			}
+		var a Account
+		if !decodePayload(w, req, &a) || !sameDevice(w, req, a.DeviceID) {
+			return
 		}
 		if a.DeviceID == "" || a.UserID == "" || a.RefreshToken == "" {
 			log.Println("missing fields from tokenRefresh request")
@@ -329,50 +490,65 @@ func handleTokenRefresh(db registry.Registry) func(coap.ResponseWriter, *coap.Re
 			if err != nil {
 				log.Println("error trying to respond with error code to device trying to refresh token: ", err)
 			}
+			return
 		}
-		accessToken, refreshToken, ttl, err := db.RefreshToken(a.DeviceID, a.UserID, a.RefreshToken)
+		accessToken, refreshToken, ttl, err := db.RefreshToken(inFlight, a.DeviceID, a.UserID, a.RefreshToken)
 		if err != nil {
-			err := w.WriteMsg(w.NewResponse(coap.InternalServerError))
+			log.Println("err from registry.RefreshToken: ", err)
+			err := w.WriteMsg(w.NewResponse(codeFromError(err)))
 			if err != nil {
 				log.Println("error trying to respond with error code to device trying to refresh token: ", err)
 			}
+			return
 		}
-		b, err := Account{AccessToken: accessToken, RefreshToken: refreshToken, TokenTTL: ttl}.MarshalCBOR()
+		clientContainer.refreshToken(req.Client, a.DeviceID, ttl)
+		err = writePayload(w, req, coap.Created, Account{AccessToken: accessToken, RefreshToken: refreshToken, TokenTTL: ttl})
 		if err != nil {
-			err := w.WriteMsg(w.NewResponse(coap.InternalServerError))
-			if err != nil {
-				log.Println("error trying to respond with error code to device trying to refresh token: ", err)
-			}
+			log.Println("error sending refreshed token to device: ", err)
 		}
-		res := w.NewResponse(coap.Created)
-		res.SetPayload(b)
-		res.SetOption(coap.ContentFormat, coap.AppOcfCbor)
-		w.WriteMsg(res)
 		//TODO
 	}
 
 }
 
-//MarshalCBOR marshals an account struct into a binary CBOR payload
-//TODO: this is probably a terrible way of encoding data. the client is recieving {"accesstoken":"","expiresin":-779349} instead of just {expiresin":-779349}
-func (a Account) MarshalCBOR() ([]byte, error) {
-	buf := new(bytes.Buffer)
-	h := new(codec.CborHandle)
-	h.BasicHandle.Canonical = true
-	enc := codec.NewEncoder(buf, h)
-	err := enc.Encode(a)
-	return buf.Bytes(), err
-
-}
-
-//UnmarshalCBOR unmarshals a CBOR payload into an account struct
-func UnmarshalCBOR(b []byte) (Account, error) {
-	var a Account
-	err := codec.NewDecoderBytes(b, new(codec.CborHandle)).Decode(&a)
-	if err != nil {
-		return Account{}, err
+//handleResourceDiscovery handles RETRIEVE /oic/res. the access token is sent as the accesstoken uri-query option along with
+//the di, rt, if, href and anchor filters. responds with the links of the user's devices in the content format it accepts (CBOR by default).
+//the token has to belong to the user the session signed in as
+func handleResourceDiscovery(db registry.Registry) func(coap.ResponseWriter, *coap.Request) {
+	return func(w coap.ResponseWriter, req *coap.Request) {
+		if req.Msg.Code() != coap.GET {
+			w.WriteMsg(w.NewResponse(coap.MethodNotAllowed))
+			return
+		}
+		query := parseQuery(req.Msg.Query())
+		accessToken := query.Get("accesstoken")
+		query.Del("accesstoken")
+		if accessToken == "" {
+			w.WriteMsg(w.NewResponse(coap.Unauthorized))
+			return
+		}
+		userID, err := db.LookupUser(inFlight, accessToken)
+		if err != nil {
+			log.Println("err looking up the user of RETRIEVE /oic/res: ", err)
+			w.WriteMsg(w.NewResponse(codeFromError(err)))
+			return
+		}
+		if userID != clientContainer.state(req.Client).userID {
+			log.Println("RETRIEVE /oic/res with the access token of another user than the session's")
+			w.WriteMsg(w.NewResponse(coap.Forbidden))
+			return
+		}
+		links, err := db.FindDevice(inFlight, userID, query)
+		if err != nil {
+			log.Println("err from FindDevice: ", err)
+			w.WriteMsg(w.NewResponse(coap.InternalServerError))
+			return
+		}
+		err = writeJSONPayload(w, req, coap.Content, links)
+		if err != nil {
+			log.Println("error sending response to RETRIEVE /oic/res: ", err)
+		}
 	}
-	return a, err
 }
 
 /*
@@ -380,7 +556,7 @@ need to double check these.
 
 UPDATE /oic/sec/account {deviceID, mediated token, authProvider (optional)} returns {access token, userID, refresh token, expires in, redirect URI (optional)}
 DELETE /oic/sec/account {access token, userID OR device/clientID}
-UPDATE /oic/sec/session {deviceID, userID, loginBool, access token} returns {expires in} <- remember to use VerifyPeerCertificates function
+UPDATE /oic/sec/session {deviceID, userID, loginBool, access token} returns {expires in} <- the di has to match the client certificate
 UPDATE /oic/rd {resources (with links and stuff)} returns a "success response" (is that a response code? how do I know the deviceID?)
 UPDATE /oic/sec/tokenrefresh {userID, deviceID, refresh token} returns (access token, refresh token, expires in) <- refresh token can be new or old.
 
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-ocf/go-coap"
+)
+
+/*OCF identity certificates carry the id of the device in their subject CN as uuid:<di>, and have the serverAuth, clientAuth and
+OCF identity certificate extended key usages
+*/
+var (
+	oidOCFIdentityCertificate = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 44924, 1, 6}
+
+	errNoPeerCertificate = errors.New("the client didn't present a certificate")
+	errNotIdentityEKU    = errors.New("the certificate lacks the serverAuth, clientAuth or OCF identity certificate extended key usage")
+	errNoCertDeviceID    = errors.New("the certificate has no device id (uuid:<di>) in its CN or subject alternative names")
+)
+
+const certDeviceIDPrefix = "uuid:"
+
+//verifyIdentityEKU checks that the certificate has the extended key usages of an OCF identity certificate
+func verifyIdentityEKU(cert *x509.Certificate) error {
+	var serverAuth, clientAuth, identity bool
+	for _, eku := range cert.ExtKeyUsage {
+		switch eku {
+		case x509.ExtKeyUsageServerAuth:
+			serverAuth = true
+		case x509.ExtKeyUsageClientAuth:
+			clientAuth = true
+		}
+	}
+	for _, oid := range cert.UnknownExtKeyUsage {
+		if oid.Equal(oidOCFIdentityCertificate) {
+			identity = true
+		}
+	}
+	if !serverAuth || !clientAuth || !identity {
+		return errNotIdentityEKU
+	}
+	return nil
+}
+
+//certificateDeviceID returns the device id of the certificate, taken from its subject CN or else from a uuid: URI SAN
+func certificateDeviceID(cert *x509.Certificate) (string, error) {
+	if strings.HasPrefix(cert.Subject.CommonName, certDeviceIDPrefix) {
+		return strings.TrimPrefix(cert.Subject.CommonName, certDeviceIDPrefix), nil
+	}
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "uuid" && uri.Opaque != "" {
+			return uri.Opaque, nil
+		}
+	}
+	return "", errNoCertDeviceID
+}
+
+/*verifyPeerCertificates verifies the chain of the certificates the client presented and returns the device id of its identity
+certificate (the first one)
+*/
+func verifyPeerCertificates(certs []*x509.Certificate, roots, intermediates *x509.CertPool) (string, error) {
+	if len(certs) == 0 {
+		return "", errNoPeerCertificate
+	}
+	//TODO verify revocation
+	for _, c := range certs {
+		_, err := c.Verify(x509.VerifyOptions{
+			Intermediates: intermediates,
+			Roots:         roots,
+			CurrentTime:   time.Now(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	err := verifyIdentityEKU(certs[0])
+	if err != nil {
+		return "", err
+	}
+	return certificateDeviceID(certs[0])
+}
+
+/*recordPeerDevice returns the TLS configuration of a connection. it's config with a connection verification that records the
+device id of the client certificate under the remote address of the connection, which is how the sessions are keyed too.
+VerifyConnection runs on resumed handshakes as well (VerifyPeerCertificate doesn't), whose certificates come from the ticket
+*/
+func recordPeerDevice(config *tls.Config, roots, intermediates *x509.CertPool) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		remoteAddr := hello.Conn.RemoteAddr().String()
+		//an earlier connection from the same address may have left its entry behind
+		clientContainer.removePeerDevice(remoteAddr)
+		c := config.Clone()
+		c.GetConfigForClient = nil
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			deviceID, err := verifyPeerCertificates(cs.PeerCertificates, roots, intermediates)
+			if err != nil {
+				log.Println("rejecting the certificate of ", remoteAddr, ": ", err)
+				clientContainer.removePeerDevice(remoteAddr)
+				return err
+			}
+			clientContainer.setPeerDevice(remoteAddr, deviceID)
+			return nil
+		}
+		return c, nil
+	}
+}
+
+//setPeerDevice records the device id of the certificate presented by the client with that remote address
+func (c *ClientContainer) setPeerDevice(remoteAddr, deviceID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.peerDevices[remoteAddr] = deviceID
+}
+
+//removePeerDevice forgets the device id of the certificate presented by the client with that remote address
+func (c *ClientContainer) removePeerDevice(remoteAddr string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.peerDevices, remoteAddr)
+}
+
+//peerDevice returns the device id of the certificate client presented. ok is false if it presented none (ex: over plain tcp)
+func (c *ClientContainer) peerDevice(client *coap.ClientCommander) (deviceID string, ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	deviceID, ok = c.peerDevices[client.RemoteAddr().String()]
+	return deviceID, ok
+}
+
+/*certifiedDevice responds with 4.03 Forbidden and returns false if the client certificate the session was opened with belongs to
+another device than deviceID (the di of the payload or query). over tcp-tls a session without a recorded device id is refused as
+well, only sessions over plain tcp aren't checked
+*/
+func certifiedDevice(w coap.ResponseWriter, req *coap.Request, deviceID string) bool {
+	certDeviceID, ok := clientContainer.peerDevice(req.Client)
+	if ok && strings.EqualFold(certDeviceID, deviceID) {
+		return true
+	}
+	if !ok && !clientContainer.requiresCertificates() {
+		return true
+	}
+	log.Println("certificate of ", certDeviceID, " was used for a request to ", req.Msg.PathString(), " for ", deviceID)
+	err := w.WriteMsg(w.NewResponse(coap.Forbidden))
+	if err != nil {
+		log.Println("err from writing response about the device of the certificate: ", err)
+	}
+	return false
+}
+
+//requiresCertificates reports whether the sessions are opened over tcp-tls, in which case every one of them has a peer device
+func (c *ClientContainer) requiresCertificates() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.tcpTLS
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+)
+
+func TestCertificateIdentity(t *testing.T) {
+	block, _ := pem.Decode(CertPEMBlock)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("cannot parse certificate: %v", err)
+	}
+	if err := verifyIdentityEKU(cert); err != nil {
+		t.Fatalf("unexpected EKU error: %v", err)
+	}
+	deviceID, err := certificateDeviceID(cert)
+	if err != nil || deviceID != "6155f21c-0722-46c8-9d71-304a553279e9" {
+		t.Fatalf("unexpected device id: %v %v", deviceID, err)
+	}
+
+	cert.UnknownExtKeyUsage = nil
+	if err := verifyIdentityEKU(cert); err != errNotIdentityEKU {
+		t.Fatalf("a certificate without the OCF identity EKU should be rejected, got %v", err)
+	}
+	cert.Subject.CommonName = "device"
+	if _, err := certificateDeviceID(cert); err != errNoCertDeviceID {
+		t.Fatalf("a certificate without a uuid should be rejected, got %v", err)
+	}
+}
+
+func TestVerifyPeerCertificatesWithoutCertificate(t *testing.T) {
+	//a resumed handshake whose ticket carries no certificate mustn't pass for a device
+	if _, err := verifyPeerCertificates(nil, x509.NewCertPool(), x509.NewCertPool()); err != errNoPeerCertificate {
+		t.Fatalf("expected errNoPeerCertificate, got %v", err)
+	}
+}
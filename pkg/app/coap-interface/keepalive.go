@@ -5,6 +5,8 @@ import (
 	"time"
 
 	"github.com/go-ocf/go-coap"
+	"github.com/sking2600/coap-gateway/pkg/registry"
+	"github.com/sking2600/coap-gateway/pkg/routing"
 )
 
 //Keepalive setup of keepalive
@@ -13,6 +15,7 @@ type Keepalive struct {
 	interval time.Duration
 	retry    int
 	client   *coap.ClientCommander
+	db       registry.Registry
 
 	doneChan chan interface{}
 }
@@ -26,7 +29,7 @@ func (k *Keepalive) Done() {
 //Terminate terminate connection by keepalive
 func (k *Keepalive) Terminate() {
 	log.Printf("Terminate connection %v by keepalive %v", k.client.RemoteAddr(), k)
-	k.client.Close()
+	abortSession(k.client, "keepalive: no response to ping")
 }
 
 func (k *Keepalive) run() {
@@ -39,7 +42,7 @@ func (k *Keepalive) run() {
 		select {
 		case <-k.doneChan:
 			return
-		case <-time.After(time.Second * waitTime):
+		case <-time.After(waitTime):
 			if err := k.client.Ping(time.Second); err != nil {
 				log.Printf("Cannot send PING to %v: %v", k.client.RemoteAddr(), err)
 				if err == coap.ErrTimeout {
@@ -55,6 +58,21 @@ func (k *Keepalive) run() {
 
 			}
 			timeoutCount = 0
+			k.refreshRoutes()
+		}
+	}
+}
+
+//refreshRoutes keeps the routes of the devices signed in over the connection from expiring while it's alive
+func (k *Keepalive) refreshRoutes() {
+	for deviceID, route := range deviceContainer.sessionRoutes(k.client) {
+		err := k.db.RefreshRoute(inFlight, deviceID, route)
+		if err == routing.ErrRouteNotOwned {
+			log.Printf("Route of %v was claimed by another session", deviceID)
+			continue
+		}
+		if err != nil {
+			log.Printf("Cannot refresh route of %v: %v", deviceID, err)
 		}
 	}
 }
@@ -66,8 +84,20 @@ func NewKeepalive(server *Server, client *coap.ClientCommander) *Keepalive {
 		interval: server.keepaliveInterval,
 		retry:    server.keepaliveRetry,
 		client:   client,
+		db:       server.db,
 		doneChan: make(chan interface{}, 1),
 	}
 	go k.run()
 	return k
 }
+
+//heartbeat tells the reaper that this pod is alive until it starts shutting down. the routes of a pod that stops sending
+//heartbeats (ex: its node failed) are deleted by the reaper
+func (server *Server) heartbeat() {
+	for ; !server.isDraining(); time.Sleep(registry.HeartbeatTTL / 3) {
+		err := server.db.Heartbeat(inFlight, podAddr)
+		if err != nil {
+			log.Printf("Cannot send heartbeat: %v", err)
+		}
+	}
+}
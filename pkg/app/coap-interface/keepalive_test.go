@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-ocf/go-coap"
+	"github.com/sking2600/coap-gateway/pkg/registry"
+)
+
+func TestKeepaliveRefreshesRoute(t *testing.T) {
+	db := registry.NewMemoryRegistry()
+	server, err := NewServer(db)
+	if err != nil {
+		t.Fatalf("cannot create server: %v", err)
+	}
+	server.Net = "tcp"
+	server.keepaliveTime = 50 * time.Millisecond
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	coapserver := server.NewCoapServer()
+	coapserver.Listener = l
+	fin := make(chan error, 1)
+	go func() {
+		fin <- coapserver.ActivateAndServe()
+		l.Close()
+	}()
+	defer func() {
+		coapserver.Shutdown()
+		<-fin
+	}()
+
+	c := &coap.Client{Net: "tcp"}
+	co, err := c.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to dialing: %v", err)
+	}
+	defer co.Close()
+
+	//the session is added once the server accepted the connection
+	var client *coap.ClientCommander
+	for i := 0; client == nil && i < 100; i++ {
+		clientContainer.mutex.Lock()
+		for _, s := range clientContainer.sessions {
+			client = s.client
+		}
+		clientContainer.mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if client == nil {
+		t.Fatalf("session wasn't added")
+	}
+
+	deviceID := "6155f21c-0722-46c8-9d71-304a553279e9"
+	route, err := db.Routes.SetRoute(deviceID, podAddr, 300*time.Millisecond)
+	if err != nil {
+		t.Fatalf("cannot set route: %v", err)
+	}
+	deviceContainer.addDevice(deviceID, client, route)
+	defer deviceContainer.removeDevice(deviceID)
+
+	//without the keepalive the route would have expired by now
+	time.Sleep(500 * time.Millisecond)
+	got, err := db.Routes.LookupRoute(deviceID)
+	if err != nil {
+		t.Fatalf("route of a live session expired: %v", err)
+	}
+	if got != route {
+		t.Fatalf("unexpected route: %v != %v", got, route)
+	}
+}
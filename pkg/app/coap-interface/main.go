@@ -2,16 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/go-ocf/go-coap"
+	"github.com/sking2600/coap-gateway/pkg/payload"
 	"github.com/sking2600/coap-gateway/pkg/registry"
+	"github.com/sking2600/coap-gateway/pkg/routing"
 
 	"github.com/go-redis/redis"
 	"github.com/go-zoo/bone"
@@ -22,13 +31,15 @@ import (
 //TODO: do I need to worry about congestion control stuff? (RFC 7252 sec 4.2, 4.7-4.8)
 
 type dbconfig struct {
-	dbName        string `envconfig:"DB_NAME" required:"true"`
-	dbUsername    string `envconfig:"DB_USERNAME" required:"true"`
-	dbPassword    string `envconfig:"DB_PASSWORD" required:"true"`
-	dbAddress     string `envconfig:"DB_URI" required:"true"`
-	redisPassword string `envconfig:"CACHE_PASSWORD" required:"true"`
-	redisAddress  string `envconfig:"CACHE_URI" required:"true"`
-	redisNumber   int    `envconfig:"CACHE_NUMBER" ` //this line is what's causing envconfig to fail. if I just want my default val to be 0. can I just use the 0 val and not set a default?
+	DBName     string `envconfig:"DB_NAME" required:"true"`
+	DBUsername string `envconfig:"DB_USERNAME" required:"true"`
+	DBPassword string `envconfig:"DB_PASSWORD" required:"true"`
+	DBAddress  string `envconfig:"DB_URI" required:"true"`
+}
+
+//mysqlDSN returns the data source name of the mysql db. DB_URI is everything between the password and the db name (ex: @tcp(host:3306)/)
+func (c dbconfig) mysqlDSN() string {
+	return fmt.Sprintf("%s:%s%s%s?parseTime=true", c.DBUsername, c.DBPassword, c.DBAddress, c.DBName)
 }
 
 //constants
@@ -36,14 +47,25 @@ var (
 	dbName        = os.Getenv("DB_NAME")
 	dbUsername    = os.Getenv("DB_USERNAME")
 	dbPassword    = os.Getenv("DB_PASSWORD")
-	dbAddress     = os.Getenv("DB_URI")
+	dbAddress     = os.Getenv("DB_URI") //for postgres this is just host[:port]
+	dbSSLMode     = os.Getenv("DB_SSLMODE")
 	redisPassword = os.Getenv("CACHE_PASSWORD")
 	redisAddress  = os.Getenv("CACHE_URI")
 	redisNumber   = os.Getenv("CACHE_NUMBER")
 
+	envRegistryBackend   = "REGISTRY_BACKEND"
+	envTokenPepper       = "TOKEN_PEPPER"
 	envKeepaliveTime     = "KEEPALIVE_TIME"
 	envKeepaliveInterval = "KEEPALIVE_INTERVAL"
 	envKeepaliveRetry    = "KEEPALIVE_RETRY"
+	envMaxSessions       = "MAX_SESSIONS"
+	envMaxGoroutines     = "MAX_GOROUTINES"
+	envMaxLatency        = "MAX_LATENCY_MS"
+	envShedRate          = "SHED_RATE"
+	envShedStrategy      = "SHED_STRATEGY"
+	envReleaseHoldOff    = "RELEASE_HOLD_OFF"
+	envReleaseOnExpiry   = "RELEASE_ON_EXPIRY"
+	envShutdownTimeout   = "SHUTDOWN_TIMEOUT"
 	envListenAddress     = "ADDRESS"
 	envListenNet         = "NETWORK"
 	envTLSCertificate    = "TLS_CERTIFICATE"
@@ -58,38 +80,18 @@ var (
 )
 
 func main() {
-	var dbc dbconfig
-	err := envconfig.Process("db", &dbc)
-	err = envconfig.Process("cache", &dbc)
-	if err != nil {
-		log.Fatal(err.Error())
-	}
-	dbURI := fmt.Sprintf("%s:%s%s%s?parseTime=true", dbc.dbUsername, dbc.dbPassword, dbc.dbAddress, dbc.dbName)
-	log.Println("db URI using envconfig: ", dbURI)
-	dbURI = fmt.Sprintf("%s:%s%s%s?parseTime=true", dbUsername, dbPassword, dbAddress, dbName)
-	log.Println("db URI using os.getenv: ", dbURI)
 	if podAddr == "" {
 		log.Println("no pod IP provided in env. setting podAddr to 'localhost'")
 		podAddr = "localhost"
 
 	}
-	log.Println("dbURI: ", dbURI)
-	//fmt.Println(dbURI)
-	db, err := sql.Open("mysql", dbURI)
+	reg, err := newRegistry()
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = db.Ping()
-	if err != nil {
-		log.Fatal("error from pinging mysql: ", err)
-	}
-	redisdb := redis.NewClient(&redis.Options{
-		Addr:     redisAddress,
-		Password: redisPassword,
-		DB:       0,
-	})
 	fmt.Println("created registry")
-	reg := registry.MysqlRedisRegistry{db, redisdb}
+	commandQueue = newCommandQueue()
+	events = newDispatcher(reg)
 	s, err := NewServer(reg)
 	if err != nil {
 		log.Fatal("err from register device: ", err)
@@ -99,13 +101,108 @@ func main() {
 	router := bone.New()
 	router.Get("/", http.HandlerFunc(handleHealthCheck))
 	router.Get("/healthz", http.HandlerFunc(handleHealthCheck))
-	router.Post("/:deviceUUID/:href", http.HandlerFunc(handleClientRequest))
+	router.Get("/readyz", http.HandlerFunc(handleReadiness(s)))
+	router.Delete("/:deviceUUID", http.HandlerFunc(handleDeviceRemoval))
+	router.Post("/admin/release", http.HandlerFunc(handleRelease(s)))
 	fmt.Println("started server")
-	go func() { log.Fatal(http.ListenAndServe(":8081", router)) }()
+	httpServer := &http.Server{Addr: ":8081", Handler: routing.DeviceMux(router, map[string]http.Handler{
+		http.MethodGet:    http.HandlerFunc(handleObserve),
+		http.MethodPost:   http.HandlerFunc(handleClientRequest),
+		http.MethodPut:    http.HandlerFunc(handleClientRequest),
+		http.MethodDelete: http.HandlerFunc(handleClientRequest),
+	})}
+	go func() {
+		err := httpServer.ListenAndServe()
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	go func() {
+		err := s.ListenAndServe()
+		if !s.isDraining() {
+			log.Fatal(err)
+		}
+	}()
 
-	go func() { log.Fatal(s.ListenAndServe()) }()
-	select {}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	log.Println("received ", <-sigs, ", draining sessions")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout())
+	defer cancel()
+	//the cancellation only reaches the registry calls once the deadline is reached, until then they're left to finish
+	go func() {
+		<-ctx.Done()
+		cancelInFlight()
+	}()
+	err = s.Shutdown(ctx)
+	if err != nil {
+		log.Println("err shutting down the coap server: ", err)
+	}
+	//the internal http server is shut down last since the northbound-interface keeps forwarding requests while the devices drain
+	err = httpServer.Shutdown(ctx)
+	if err != nil {
+		log.Println("err shutting down the http server: ", err)
+	}
+}
 
+//shutdownTimeout returns SHUTDOWN_TIMEOUT (in seconds) or defaultShutdownTimeout
+func shutdownTimeout() time.Duration {
+	v := os.Getenv(envShutdownTimeout)
+	if v == "" {
+		return defaultShutdownTimeout
+	}
+	seconds, err := strconv.Atoi(v)
+	if err != nil || seconds < 0 {
+		log.Printf("Invalid value '%v' of env variable '%v'", v, envShutdownTimeout)
+		return defaultShutdownTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+//newRegistry connects to the backend selected by REGISTRY_BACKEND ("memory", "postgres" or "mysql" which is the default)
+func newRegistry() (registry.Registry, error) {
+	backend := os.Getenv(envRegistryBackend)
+	if backend == "memory" {
+		log.Println("using in-memory registry. nothing will be persisted")
+		return registry.NewMemoryRegistry(), nil
+	}
+	//tokens are hashed with the same pepper as the northbound-interface, otherwise none of them would match
+	pepper := os.Getenv(envTokenPepper)
+	if pepper == "" {
+		return nil, ErrEnvNotSet(envTokenPepper)
+	}
+	driver := "mysql"
+	var dbURI string
+	if backend == "postgres" {
+		driver = "postgres"
+		dbURI = registry.PostgresURI(dbUsername, dbPassword, dbAddress, dbName, dbSSLMode)
+	} else {
+		var dbc dbconfig
+		err := envconfig.Process("db", &dbc)
+		if err != nil {
+			return nil, err
+		}
+		dbURI = dbc.mysqlDSN()
+	}
+	db, err := sql.Open(driver, dbURI)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Ping()
+	if err != nil {
+		log.Println("error from pinging ", driver, ": ", err)
+		return nil, err
+	}
+	redisdb := redis.NewClient(&redis.Options{
+		Addr:     redisAddress,
+		Password: redisPassword,
+		DB:       0,
+	})
+	hasher := registry.NewTokenHasher([]byte(pepper))
+	if driver == "postgres" {
+		return registry.PostgresRedisRegistry{DB: db, Routes: routing.NewRedisRouteTable(redisdb), Hasher: hasher}, nil
+	}
+	return registry.MysqlRedisRegistry{DB: db, Routes: routing.NewRedisRouteTable(redisdb), Hasher: hasher}, nil
 }
 
 /*
@@ -145,38 +242,196 @@ func ticker() {
 }
 
 //TODO: handle authZ with the access tokens
-//TODO convert content format to coap.AppOcfCbor if it's a different format like coap.AppJSON
 func handleClientRequest(w http.ResponseWriter, r *http.Request) {
-	deviceUUID := bone.GetValue(r, "deviceUUID")
-	href := bone.GetValue(r, "href")
+	deviceUUID, href, _ := routing.SplitDevicePath(r.URL.Path)
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		log.Println("error parsing request body", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("STATUS CODE 500:\ncouldn't read body"))
 	}
-	if _, ok := deviceContainer.devices[deviceUUID]; !ok {
+	if _, ok := deviceContainer.client(deviceUUID); !ok {
 		log.Println("client made request to deviceUUID == ", deviceUUID, " but it was not found")
 		w.WriteHeader(http.StatusNotFound)
 		//TODO is this the correct status code?
 		return
 	}
-	log.Println("client requested to send to: ", deviceUUID, "\nand this href: ", href, "\nand this body:", string(b[:]))
-	req, err := deviceContainer.devices[deviceUUID].NewPostRequest(href, coap.AppJSON, bytes.NewBuffer(b))
-	if err != nil {
-		log.Println("error creating coap POST request: ", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	if !ownsRoute(w, r, deviceUUID) {
 		return
 	}
-	res, err := deviceContainer.devices[deviceUUID].Exchange(req)
+	status, contentType, body, err := forwardToDevice(deviceUUID, r.Method, href, r.URL.RawQuery, r.Header.Get("Content-Type"), r.Header.Get("Accept"), b)
+	if err == nil {
+		w.Header().Set(deviceRespondedHeader, "true")
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+//deviceRespondedHeader is set on the responses that come from the device, as opposed to the ones the pod answers by itself
+const deviceRespondedHeader = "Device-Responded"
+
+//errMethodNotSupported is returned for HTTP methods that have no CoAP equivalent
+var errMethodNotSupported = errors.New("method isn't supported")
+
+/*forwardToDevice sends the request (GET, POST, PUT or DELETE) to href on the device and returns the HTTP status, content type and
+payload to respond with. the query string is sent as uri-query options. the body (of contentType) is sent as CBOR and a CBOR
+response is translated to the media type accept asks for (see payload.Negotiate). err is set if the device didn't respond, in
+which case the status is the pod's own: 404 if the device isn't connected, 405 for other methods, 415 or 400 if the body isn't
+JSON or CBOR and 502 if the exchange failed
+*/
+func forwardToDevice(deviceUUID, method, href, query, contentType, accept string, b []byte) (int, string, []byte, error) {
+	conn, ok := deviceContainer.client(deviceUUID)
+	if !ok {
+		log.Println("client made request to deviceUUID == ", deviceUUID, " but it was not found")
+		return http.StatusNotFound, "", nil, errorDeviceNotConnected
+	}
+	log.Println("forwarding ", method, " ", href, " to ", deviceUUID)
+	cbor, mediaType, err := requestPayload(method, contentType, b)
+	if err == payload.ErrUnsupportedMediaType {
+		return http.StatusUnsupportedMediaType, "", nil, err
+	}
+	if err != nil {
+		log.Println("err converting request body to cbor: ", err)
+		return http.StatusBadRequest, "", nil, err
+	}
+	var req coap.Message
+	switch method {
+	case http.MethodGet:
+		req, err = conn.NewGetRequest(href)
+	case http.MethodPost:
+		req, err = conn.NewPostRequest(href, mediaType, bytes.NewBuffer(cbor))
+	case http.MethodPut:
+		req, err = conn.NewPutRequest(href, mediaType, bytes.NewBuffer(cbor))
+	case http.MethodDelete:
+		req, err = conn.NewDeleteRequest(href)
+	default:
+		return http.StatusMethodNotAllowed, "", nil, errMethodNotSupported
+	}
+	if err != nil {
+		log.Println("error creating coap ", method, " request: ", err)
+		return http.StatusInternalServerError, "", nil, err
+	}
+	if query != "" {
+		req.SetQuery(uriQuery(query))
+	}
+	res, err := conn.Exchange(req)
 	if err != nil {
 		log.Println("error exchanging message with deviceUUID:", deviceUUID, ": ", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return http.StatusBadGateway, "", nil, err
+	}
+	log.Println(deviceUUID, " responded to ", method, " ", href, " with ", res.Code())
+	responseType, body := responsePayload(res, accept)
+	return statusFromCode(res.Code()), responseType, body, nil
+}
+
+/*requestPayload returns the body of a POST or PUT as CBOR with the content format to send it with: application/cbor is passed
+through as such and everything else is sent as vnd.ocf+cbor
+*/
+func requestPayload(method, contentType string, b []byte) ([]byte, coap.MediaType, error) {
+	if method != http.MethodPost && method != http.MethodPut {
+		return nil, coap.AppOcfCbor, nil
+	}
+	cbor, err := payload.ToCBOR(contentType, b)
+	if payload.MediaType(contentType) == payload.CBOR {
+		return cbor, coap.AppCBOR, err
 	}
-	log.Println("response from exchanging message with device: ", string(res.Payload()))
-	w.Write(res.Payload())
+	return cbor, coap.AppOcfCbor, err
+}
 
+//mediaTypes are the HTTP media types of the content formats devices respond with, other than CBOR
+var mediaTypes = map[coap.MediaType]string{
+	coap.TextPlain:     "text/plain",
+	coap.AppLinkFormat: "application/link-format",
+	coap.AppXML:        "application/xml",
+	coap.AppOctets:     "application/octet-stream",
+	coap.AppJSON:       payload.JSON,
+}
+
+/*responsePayload returns the content type and payload of the device's response for a client with the accept header. CBOR is
+translated to the media type it asks for, other formats are passed through. a CBOR payload that can't be decoded is passed
+through as it is
+*/
+func responsePayload(res coap.Message, accept string) (string, []byte) {
+	mediaType, ok := res.Option(coap.ContentFormat).(coap.MediaType)
+	if !ok {
+		return "", res.Payload()
+	}
+	if mediaType != coap.AppOcfCbor && mediaType != coap.AppCBOR {
+		return mediaTypes[mediaType], res.Payload()
+	}
+	responseType := payload.Negotiate(accept)
+	b, err := payload.FromCBOR(responseType, res.Payload())
+	if err != nil {
+		log.Println("err converting response payload from cbor: ", err)
+		return payload.OCFCBOR, res.Payload()
+	}
+	return responseType, b
+}
+
+//uriQuery splits a raw query string into the values of the uri-query options, which aren't percent-encoded
+func uriQuery(query string) []string {
+	var options []string
+	for _, option := range strings.Split(query, "&") {
+		if option == "" {
+			continue
+		}
+		unescaped, err := url.QueryUnescape(option)
+		if err != nil {
+			unescaped = option
+		}
+		options = append(options, unescaped)
+	}
+	return options
+}
+
+//routeEpochHeader carries the epoch of the route the northbound-interface looked up for the device
+const routeEpochHeader = "Route-Epoch"
+
+/*ownsRoute checks that the route the northbound-interface forwarded the request with was claimed by the device's session on this pod.
+if it wasn't (ex: the device signed in over another session since) it responds with 409 Conflict and returns false.
+requests without a route epoch are let through
+*/
+func ownsRoute(w http.ResponseWriter, r *http.Request, deviceID string) bool {
+	v := r.Header.Get(routeEpochHeader)
+	if v == "" {
+		return true
+	}
+	epoch, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("invalid " + routeEpochHeader))
+		return false
+	}
+	if holdsRoute(deviceID, epoch) {
+		return true
+	}
+	w.WriteHeader(http.StatusConflict)
+	w.Write([]byte(fmt.Sprintf("route epoch %v isn't owned by this pod's session of the device", epoch)))
+	return false
+}
+
+//holdsRoute reports whether the device's session on this pod claimed the route with that epoch. 0 means the epoch is unknown
+func holdsRoute(deviceID string, epoch int64) bool {
+	if epoch == 0 {
+		return true
+	}
+	route, ok := deviceContainer.route(deviceID)
+	if ok && route.Epoch == epoch {
+		return true
+	}
+	log.Println("request for ", deviceID, " was routed with epoch ", epoch, " but this pod holds ", route)
+	return false
+}
+
+//handleDeviceRemoval is called by the northbound-interface after a client deleted the device, so that its session gets closed
+func handleDeviceRemoval(w http.ResponseWriter, r *http.Request) {
+	deviceUUID := bone.GetValue(r, "deviceUUID")
+	log.Println("closing session of deleted device ", deviceUUID)
+	deviceContainer.closeDevice(deviceUUID)
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func handleHealthCheck(w http.ResponseWriter, r *http.Request) {
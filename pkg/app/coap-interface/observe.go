@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/go-ocf/go-coap"
+	"github.com/sking2600/coap-gateway/pkg/payload"
+	"github.com/sking2600/coap-gateway/pkg/routing"
+	"github.com/sking2600/coap-gateway/pkg/webhooks"
+)
+
+var errorDeviceNotConnected = errors.New("device is not connected to this pod")
+
+//notificationBuffer is how many notifications a subscriber can fall behind before notifications start being dropped for it
+const notificationBuffer = 16
+
+//observation is a single CoAP observe (RFC 7641) on a device resource that is shared by every subscriber of that resource
+type observation struct {
+	deviceID    string
+	href        string
+	subscribers map[chan []byte]struct{}
+	obs         *coap.Observation //nil until the device accepted the observe
+	done        bool
+	mutex       sync.Mutex
+}
+
+//observationMap holds the active observations keyed by deviceID/href.
+//locks are always taken in this order: observationMap, then observation
+type observationMap struct {
+	observations map[string]*observation
+	mutex        sync.Mutex
+}
+
+var (
+	observations = &observationMap{observations: make(map[string]*observation)}
+)
+
+func observationKey(deviceID, href string) string {
+	return deviceID + "/" + href
+}
+
+/*subscribe returns a channel that receives the (json encoded) payload of every notification of the resource. the first subscriber
+establishes the observe with the device and the others share it. the channel is closed once the device stops the observation or
+disconnects. unsubscribe must always be called, the observe is cancelled when the last subscriber leaves
+*/
+func (m *observationMap) subscribe(deviceID, href string) (notifications <-chan []byte, unsubscribe func(), err error) {
+	client, ok := deviceContainer.client(deviceID)
+	if !ok {
+		return nil, nil, errorDeviceNotConnected
+	}
+	key := observationKey(deviceID, href)
+	ch := make(chan []byte, notificationBuffer)
+	m.mutex.Lock()
+	o, ok := m.observations[key]
+	if ok {
+		o.mutex.Lock()
+		o.subscribers[ch] = struct{}{}
+		o.mutex.Unlock()
+		m.mutex.Unlock()
+		return ch, func() { m.unsubscribe(key, o, ch) }, nil
+	}
+	o = &observation{deviceID: deviceID, href: href, subscribers: map[chan []byte]struct{}{ch: {}}}
+	m.observations[key] = o
+	m.mutex.Unlock()
+
+	//no lock can be held here: the first notification is delivered before Observe returns
+	obs, err := client.Observe(href, func(req *coap.Request) {
+		m.notify(key, o, req.Msg)
+	})
+	if err != nil {
+		m.end(key, o)
+		return nil, nil, err
+	}
+	o.mutex.Lock()
+	done := o.done
+	if !done {
+		o.obs = obs
+	}
+	o.mutex.Unlock()
+	if done {
+		//every subscriber left (or the device ended the observation) while the observe was being established
+		cancelObservation(key, obs)
+	}
+	return ch, func() { m.unsubscribe(key, o, ch) }, nil
+}
+
+func (m *observationMap) unsubscribe(key string, o *observation, ch chan []byte) {
+	m.mutex.Lock()
+	o.mutex.Lock()
+	if _, ok := o.subscribers[ch]; ok {
+		delete(o.subscribers, ch)
+		close(ch)
+	}
+	var obs *coap.Observation
+	if len(o.subscribers) == 0 {
+		obs = m.removeLocked(key, o)
+	}
+	o.mutex.Unlock()
+	m.mutex.Unlock()
+	cancelObservation(key, obs)
+}
+
+//notify fans the notification out to every subscriber. a subscriber that isn't keeping up misses the notification rather than
+//holding up the others
+func (m *observationMap) notify(key string, o *observation, msg coap.Message) {
+	if msg.Code() != coap.Content {
+		log.Println("observation of ", key, " ended with code ", msg.Code())
+		//ending cancels the observe, which can't be done from the goroutine that is delivering the notification
+		go m.end(key, o)
+		return
+	}
+	payload, err := notificationPayload(msg)
+	if err != nil {
+		log.Println("err decoding notification of ", key, ": ", err)
+		return
+	}
+	o.mutex.Lock()
+	for ch := range o.subscribers {
+		select {
+		case ch <- payload:
+		default:
+			log.Println("dropping notification of ", key, " for a slow subscriber")
+		}
+	}
+	o.mutex.Unlock()
+	go events.Emit(inFlight, webhooks.ResourceNotification, o.deviceID, notificationEvent{DeviceID: o.deviceID, Href: o.href, Payload: webhooks.JSONPayload(payload)})
+	if msg.Option(coap.Observe) == nil {
+		//the device doesn't support observe on this resource (or it stopped the observation), so this was the last notification
+		go m.end(key, o)
+	}
+}
+
+//end closes every subscriber of the observation and cancels the observe
+func (m *observationMap) end(key string, o *observation) {
+	m.mutex.Lock()
+	o.mutex.Lock()
+	obs := m.removeLocked(key, o)
+	o.mutex.Unlock()
+	m.mutex.Unlock()
+	cancelObservation(key, obs)
+}
+
+//closeDevice ends every observation of the device. called when the device signs out or its session ends
+func (m *observationMap) closeDevice(deviceID string) {
+	var ended []*coap.Observation
+	m.mutex.Lock()
+	for key, o := range m.observations {
+		if !strings.HasPrefix(key, deviceID+"/") {
+			continue
+		}
+		o.mutex.Lock()
+		if obs := m.removeLocked(key, o); obs != nil {
+			ended = append(ended, obs)
+		}
+		o.mutex.Unlock()
+	}
+	m.mutex.Unlock()
+	for _, obs := range ended {
+		go cancelObservation(deviceID, obs)
+	}
+}
+
+//removeLocked removes the observation, closes its subscribers and returns the observe that has to be cancelled (nil if it hasn't
+//been established yet). the caller must hold both locks
+func (m *observationMap) removeLocked(key string, o *observation) *coap.Observation {
+	if m.observations[key] == o {
+		delete(m.observations, key)
+	}
+	for ch := range o.subscribers {
+		delete(o.subscribers, ch)
+		close(ch)
+	}
+	obs := o.obs
+	o.obs = nil
+	o.done = true
+	return obs
+}
+
+func cancelObservation(key string, obs *coap.Observation) {
+	if obs == nil {
+		return
+	}
+	err := obs.Cancel()
+	if err != nil {
+		log.Println("err cancelling observation of ", key, ": ", err)
+	}
+}
+
+//notificationPayload returns the payload of the notification as json. CBOR payloads are converted, anything else is passed through
+func notificationPayload(msg coap.Message) ([]byte, error) {
+	mediaType, ok := msg.Option(coap.ContentFormat).(coap.MediaType)
+	if !ok || (mediaType != coap.AppOcfCbor && mediaType != coap.AppCBOR) {
+		return msg.Payload(), nil
+	}
+	return payload.CBORToJSON(msg.Payload())
+}
+
+/*handleObserve handles GET /:deviceUUID/:href with "Accept: text/event-stream". it streams every notification of the resource
+as a Server-Sent Event until the client goes away or the device stops the observation. other GETs retrieve the resource once
+*/
+func handleObserve(w http.ResponseWriter, r *http.Request) {
+	if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		handleClientRequest(w, r)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Println("response writer doesn't support flushing, can't stream notifications")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	deviceUUID, href, _ := routing.SplitDevicePath(r.URL.Path)
+	if _, connected := deviceContainer.client(deviceUUID); connected && !ownsRoute(w, r, deviceUUID) {
+		return
+	}
+	notifications, unsubscribe, err := observations.subscribe(deviceUUID, href)
+	if err == errorDeviceNotConnected {
+		log.Println("client tried to observe ", href, " of ", deviceUUID, " but the device is not connected")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("err observing ", href, " of ", deviceUUID, ": ", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer unsubscribe()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case payload, ok := <-notifications:
+			if !ok {
+				return
+			}
+			err := writeEvent(w, payload)
+			if err != nil {
+				log.Println("err streaming notification of ", href, " of ", deviceUUID, ": ", err)
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+//writeEvent writes payload as a server-sent event. every line of the payload gets its own data field, since a line break would
+//otherwise end the field (and a blank line the event)
+func writeEvent(w io.Writer, payload []byte) error {
+	payload = bytes.Replace(payload, []byte("\r\n"), []byte("\n"), -1)
+	payload = bytes.Replace(payload, []byte("\r"), []byte("\n"), -1)
+	var event bytes.Buffer
+	for _, line := range bytes.Split(payload, []byte("\n")) {
+		event.WriteString("data: ")
+		event.Write(line)
+		event.WriteString("\n")
+	}
+	event.WriteString("\n")
+	_, err := w.Write(event.Bytes())
+	return err
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteEvent(t *testing.T) {
+	for _, tc := range []struct {
+		payload string
+		want    string
+	}{
+		{`{"on":true}`, "data: {\"on\":true}\n\n"},
+		{"{\n  \"on\": true\n}", "data: {\ndata:   \"on\": true\ndata: }\n\n"},
+		{"a\r\n\r\nb", "data: a\ndata: \ndata: b\n\n"},
+	} {
+		var b bytes.Buffer
+		if err := writeEvent(&b, []byte(tc.payload)); err != nil || b.String() != tc.want {
+			t.Fatalf("unexpected event for %q: %q %v", tc.payload, b.String(), err)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/pem"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -15,6 +16,7 @@ import (
 	"time"
 
 	"github.com/sking2600/coap-gateway/pkg/registry"
+	"github.com/sking2600/coap-gateway/pkg/routing"
 
 	"github.com/go-ocf/go-coap"
 )
@@ -24,46 +26,83 @@ import (
 
 //Session a setup of connection
 type Session struct {
-	server    *Server
-	client    *coap.ClientCommander
-	keepalive *Keepalive
+	server      *Server
+	client      *coap.ClientCommander
+	keepalive   *Keepalive
+	connectedAt time.Time
+	released    bool         //set once a Release was sent, guarded by the ClientContainer mutex
+	state       sessionState //set by signing in to /oic/sec/session, guarded by the ClientContainer mutex
+	expiry      *time.Timer  //fires when the access token of state expires, guarded by the ClientContainer mutex
 }
 
+//ClientContainer holds the sessions keyed by the remote address. every session has the same local address (the listener)
 type ClientContainer struct {
-	sessions map[string]*Session
-	mutex    sync.Mutex
+	sessions    map[string]*Session
+	peerDevices map[string]string //device id of the client certificate of every TLS session
+	tcpTLS      bool              //set when the sessions are opened over tcp-tls
+	mutex       sync.Mutex
 }
 
 func (c *ClientContainer) addSession(server *Server, client *coap.ClientCommander) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	c.sessions[client.LocalAddr().String()] = NewSession(server, client)
+	c.sessions[client.RemoteAddr().String()] = NewSession(server, client)
 }
 
 func (c *ClientContainer) removeSession(s *coap.ClientCommander) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	c.sessions[s.LocalAddr().String()].keepalive.Done()
-	delete(c.sessions, s.LocalAddr().String())
+	delete(c.peerDevices, s.RemoteAddr().String())
+	session, ok := c.sessions[s.RemoteAddr().String()]
+	if !ok {
+		return
+	}
+	session.keepalive.Done()
+	session.setState(sessionState{})
+	delete(c.sessions, s.RemoteAddr().String())
+}
+
+//count returns how many sessions are open
+func (c *ClientContainer) count() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.sessions)
+}
+
+//session returns the session of client
+func (c *ClientContainer) session(client *coap.ClientCommander) (*Session, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	s, ok := c.sessions[client.RemoteAddr().String()]
+	return s, ok
 }
 
 var (
-	clientContainer = &ClientContainer{sessions: make(map[string]*Session)}
+	clientContainer = &ClientContainer{sessions: make(map[string]*Session), peerDevices: make(map[string]string)}
 )
 
 //NewSession create and initialize session
 func NewSession(server *Server, client *coap.ClientCommander) *Session {
-	return &Session{server: server, client: client, keepalive: NewKeepalive(server, client)}
+	return &Session{server: server, client: client, keepalive: NewKeepalive(server, client), connectedAt: time.Now()}
 }
 
 //Server a configuration of coapgateway
 type Server struct {
-	Addr              string        // Address to listen on, ":COAP" if empty.
-	Net               string        // if "tcp" or "tcp-tls" (COAP over TLS) it will invoke a TCP listener, otherwise an UDP one
-	TLSConfig         *tls.Config   // TLS connection configuration
-	keepaliveTime     time.Duration // the duration in seconds between two keepalive transmissions in idle condition. TCP keepalive period is required to be configurable and by default is set to 1 hour.
-	keepaliveInterval time.Duration // the duration in seconds between two successive keepalive retransmissions, if acknowledgement to the previous keepalive transmission is not received.
-	keepaliveRetry    int           // the number of retransmissions to be carried out before declaring that remote end is not available.
+	Addr              string         // Address to listen on, ":COAP" if empty.
+	Net               string         // if "tcp" or "tcp-tls" (COAP over TLS) it will invoke a TCP listener, otherwise an UDP one
+	TLSConfig         *tls.Config    // TLS connection configuration
+	keepaliveTime     time.Duration  // the duration in seconds between two keepalive transmissions in idle condition. TCP keepalive period is required to be configurable and by default is set to 1 hour.
+	keepaliveInterval time.Duration  // the duration in seconds between two successive keepalive retransmissions, if acknowledgement to the previous keepalive transmission is not received.
+	keepaliveRetry    int            // the number of retransmissions to be carried out before declaring that remote end is not available.
+	shedding          SheddingPolicy // decides when sessions are released so they reconnect to another pod. nil disables shedding
+	shedRate          int            // the maximum number of sessions released per second while shedding
+	overloaded        int32          // 1 while the pod is over its load target, accessed atomically
+	releaseHoldOff    time.Duration  // how long released devices are asked to wait before reconnecting
+	releaseOnExpiry   bool           // whether the sessions whose access token expired are released, so that the device signs in again
+	draining          int32          // 1 once Shutdown was called, accessed atomically
+	coapServer        *coap.Server   // set by ListenAndServe
+	listener          net.Listener   // set by ListenAndServe for tcp and tcp-tls
+	mutex             sync.Mutex     // guards coapServer and listener
 	db                registry.Registry
 }
 
@@ -147,49 +186,37 @@ func setupTLS() (*tls.Config, error) {
 		return nil, ErrEmptyCARootPool
 	}
 
-	return &tls.Config{
+	config := &tls.Config{
 		Certificates: []tls.Certificate{cert},
 		ClientAuth:   tls.RequireAnyClientCert,
-		VerifyPeerCertificate: func(rawCerts [][]byte, verifyChains [][]*x509.Certificate) error {
-			for _, rawCert := range rawCerts {
-				cert, err := x509.ParseCertificates(rawCert)
-				if err != nil {
-					return err
-				}
-				//TODO verify revocation
-				for _, c := range cert {
-					_, err := c.Verify(x509.VerifyOptions{
-						Intermediates: caIntermediatesPool,
-						Roots:         caRootPool,
-						CurrentTime:   time.Now(),
-						KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
-					})
-					if err != nil {
-						return err
-					}
-				}
-				//TODO verify EKU - need to use ASN decoding
-			}
-			return nil
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			_, err := verifyPeerCertificates(cs.PeerCertificates, caRootPool, caIntermediatesPool)
+			return err
 		},
-	}, nil
+	}
+	//every connection gets its own config, so that the device id of its certificate can be tied to its session
+	config.GetConfigForClient = recordPeerDevice(config, caRootPool, caIntermediatesPool)
+	return config, nil
 }
 
 //NewServer setup coap gateway
 func NewServer(db registry.Registry) (*Server, error) {
-	s := &Server{keepaliveTime: time.Hour, keepaliveInterval: time.Second * 5, keepaliveRetry: 5, Net: "tcp", Addr: "0.0.0.0:5684", db: db}
+	s := &Server{keepaliveTime: time.Hour, keepaliveInterval: time.Second * 5, keepaliveRetry: 5, shedRate: 10, Net: "tcp", Addr: "0.0.0.0:5684", db: db}
 
 	//load env variables
 	var keepaliveTime *int
 	var keepaliveInterval *int
 	var keepaliveRetry *int
+	var maxSessions, maxGoroutines, maxLatency, shedRate *int
+	var releaseHoldOff *int
+	shedStrategy := "newest"
 	var listenNetwork *string
 	var listenAddress *string
 	for _, e := range os.Environ() {
 		pair := strings.Split(e, "=")
 		key := pair[0]
 		switch key {
-		case envKeepaliveTime, envKeepaliveInterval, envKeepaliveRetry:
+		case envKeepaliveTime, envKeepaliveInterval, envKeepaliveRetry, envMaxSessions, envMaxGoroutines, envMaxLatency, envShedRate, envReleaseHoldOff:
 			val, err := strconv.Atoi(pair[1])
 			if err != nil {
 				log.Printf("Invalid value '%v' of env variable '%v: %v'", key, pair[1], err)
@@ -201,7 +228,21 @@ func NewServer(db registry.Registry) (*Server, error) {
 				keepaliveInterval = &val
 			case envKeepaliveRetry:
 				keepaliveRetry = &val
+			case envMaxSessions:
+				maxSessions = &val
+			case envMaxGoroutines:
+				maxGoroutines = &val
+			case envMaxLatency:
+				maxLatency = &val
+			case envShedRate:
+				shedRate = &val
+			case envReleaseHoldOff:
+				releaseHoldOff = &val
 			}
+		case envShedStrategy:
+			shedStrategy = pair[1]
+		case envReleaseOnExpiry:
+			s.releaseOnExpiry = pair[1] == "true"
 		case envListenAddress:
 			listenAddress = &pair[1]
 		case envListenNet:
@@ -216,14 +257,37 @@ func NewServer(db registry.Registry) (*Server, error) {
 		s.Addr = *listenAddress
 	}
 	if keepaliveTime != nil {
-		s.keepaliveTime = time.Duration(*keepaliveTime)
+		s.keepaliveTime = time.Duration(*keepaliveTime) * time.Second
 	}
 	if keepaliveInterval != nil {
-		s.keepaliveInterval = time.Duration(*keepaliveInterval)
+		s.keepaliveInterval = time.Duration(*keepaliveInterval) * time.Second
 	}
 	if keepaliveRetry != nil {
 		s.keepaliveRetry = *keepaliveRetry
 	}
+	if maxSessions != nil || maxGoroutines != nil || maxLatency != nil {
+		var sessions, goroutines, latency int
+		if maxSessions != nil {
+			sessions = *maxSessions
+		}
+		if maxGoroutines != nil {
+			goroutines = *maxGoroutines
+		}
+		if maxLatency != nil {
+			latency = *maxLatency
+		}
+		var err error
+		s.shedding, err = NewSheddingPolicy(shedStrategy, sessions, goroutines, time.Duration(latency)*time.Millisecond)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if shedRate != nil && *shedRate > 0 {
+		s.shedRate = *shedRate
+	}
+	if releaseHoldOff != nil {
+		s.releaseHoldOff = time.Duration(*releaseHoldOff) * time.Second
+	}
 	if strings.Contains(s.Net, "tls") {
 		var err error
 		s.TLSConfig, err = setupTLS()
@@ -231,6 +295,9 @@ func NewServer(db registry.Registry) (*Server, error) {
 			return nil, err
 		}
 	}
+	clientContainer.mutex.Lock()
+	clientContainer.tcpTLS = s.Net == "tcp-tls"
+	clientContainer.mutex.Unlock()
 
 	return s, nil
 }
@@ -241,24 +308,56 @@ func (server *Server) NewCoapServer() *coap.Server {
 	//mux.DefaultHandle(coap.HandlerFunc(DefaultHandler))
 	mux.Handle("/oic/sec/account", coap.HandlerFunc(handleAccountUpdateOrDelete(server.db)))
 	mux.Handle("oic/sec/session", coap.HandlerFunc(handleSessionUpdate(server.db)))
-	mux.Handle("oic/rd", coap.HandlerFunc(handleRDUpdate(server.db)))
+	mux.Handle("oic/rd", requireSignIn(coap.HandlerFunc(handleResourceDirectory(server.db))))
 	mux.Handle("oic/sec/tokenrefresh", coap.HandlerFunc(handleTokenRefresh(server.db)))
+	mux.Handle("/oic/res", requireSignIn(coap.HandlerFunc(handleResourceDiscovery(server.db))))
 
 	return &coap.Server{
 		Net:       server.Net,
 		Addr:      server.Addr,
 		TLSConfig: server.TLSConfig,
-		Handler:   mux,
+		Handler:   measureLatency(mux),
 		NotifySessionNewFunc: func(s *coap.ClientCommander) {
 			clientContainer.addSession(server, s)
 		},
 		NotifySessionEndFunc: func(s *coap.ClientCommander, err error) {
 			clientContainer.removeSession(s)
+			routes := deviceContainer.removeSession(s)
+			//while draining, Shutdown deletes the routes instead
+			if !server.isDraining() {
+				go server.signOut(routes)
+			}
 		},
 	}
 }
 
+//signOut marks the devices of a session that ended as signed out, unless they already signed in over another session
+func (server *Server) signOut(routes map[string]routing.Route) {
+	for deviceID, route := range routes {
+		_, _, err := server.db.UpdateSession(inFlight, deviceID, "", "", route, false)
+		if err != nil {
+			log.Println("err signing out ", deviceID, ": ", err)
+		}
+	}
+}
+
 //ListenAndServe starts a coapgateway on the configured address in *Server.
 func (server *Server) ListenAndServe() error {
-	return server.NewCoapServer().ListenAndServe()
+	if server.shedding != nil {
+		go server.shedLoad()
+	}
+	go server.heartbeat()
+	go server.consumeRequests()
+	coapServer := server.NewCoapServer()
+	if server.Net != "tcp" && server.Net != "tcp-tls" {
+		server.setCoapServer(coapServer, nil)
+		return coapServer.ListenAndServe()
+	}
+	l, err := server.listen()
+	if err != nil {
+		return err
+	}
+	coapServer.Listener = l
+	server.setCoapServer(coapServer, l)
+	return coapServer.ActivateAndServe()
 }
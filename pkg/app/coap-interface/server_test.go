@@ -12,11 +12,12 @@ import (
 	"time"
 
 	"github.com/go-ocf/go-coap"
+	"github.com/sking2600/coap-gateway/pkg/registry"
 )
 
 func testCreateCoapGateway(t *testing.T) (*coap.Server, string, chan error, error) {
 
-	server, err := NewServer(MysqlRedisRegistry{})
+	server, err := NewServer(registry.NewMemoryRegistry())
 	if err != nil {
 		return nil, "", nil, err
 	}
@@ -117,14 +118,14 @@ func TestSetupServer(t *testing.T) {
 	os.Setenv(envListenAddress, address)
 	os.Setenv(envListenNet, network)
 
-	s, err := NewServer(MysqlRedisRegistry{})
+	s, err := NewServer(registry.NewMemoryRegistry())
 	if err != nil {
 		t.Fatalf("cannot create server: %v", err)
 	}
-	if s.keepaliveTime != time.Duration(keepaliveTime) {
+	if s.keepaliveTime != time.Duration(keepaliveTime)*time.Second {
 		t.Fatalf("invalid keepaliveTime: %v != %v ", s.keepaliveTime, keepaliveTime)
 	}
-	if s.keepaliveInterval != time.Duration(keepaliveInterval) {
+	if s.keepaliveInterval != time.Duration(keepaliveInterval)*time.Second {
 		t.Fatalf("invalid keepaliveInterval: %v != %v ", s.keepaliveInterval, keepaliveInterval)
 	}
 	if s.keepaliveRetry != keepaliveRetry {
@@ -171,7 +172,7 @@ func TestSetupTLSServer(t *testing.T) {
 
 	testSetupTLS(t, dir)
 
-	_, err = NewServer(MysqlRedisRegistry{})
+	_, err = NewServer(registry.NewMemoryRegistry())
 	if err != nil {
 		t.Fatalf("cannot create server: %v", err)
 	}
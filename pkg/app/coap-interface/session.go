@@ -0,0 +1,145 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/go-ocf/go-coap"
+	"github.com/sking2600/coap-gateway/pkg/routing"
+	"github.com/sking2600/coap-gateway/pkg/webhooks"
+)
+
+//sessionState is what the device signed in to its session with
+type sessionState struct {
+	deviceID  string
+	userID    string
+	expiresAt time.Time //when the access token expires, zero if it doesn't
+}
+
+//signedIn reports whether the device signed in and its access token hasn't expired
+func (s sessionState) signedIn(now time.Time) bool {
+	return s.deviceID != "" && (s.expiresAt.IsZero() || now.Before(s.expiresAt))
+}
+
+//tokenExpiry returns when an access token that expires in that many seconds expires. OCF uses -1 for tokens that don't expire
+func tokenExpiry(expiresIn int) time.Time {
+	if expiresIn <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(expiresIn) * time.Second)
+}
+
+//setState replaces the state of the session and schedules its expiry. the caller holds the ClientContainer mutex
+func (s *Session) setState(state sessionState) {
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+	s.state = state
+	if state.expiresAt.IsZero() {
+		return
+	}
+	deviceID := state.deviceID
+	s.expiry = time.AfterFunc(time.Until(state.expiresAt), func() {
+		s.server.expireSession(s, deviceID)
+	})
+}
+
+//signIn records what the device signed in to the session of client with
+func (c *ClientContainer) signIn(client *coap.ClientCommander, state sessionState) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if s, ok := c.sessions[client.RemoteAddr().String()]; ok {
+		s.setState(state)
+	}
+}
+
+//signOut clears the state of the session of client
+func (c *ClientContainer) signOut(client *coap.ClientCommander) {
+	c.signIn(client, sessionState{})
+}
+
+//refreshToken moves the expiry of the session of client forward if it's signed in as deviceID
+func (c *ClientContainer) refreshToken(client *coap.ClientCommander, deviceID string, expiresIn int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if s, ok := c.sessions[client.RemoteAddr().String()]; ok && s.state.deviceID == deviceID {
+		state := s.state
+		state.expiresAt = tokenExpiry(expiresIn)
+		s.setState(state)
+	}
+}
+
+//expire clears the state of the session if it's still signed in as deviceID and its access token expired. returns false if the
+//token was refreshed or the device signed out since
+func (c *ClientContainer) expire(s *Session, deviceID string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if s.state.deviceID != deviceID || s.state.signedIn(time.Now()) {
+		return false
+	}
+	s.setState(sessionState{})
+	return true
+}
+
+/*expireSession signs the device out of the session once its access token expired without being refreshed: it's no longer
+reachable and its route is deleted from redis, unless it signed in over another session since. the session is released too if
+RELEASE_ON_EXPIRY is set, so that the device reconnects and signs in again with a fresh token
+*/
+func (server *Server) expireSession(s *Session, deviceID string) {
+	if !clientContainer.expire(s, deviceID) {
+		return
+	}
+	log.Println("access token of ", deviceID, " expired, signing it out of ", s.client.RemoteAddr())
+	if route, ok := deviceContainer.removeSessionDevice(deviceID, s.client); ok {
+		server.signOut(map[string]routing.Route{deviceID: route})
+		go events.Emit(inFlight, webhooks.DeviceSignedOut, deviceID, sessionEvent{DeviceID: deviceID})
+	}
+	if !server.releaseOnExpiry || !clientContainer.markReleased(s) {
+		return
+	}
+	err := releaseSession(s.client, "", server.releaseHoldOff)
+	if err != nil {
+		log.Println("err releasing session of ", s.client.RemoteAddr(), ": ", err)
+	}
+}
+
+//state returns what the device signed in to the session of client with, the zero value if it didn't
+func (c *ClientContainer) state(client *coap.ClientCommander) sessionState {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	s, ok := c.sessions[client.RemoteAddr().String()]
+	if !ok {
+		return sessionState{}
+	}
+	return s.state
+}
+
+//requireSignIn responds with 4.01 Unauthorized to the requests sent over sessions that haven't signed in to /oic/sec/session,
+//or whose access token expired since
+func requireSignIn(h coap.Handler) coap.Handler {
+	return coap.HandlerFunc(func(w coap.ResponseWriter, r *coap.Request) {
+		if !clientContainer.state(r.Client).signedIn(time.Now()) {
+			log.Println("request to ", r.Msg.PathString(), " from ", r.Client.RemoteAddr(), " before signing in")
+			w.WriteMsg(w.NewResponse(coap.Unauthorized))
+			return
+		}
+		h.ServeCOAP(w, r)
+	})
+}
+
+/*sameDevice responds with 4.03 Forbidden and returns false if the session the request was sent over signed in as another device
+than deviceID (the di of the payload or query). sessions that haven't signed in aren't tied to a device yet
+*/
+func sameDevice(w coap.ResponseWriter, req *coap.Request, deviceID string) bool {
+	state := clientContainer.state(req.Client)
+	if state.deviceID == "" || state.deviceID == deviceID {
+		return true
+	}
+	log.Println("session signed in as ", state.deviceID, " sent a request to ", req.Msg.PathString(), " for ", deviceID)
+	err := w.WriteMsg(w.NewResponse(coap.Forbidden))
+	if err != nil {
+		log.Println("err from writing response about the device of the request: ", err)
+	}
+	return false
+}
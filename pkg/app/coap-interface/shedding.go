@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-ocf/go-coap"
+)
+
+//LoadMetrics is a snapshot of how busy the pod is
+type LoadMetrics struct {
+	Sessions   int
+	Devices    int
+	Goroutines int
+	Latency    time.Duration //average CoAP request latency since the previous snapshot
+}
+
+//SheddingPolicy decides when the pod is overloaded and which sessions it releases to get back under its target
+type SheddingPolicy interface {
+	//Excess returns how many sessions have to be shed. 0 means the pod is under its target
+	Excess(m LoadMetrics) int
+	//Victims picks n of the sessions to be released
+	Victims(sessions []*Session, n int) []*Session
+}
+
+//VictimStrategy picks n of the sessions to be released. sessions are ordered oldest first
+type VictimStrategy func(sessions []*Session, n int) []*Session
+
+//victimStrategies are the strategies that can be selected with SHED_STRATEGY
+var victimStrategies = map[string]VictimStrategy{
+	"random":   randomVictims,
+	"oldest":   oldestVictims,
+	"newest":   newestVictims,
+	"weighted": ageWeightedVictims,
+}
+
+func randomVictims(sessions []*Session, n int) []*Session {
+	victims := make([]*Session, 0, n)
+	for _, i := range rand.Perm(len(sessions))[:n] {
+		victims = append(victims, sessions[i])
+	}
+	return victims
+}
+
+func oldestVictims(sessions []*Session, n int) []*Session {
+	return sessions[:n]
+}
+
+//newestVictims releases the sessions that were connected last, like a LIFO queue
+func newestVictims(sessions []*Session, n int) []*Session {
+	return sessions[len(sessions)-n:]
+}
+
+//ageWeightedVictims picks sessions at random, with a chance proportional to how long they have been connected
+func ageWeightedVictims(sessions []*Session, n int) []*Session {
+	now := time.Now()
+	candidates := append([]*Session(nil), sessions...)
+	victims := make([]*Session, 0, n)
+	for len(victims) < n {
+		var total float64
+		for _, s := range candidates {
+			total += now.Sub(s.connectedAt).Seconds() + 1 //+1 so brand new sessions can still be picked
+		}
+		pick := rand.Float64() * total
+		i := 0
+		for ; i < len(candidates)-1; i++ {
+			pick -= now.Sub(candidates[i].connectedAt).Seconds() + 1
+			if pick < 0 {
+				break
+			}
+		}
+		victims = append(victims, candidates[i])
+		candidates = append(candidates[:i], candidates[i+1:]...)
+	}
+	return victims
+}
+
+//loadTargets is the default SheddingPolicy. a target of 0 is ignored
+type loadTargets struct {
+	maxSessions   int
+	maxGoroutines int
+	maxLatency    time.Duration
+	strategy      VictimStrategy
+}
+
+//overloadShedFraction is the share of sessions shed per round while the goroutine or latency targets are exceeded, since
+//those can't be mapped to an exact number of sessions
+const overloadShedFraction = 0.1
+
+//NewSheddingPolicy returns a policy that sheds sessions over maxSessions, or a fraction of them while there are more than
+//maxGoroutines goroutines or requests take longer than maxLatency on average. strategy is one of random, oldest, newest or weighted
+func NewSheddingPolicy(strategy string, maxSessions, maxGoroutines int, maxLatency time.Duration) (SheddingPolicy, error) {
+	victims, ok := victimStrategies[strategy]
+	if !ok {
+		return nil, fmt.Errorf("unknown shedding strategy %q", strategy)
+	}
+	return loadTargets{maxSessions: maxSessions, maxGoroutines: maxGoroutines, maxLatency: maxLatency, strategy: victims}, nil
+}
+
+func (t loadTargets) Excess(m LoadMetrics) int {
+	excess := 0
+	if t.maxSessions > 0 && m.Sessions > t.maxSessions {
+		excess = m.Sessions - t.maxSessions
+	}
+	if (t.maxGoroutines > 0 && m.Goroutines > t.maxGoroutines) || (t.maxLatency > 0 && m.Latency > t.maxLatency) {
+		fraction := int(float64(m.Sessions)*overloadShedFraction + 0.5)
+		if fraction < 1 {
+			fraction = 1
+		}
+		if fraction > excess {
+			excess = fraction
+		}
+	}
+	if excess > m.Sessions {
+		excess = m.Sessions
+	}
+	return excess
+}
+
+func (t loadTargets) Victims(sessions []*Session, n int) []*Session {
+	return t.strategy(sessions, n)
+}
+
+//latencyRecorder averages the time spent handling CoAP requests
+type latencyRecorder struct {
+	total time.Duration
+	count int64
+	mutex sync.Mutex
+}
+
+func (l *latencyRecorder) record(d time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.total += d
+	l.count++
+}
+
+//average returns the average since the previous call
+func (l *latencyRecorder) average() time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.count == 0 {
+		return 0
+	}
+	avg := l.total / time.Duration(l.count)
+	l.total, l.count = 0, 0
+	return avg
+}
+
+var (
+	requestLatency = &latencyRecorder{}
+)
+
+//measureLatency wraps h so that the time spent handling each request is recorded
+func measureLatency(h coap.Handler) coap.Handler {
+	return coap.HandlerFunc(func(w coap.ResponseWriter, r *coap.Request) {
+		start := time.Now()
+		h.ServeCOAP(w, r)
+		requestLatency.record(time.Since(start))
+	})
+}
+
+func currentLoad() LoadMetrics {
+	deviceContainer.mutex.Lock()
+	devices := len(deviceContainer.devices)
+	deviceContainer.mutex.Unlock()
+	return LoadMetrics{
+		Sessions:   len(clientContainer.oldestSessions()),
+		Devices:    devices,
+		Goroutines: runtime.NumGoroutine(),
+		Latency:    requestLatency.average(),
+	}
+}
+
+//shedInterval is how often the load is compared with the policy's target
+var shedInterval = 10 * time.Second
+
+/*shedLoad checks the load every shedInterval and releases the sessions picked by the policy, at most shedRate per second so that
+the reconnecting devices don't overwhelm the other pods. the pod reports not ready for as long as it is over its target. it returns once
+the pod starts shutting down
+*/
+func (server *Server) shedLoad() {
+	for range time.Tick(shedInterval) {
+		if server.isDraining() {
+			return
+		}
+		load := currentLoad()
+		excess := server.shedding.Excess(load)
+		server.setOverloaded(excess > 0)
+		if excess == 0 {
+			continue
+		}
+		sessions := clientContainer.oldestSessions()
+		if excess > len(sessions) {
+			excess = len(sessions)
+		}
+		victims := server.shedding.Victims(sessions, excess)
+		log.Printf("over the load target (%+v), releasing %v sessions", load, len(victims))
+		for _, s := range victims {
+			releaseSessions([]*Session{s}, "", server.releaseHoldOff)
+			time.Sleep(time.Second / time.Duration(server.shedRate))
+		}
+	}
+}
+
+func (server *Server) setOverloaded(overloaded bool) {
+	var v int32
+	if overloaded {
+		v = 1
+	}
+	atomic.StoreInt32(&server.overloaded, v)
+}
+
+//handleReadiness reports not ready while the pod is over its load target or shutting down, so that the load balancer stops
+//sending it new devices
+func handleReadiness(server *Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if server.isDraining() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("shutting down"))
+			return
+		}
+		if atomic.LoadInt32(&server.overloaded) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("over the load target"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
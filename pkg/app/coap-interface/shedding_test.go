@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSheddingPolicyExcess(t *testing.T) {
+	policy, err := NewSheddingPolicy("newest", 10, 1000, 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("cannot create shedding policy: %v", err)
+	}
+	for _, tc := range []struct {
+		load LoadMetrics
+		want int
+	}{
+		{LoadMetrics{Sessions: 5, Goroutines: 100}, 0},
+		{LoadMetrics{Sessions: 13, Goroutines: 100}, 3},
+		{LoadMetrics{Sessions: 8, Goroutines: 5000}, 1},
+		{LoadMetrics{Sessions: 10, Latency: time.Second}, 1},
+		{LoadMetrics{Sessions: 0, Latency: time.Second}, 0},
+	} {
+		if got := policy.Excess(tc.load); got != tc.want {
+			t.Fatalf("%+v: expected %v sessions to be shed, got %v", tc.load, tc.want, got)
+		}
+	}
+	if _, err := NewSheddingPolicy("unknown", 10, 0, 0); err == nil {
+		t.Fatalf("unknown strategy was accepted")
+	}
+}
+
+func TestVictimStrategies(t *testing.T) {
+	now := time.Now()
+	sessions := []*Session{
+		{connectedAt: now.Add(-time.Hour)},
+		{connectedAt: now.Add(-time.Minute)},
+		{connectedAt: now},
+	}
+	if v := oldestVictims(sessions, 1); v[0] != sessions[0] {
+		t.Fatalf("oldest strategy didn't pick the oldest session")
+	}
+	if v := newestVictims(sessions, 2); v[0] != sessions[1] || v[1] != sessions[2] {
+		t.Fatalf("newest strategy didn't pick the newest sessions")
+	}
+	for name, strategy := range victimStrategies {
+		victims := strategy(sessions, 2)
+		if len(victims) != 2 || victims[0] == victims[1] {
+			t.Fatalf("%v strategy picked %v", name, victims)
+		}
+	}
+}
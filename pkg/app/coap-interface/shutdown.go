@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-ocf/go-coap"
+)
+
+//inFlight is passed to the registry by the CoAP handlers. it's cancelled once the shutdown deadline is reached so that
+//in-flight registry calls give up instead of holding the shutdown
+var inFlight, cancelInFlight = context.WithCancel(context.Background())
+
+//defaultShutdownTimeout leaves some room before kubernetes' default terminationGracePeriodSeconds of 30 kills the pod
+const defaultShutdownTimeout = 25 * time.Second
+
+//routeCleanupTimeout is how long Shutdown gives the registry to delete the pod's routes. the release phase leaves that much of the
+//deadline for it, and it doesn't depend on ctx so that it still runs if the deadline was reached
+const routeCleanupTimeout = 5 * time.Second
+
+//drainPollInterval is how often Shutdown checks whether every released device has disconnected
+var drainPollInterval = 100 * time.Millisecond
+
+//listen opens the listener for tcp and tcp-tls. it's kept by the Server so that Shutdown can stop accepting connections
+//without closing the sessions that are being drained
+func (server *Server) listen() (net.Listener, error) {
+	if server.Net == "tcp-tls" {
+		return tls.Listen("tcp", server.Addr, server.TLSConfig)
+	}
+	return net.Listen("tcp", server.Addr)
+}
+
+func (server *Server) setCoapServer(coapServer *coap.Server, l net.Listener) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.coapServer = coapServer
+	server.listener = l
+}
+
+func (server *Server) isDraining() bool {
+	return atomic.LoadInt32(&server.draining) == 1
+}
+
+/*Shutdown drains the pod: it reports not ready, stops accepting connections and releases every session at shedRate per second,
+or faster if that wouldn't release them all before the deadline of ctx (minus routeCleanupTimeout). it then deletes the routes that
+still point at this pod and shuts the coap server down once the devices are gone (or ctx is done)
+*/
+func (server *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&server.draining, 1)
+	server.mutex.Lock()
+	coapServer, l := server.coapServer, server.listener
+	server.mutex.Unlock()
+	if l != nil {
+		err := l.Close()
+		if err != nil {
+			log.Println("err closing the listener: ", err)
+		}
+	}
+
+	//sessions end as the devices disconnect, so the routes have to be collected before releasing them
+	routes := deviceContainer.allRoutes()
+
+	sessions := clientContainer.oldestSessions()
+	interval := releaseInterval(ctx, server.shedRate, len(sessions))
+	log.Println("draining ", len(sessions), " sessions, one every ", interval)
+	for _, s := range sessions {
+		if ctx.Err() != nil {
+			break
+		}
+		releaseSessions([]*Session{s}, "", server.releaseHoldOff)
+		select {
+		case <-ctx.Done():
+		case <-time.After(interval):
+		}
+	}
+	cleanup, cancel := context.WithTimeout(context.Background(), routeCleanupTimeout)
+	for deviceID, route := range routes {
+		err := server.db.ReleaseRoute(cleanup, deviceID, route)
+		if err != nil {
+			log.Println("err deleting the route of ", deviceID, ": ", err)
+		}
+	}
+	cancel()
+	for clientContainer.count() > 0 && ctx.Err() == nil {
+		time.Sleep(drainPollInterval)
+	}
+	if coapServer == nil {
+		return nil
+	}
+	return coapServer.Shutdown()
+}
+
+//releaseInterval is the time between two releases: 1/shedRate, or less if that wouldn't release every session before the deadline
+//of ctx while leaving routeCleanupTimeout for deleting the routes
+func releaseInterval(ctx context.Context, shedRate, sessions int) time.Duration {
+	interval := time.Second / time.Duration(shedRate)
+	deadline, ok := ctx.Deadline()
+	if !ok || sessions == 0 {
+		return interval
+	}
+	spread := time.Until(deadline.Add(-routeCleanupTimeout)) / time.Duration(sessions)
+	if spread < 0 {
+		return 0
+	}
+	if spread < interval {
+		return spread
+	}
+	return interval
+}
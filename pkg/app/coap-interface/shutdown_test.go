@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReleaseInterval(t *testing.T) {
+	if interval := releaseInterval(context.Background(), 10, 1000); interval != 100*time.Millisecond {
+		t.Fatalf("without a deadline sessions should be released at shedRate: %v", interval)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), routeCleanupTimeout+10*time.Second)
+	defer cancel()
+	if interval := releaseInterval(ctx, 10, 50); interval != 100*time.Millisecond {
+		t.Fatalf("a few sessions should be released at shedRate: %v", interval)
+	}
+	//1000 sessions at 10 per second would take 100 seconds
+	if interval := releaseInterval(ctx, 10, 1000); interval > 10*time.Millisecond {
+		t.Fatalf("every session should be released before the deadline: %v", interval)
+	}
+	expired, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if interval := releaseInterval(expired, 10, 1000); interval != 0 {
+		t.Fatalf("past the release deadline sessions should be released at once: %v", interval)
+	}
+}
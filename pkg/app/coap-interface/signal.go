@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-ocf/go-coap"
+)
+
+/*RFC 8323 signalling. a Release (7.04) asks the device to close the connection and reconnect, which sends it back through the
+L4 load balancer (possibly to another pod) without the device treating it as a cloud failure in its clec. an Abort (7.05) tells
+the device that the connection is being closed because of an error
+*/
+
+const (
+	//optionAlternativeAddress (RFC 8323 5.5.1) is the host[:port] the device should reconnect to. when it's left out the device
+	//reconnects to the same address, which is the load balancer
+	optionAlternativeAddress coap.OptionID = 2
+	//optionHoldOff (RFC 8323 5.5.2) is how many seconds the device should wait before reconnecting
+	optionHoldOff coap.OptionID = 4
+)
+
+//releaseGracePeriod is how long a released device has to close the connection by itself before the pod closes it
+var releaseGracePeriod = 30 * time.Second
+
+//releaseSession sends a Release signal. the session is closed once the grace period is over if the device hasn't done so already
+func releaseSession(client *coap.ClientCommander, alternativeAddress string, holdOff time.Duration) error {
+	msg := client.NewMessage(coap.MessageParams{Code: coap.Release})
+	if alternativeAddress != "" {
+		msg.SetOption(optionAlternativeAddress, alternativeAddress)
+	}
+	if holdOff > 0 {
+		msg.SetOption(optionHoldOff, uint32(holdOff/time.Second))
+	}
+	err := client.WriteMsg(msg)
+	if err != nil {
+		return err
+	}
+	time.AfterFunc(releaseGracePeriod, func() {
+		client.Close()
+	})
+	return nil
+}
+
+//abortSession sends an Abort signal with diagnostic as its payload and closes the session
+func abortSession(client *coap.ClientCommander, diagnostic string) {
+	msg := client.NewMessage(coap.MessageParams{Code: coap.Abort, Payload: []byte(diagnostic)})
+	err := client.WriteMsg(msg)
+	if err != nil {
+		log.Println("err sending ABORT to ", client.RemoteAddr(), ": ", err)
+	}
+	err = client.Close()
+	if err != nil {
+		log.Println("err closing session of ", client.RemoteAddr(), ": ", err)
+	}
+}
+
+//oldestSessions returns every session that hasn't been released yet, the ones that have been connected the longest first
+func (c *ClientContainer) oldestSessions() []*Session {
+	c.mutex.Lock()
+	sessions := make([]*Session, 0, len(c.sessions))
+	for _, s := range c.sessions {
+		if !s.released {
+			sessions = append(sessions, s)
+		}
+	}
+	c.mutex.Unlock()
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].connectedAt.Before(sessions[j].connectedAt)
+	})
+	return sessions
+}
+
+//markReleased flags the session as released. returns false if it already was
+func (c *ClientContainer) markReleased(s *Session) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if s.released {
+		return false
+	}
+	s.released = true
+	return true
+}
+
+//releaseSessions sends a Release to every session and returns how many were released. sessions are only ever released once
+func releaseSessions(sessions []*Session, alternativeAddress string, holdOff time.Duration) int {
+	released := 0
+	for _, s := range sessions {
+		if !clientContainer.markReleased(s) {
+			continue
+		}
+		err := releaseSession(s.client, alternativeAddress, holdOff)
+		if err != nil {
+			log.Println("err releasing session of ", s.client.RemoteAddr(), ": ", err)
+			continue
+		}
+		released++
+	}
+	return released
+}
+
+/*handleRelease handles POST /admin/release?di=<deviceID>&count=<n>&alternativeaddress=<host:port>&holdoff=<seconds>.
+di (can be repeated) releases the sessions of those devices and count releases the n sessions that have been connected the longest.
+responds with {"released": <number of sessions>}. this endpoint is only meant to be reachable from inside the cluster
+*/
+func handleRelease(server *Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		holdOff := server.releaseHoldOff
+		if v := query.Get("holdoff"); v != "" {
+			seconds, err := strconv.Atoi(v)
+			if err != nil || seconds < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("holdoff must be a number of seconds"))
+				return
+			}
+			holdOff = time.Duration(seconds) * time.Second
+		}
+		count := 0
+		if v := query.Get("count"); v != "" {
+			var err error
+			count, err = strconv.Atoi(v)
+			if err != nil || count < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("count must be a positive number"))
+				return
+			}
+		}
+		var selected []*Session
+		for _, deviceID := range query["di"] {
+			client, ok := deviceContainer.client(deviceID)
+			if !ok {
+				continue
+			}
+			if s, ok := clientContainer.session(client); ok {
+				selected = append(selected, s)
+			}
+		}
+		sessions := clientContainer.oldestSessions()
+		if count > len(sessions) {
+			count = len(sessions)
+		}
+		selected = append(selected, sessions[:count]...)
+		released := releaseSessions(selected, query.Get("alternativeaddress"), holdOff)
+		log.Println("released ", released, " sessions on request")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Released int `json:"released"`
+		}{released})
+	}
+}
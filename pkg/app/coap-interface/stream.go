@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/go-redis/redis"
+
+	"github.com/sking2600/coap-gateway/pkg/routing"
+)
+
+var envRouter = "ROUTER"
+
+/*consumeRequests serves the requests that the northbound-interface publishes to this pod's stream when ROUTER is "redis-stream".
+they're handled like the ones sent to the internal http server, which includes serving them while the sessions drain
+*/
+func (server *Server) consumeRequests() {
+	if os.Getenv(envRouter) != "redis-stream" {
+		return
+	}
+	client := redis.NewClient(&redis.Options{
+		Addr:     redisAddress,
+		Password: redisPassword,
+	})
+	log.Println("consuming requests from ", routing.RequestStream(podAddr))
+	//requests published before the pod started were meant for the one that had this address before
+	lastID := routing.StreamIDAt(time.Now())
+	for {
+		requests, next, err := routing.ReadRequests(client, podAddr, lastID, 5*time.Second)
+		if err != nil {
+			log.Println("err reading requests from ", routing.RequestStream(podAddr), ": ", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		lastID = next
+		for _, req := range requests {
+			go replyTo(client, req)
+		}
+	}
+}
+
+func replyTo(client *redis.Client, req routing.StreamRequest) {
+	reply := routing.StreamReply{ID: req.ID}
+	_, connected := deviceContainer.client(req.DeviceID)
+	switch {
+	case req.Method == http.MethodDelete && req.Href == "":
+		log.Println("closing session of deleted device ", req.DeviceID)
+		deviceContainer.closeDevice(req.DeviceID)
+		reply.Status = http.StatusNoContent
+	//same order as the HTTP handler: a device that isn't connected is 404 whatever the epoch
+	case !connected:
+		log.Println("request for ", req.DeviceID, " but it isn't connected to this pod")
+		reply.Status = http.StatusNotFound
+	case !holdsRoute(req.DeviceID, req.Epoch):
+		reply.Status = http.StatusConflict
+	default:
+		var err error
+		reply.Status, reply.ContentType, reply.Body, err = forwardToDevice(req.DeviceID, req.Method, req.Href, req.Query, req.ContentType, req.Accept, req.Body)
+		reply.DeviceResponded = err == nil
+	}
+	err := routing.PublishReply(client, req.ReplyTo, reply)
+	if err != nil {
+		log.Println("err replying to request ", req.ID, " for ", req.DeviceID, ": ", err)
+	}
+}
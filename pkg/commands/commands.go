@@ -0,0 +1,66 @@
+package commands
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	//ErrCommandNotFound is returned for unknown commands, including the ones whose result was dropped after the retention period
+	ErrCommandNotFound = errors.New("command not found")
+	//ErrCommandNotPending is returned when a command can't be claimed or completed because it expired, was completed or is being
+	//delivered by someone else
+	ErrCommandNotPending = errors.New("command is not pending")
+)
+
+//Status of a command
+const (
+	StatusPending    = "pending"    //waiting for the device to be reachable
+	StatusDelivering = "delivering" //claimed by a pod that is sending it to the device
+	StatusCompleted  = "completed"  //the device responded, Result and Payload hold its response
+	StatusExpired    = "expired"    //the command wasn't delivered before ExpiresAt
+)
+
+//Command is a request for a device that's delivered asynchronously
+type Command struct {
+	ID          string
+	DeviceID    string
+	Method      string //an HTTP method, POST for commands queued before methods were stored
+	Href        string
+	Query       string
+	ContentType string //of Body
+	Body        []byte
+	Status      string
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+	CompletedAt time.Time //zero until the command is completed
+	Result      int       //HTTP status of the delivery, 0 until the command is completed
+	Payload     []byte    //response of the device
+}
+
+//claimable reports whether the command can be claimed at now. a command whose delivery lease ran out (ex: the pod delivering it
+//died) can be claimed again, so commands are delivered at least once
+func claimable(status string, expires, lease, now time.Time) bool {
+	if !now.Before(expires) {
+		return false
+	}
+	return status == StatusPending || (status == StatusDelivering && !now.Before(lease))
+}
+
+/*Queue stores the commands of the devices until they're delivered and their results for a retention period after that.
+any pod may enqueue commands, the one that delivers a command claims it first so that it isn't sent twice by concurrent deliveries
+*/
+type Queue interface {
+	//Enqueue adds a pending command (ID, DeviceID, Method, Href and ExpiresAt must be set) at the end of the device's queue
+	Enqueue(c Command) error
+	//Get returns the command or ErrCommandNotFound. pending commands past their expiry are reported as StatusExpired
+	Get(id string) (Command, error)
+	//Pending returns the commands of the device that can be claimed, oldest first
+	Pending(deviceID string) ([]Command, error)
+	//Claim marks the command as being delivered for the next lease. returns ErrCommandNotPending if it can't be claimed
+	Claim(id string, lease time.Duration) error
+	//Release puts a claimed command back in the queue (ex: the device disconnected before responding)
+	Release(id string) error
+	//Complete stores the response of the device to a claimed command
+	Complete(id string, result int, payload []byte) error
+}
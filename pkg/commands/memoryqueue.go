@@ -0,0 +1,132 @@
+package commands
+
+import (
+	"sync"
+	"time"
+)
+
+type memCommand struct {
+	Command
+	lease time.Time
+}
+
+//MemoryQueue keeps commands in a map. it's only useful when every service runs in the same process (ex: tests)
+type MemoryQueue struct {
+	commands  map[string]*memCommand
+	devices   map[string][]string //device -> ids of its commands, oldest first
+	retention time.Duration
+	mutex     sync.Mutex
+}
+
+//NewMemoryQueue returns an empty in-memory Queue that keeps results for retention
+func NewMemoryQueue(retention time.Duration) *MemoryQueue {
+	return &MemoryQueue{commands: make(map[string]*memCommand), devices: make(map[string][]string), retention: retention}
+}
+
+//Enqueue adds a pending command to the device's queue
+func (q *MemoryQueue) Enqueue(c Command) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	c.Status = StatusPending
+	c.CreatedAt = time.Now()
+	q.commands[c.ID] = &memCommand{Command: c}
+	q.devices[c.DeviceID] = append(q.devices[c.DeviceID], c.ID)
+	return nil
+}
+
+//get returns the command unless it's past its retention. the caller must hold the lock
+func (q *MemoryQueue) get(id string) (*memCommand, bool) {
+	c, ok := q.commands[id]
+	if !ok {
+		return nil, false
+	}
+	end := c.ExpiresAt
+	if c.Status == StatusCompleted {
+		end = c.CompletedAt
+	}
+	if time.Now().After(end.Add(q.retention)) {
+		delete(q.commands, id)
+		return nil, false
+	}
+	return c, true
+}
+
+//Get returns the command
+func (q *MemoryQueue) Get(id string) (Command, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	c, ok := q.get(id)
+	if !ok {
+		return Command{}, ErrCommandNotFound
+	}
+	if c.Status != StatusCompleted && !time.Now().Before(c.ExpiresAt) {
+		c.Status = StatusExpired
+	}
+	return c.Command, nil
+}
+
+//Pending returns the commands of the device that can be claimed and drops the others from its queue
+func (q *MemoryQueue) Pending(deviceID string) ([]Command, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	now := time.Now()
+	var pending []Command
+	var ids []string
+	for _, id := range q.devices[deviceID] {
+		c, ok := q.get(id)
+		if !ok || c.Status == StatusCompleted || !now.Before(c.ExpiresAt) {
+			continue
+		}
+		ids = append(ids, id)
+		if claimable(c.Status, c.ExpiresAt, c.lease, now) {
+			pending = append(pending, c.Command)
+		}
+	}
+	if len(ids) == 0 {
+		delete(q.devices, deviceID)
+	} else {
+		q.devices[deviceID] = ids
+	}
+	return pending, nil
+}
+
+//Claim marks the command as being delivered for the next lease
+func (q *MemoryQueue) Claim(id string, lease time.Duration) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	c, ok := q.get(id)
+	now := time.Now()
+	if !ok || !claimable(c.Status, c.ExpiresAt, c.lease, now) {
+		return ErrCommandNotPending
+	}
+	c.Status = StatusDelivering
+	c.lease = now.Add(lease)
+	return nil
+}
+
+//Release puts a claimed command back in the queue
+func (q *MemoryQueue) Release(id string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	c, ok := q.get(id)
+	if !ok || c.Status != StatusDelivering {
+		return ErrCommandNotPending
+	}
+	c.Status = StatusPending
+	return nil
+}
+
+//Complete stores the response of the device to a claimed command
+func (q *MemoryQueue) Complete(id string, result int, payload []byte) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	c, ok := q.get(id)
+	if !ok || c.Status != StatusDelivering {
+		return ErrCommandNotPending
+	}
+	c.Status = StatusCompleted
+	c.CompletedAt = time.Now()
+	c.Result = result
+	c.Payload = payload
+	return nil
+}
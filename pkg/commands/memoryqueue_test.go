@@ -0,0 +1,62 @@
+package commands
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryQueue(t *testing.T) {
+	q := NewMemoryQueue(time.Hour)
+	if _, err := q.Get("missing"); err != ErrCommandNotFound {
+		t.Fatalf("expected ErrCommandNotFound, got %v", err)
+	}
+	q.Enqueue(Command{ID: "1", DeviceID: "device-test-uuid", Href: "light", Body: []byte(`{"on":true}`), ExpiresAt: time.Now().Add(time.Hour)})
+	q.Enqueue(Command{ID: "2", DeviceID: "device-test-uuid", Href: "light", ExpiresAt: time.Now().Add(time.Hour)})
+	pending, err := q.Pending("device-test-uuid")
+	if err != nil || len(pending) != 2 || pending[0].ID != "1" {
+		t.Fatalf("unexpected pending commands: %v %v", pending, err)
+	}
+	if err := q.Claim("1", time.Minute); err != nil {
+		t.Fatalf("cannot claim command: %v", err)
+	}
+	if err := q.Claim("1", time.Minute); err != ErrCommandNotPending {
+		t.Fatalf("command was claimed twice: %v", err)
+	}
+	if pending, _ := q.Pending("device-test-uuid"); len(pending) != 1 || pending[0].ID != "2" {
+		t.Fatalf("claimed command is still pending: %v", pending)
+	}
+	if err := q.Complete("1", 200, []byte("ok")); err != nil {
+		t.Fatalf("cannot complete command: %v", err)
+	}
+	c, err := q.Get("1")
+	if err != nil || c.Status != StatusCompleted || c.Result != 200 || string(c.Payload) != "ok" {
+		t.Fatalf("unexpected command: %+v %v", c, err)
+	}
+	//a released command can be claimed again, ex: by the pod the device reconnected to
+	q.Claim("2", time.Minute)
+	if err := q.Release("2"); err != nil {
+		t.Fatalf("cannot release command: %v", err)
+	}
+	if err := q.Claim("2", time.Minute); err != nil {
+		t.Fatalf("cannot claim released command: %v", err)
+	}
+}
+
+func TestMemoryQueueExpiry(t *testing.T) {
+	q := NewMemoryQueue(time.Hour)
+	q.Enqueue(Command{ID: "1", DeviceID: "device-test-uuid", ExpiresAt: time.Now().Add(time.Millisecond)})
+	q.Enqueue(Command{ID: "2", DeviceID: "device-test-uuid", ExpiresAt: time.Now().Add(time.Hour)})
+	q.Claim("2", time.Nanosecond)
+	time.Sleep(2 * time.Millisecond)
+	if err := q.Claim("1", time.Minute); err != ErrCommandNotPending {
+		t.Fatalf("expired command was claimed: %v", err)
+	}
+	if c, err := q.Get("1"); err != nil || c.Status != StatusExpired {
+		t.Fatalf("expected an expired command, got %+v %v", c, err)
+	}
+	//the lease of the pod delivering the second command ran out
+	pending, _ := q.Pending("device-test-uuid")
+	if len(pending) != 1 || pending[0].ID != "2" {
+		t.Fatalf("unexpected pending commands: %v", pending)
+	}
+}
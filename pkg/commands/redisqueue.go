@@ -0,0 +1,207 @@
+package commands
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+//commands are stored in a hash under command:<id> and the ids of a device's commands in a list under commands:<deviceID>
+const (
+	commandKeyPrefix = "command:"
+	deviceKeyPrefix  = "commands:"
+)
+
+var (
+	//enqueueScript stores the command hash (ARGV[3...] are its fields and values) and appends ARGV[1] to the device's queue.
+	//both expire at ARGV[2] (unix ms, the expiry plus the retention), the queue only ever gets a later expiry
+	//KEYS: command, device queue
+	enqueueScript = redis.NewScript(`
+redis.call("HMSET", KEYS[1], unpack(ARGV, 3))
+redis.call("PEXPIREAT", KEYS[1], ARGV[2])
+redis.call("RPUSH", KEYS[2], ARGV[1])
+local ttl = redis.call("PTTL", KEYS[2])
+if ttl < 0 or tonumber(redis.call("TIME")[1]) * 1000 + ttl < tonumber(ARGV[2]) then
+	redis.call("PEXPIREAT", KEYS[2], ARGV[2])
+end
+return 1`)
+	//claimScript marks the command as delivering until ARGV[2] (unix ms) if it's pending, or delivering with a lease that ran out,
+	//and hasn't expired at ARGV[1]
+	claimScript = redis.NewScript(`
+local c = redis.call("HMGET", KEYS[1], "status", "expires", "lease")
+if not c[1] or tonumber(c[2]) <= tonumber(ARGV[1]) then
+	return 0
+end
+if c[1] == "pending" or (c[1] == "delivering" and tonumber(c[3]) <= tonumber(ARGV[1])) then
+	redis.call("HMSET", KEYS[1], "status", "delivering", "lease", ARGV[2])
+	return 1
+end
+return 0`)
+	//releaseScript puts the command back to pending if it's being delivered
+	releaseScript = redis.NewScript(`
+if redis.call("HGET", KEYS[1], "status") ~= "delivering" then
+	return 0
+end
+redis.call("HSET", KEYS[1], "status", "pending")
+return 1`)
+	//completeScript stores the result (ARGV[1]), payload (ARGV[2]) and completion time (ARGV[3], unix ms) of a command that's being
+	//delivered, keeps it for ARGV[4] ms and removes it (ARGV[5] is its id) from the queue of its device
+	//KEYS: command, device queue
+	completeScript = redis.NewScript(`
+if redis.call("HGET", KEYS[1], "status") ~= "delivering" then
+	return 0
+end
+redis.call("HMSET", KEYS[1], "status", "completed", "result", ARGV[1], "payload", ARGV[2], "completed", ARGV[3])
+redis.call("PEXPIRE", KEYS[1], ARGV[4])
+redis.call("LREM", KEYS[2], 0, ARGV[5])
+return 1`)
+)
+
+//RedisQueue stores commands in redis so that they survive restarts and can be delivered by any pod
+type RedisQueue struct {
+	client    *redis.Client
+	retention time.Duration
+}
+
+//NewRedisQueue returns a Queue backed by the redis client that keeps results for retention
+func NewRedisQueue(client *redis.Client, retention time.Duration) *RedisQueue {
+	return &RedisQueue{client: client, retention: retention}
+}
+
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromUnixMilli(s string) time.Time {
+	ms, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || ms == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+//result returns nil if the script returned 1 and ErrCommandNotPending if it returned 0
+func result(cmd *redis.Cmd) error {
+	n, err := cmd.Int64()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrCommandNotPending
+	}
+	return nil
+}
+
+//Enqueue adds a pending command to the device's queue
+func (q *RedisQueue) Enqueue(c Command) error {
+	keep := unixMilli(c.ExpiresAt.Add(q.retention))
+	return result(enqueueScript.Run(q.client, []string{commandKeyPrefix + c.ID, deviceKeyPrefix + c.DeviceID},
+		c.ID, keep,
+		"di", c.DeviceID,
+		"method", c.Method,
+		"href", c.Href,
+		"query", c.Query,
+		"contenttype", c.ContentType,
+		"body", c.Body,
+		"status", StatusPending,
+		"created", unixMilli(time.Now()),
+		"expires", unixMilli(c.ExpiresAt),
+		"lease", 0,
+	))
+}
+
+//get returns the command as it's stored, with the time of its lease
+func (q *RedisQueue) get(id string) (Command, time.Time, error) {
+	fields, err := q.client.HGetAll(commandKeyPrefix + id).Result()
+	if err != nil {
+		return Command{}, time.Time{}, err
+	}
+	if len(fields) == 0 {
+		return Command{}, time.Time{}, ErrCommandNotFound
+	}
+	resultCode, _ := strconv.Atoi(fields["result"])
+	c := Command{
+		ID:          id,
+		DeviceID:    fields["di"],
+		Method:      fields["method"],
+		Href:        fields["href"],
+		Query:       fields["query"],
+		ContentType: fields["contenttype"],
+		Body:        []byte(fields["body"]),
+		Status:      fields["status"],
+		CreatedAt:   fromUnixMilli(fields["created"]),
+		ExpiresAt:   fromUnixMilli(fields["expires"]),
+		CompletedAt: fromUnixMilli(fields["completed"]),
+		Result:      resultCode,
+	}
+	if c.Method == "" {
+		c.Method = http.MethodPost
+	}
+	if c.Status == StatusCompleted {
+		c.Payload = []byte(fields["payload"])
+	}
+	return c, fromUnixMilli(fields["lease"]), nil
+}
+
+//Get returns the command
+func (q *RedisQueue) Get(id string) (Command, error) {
+	c, _, err := q.get(id)
+	if err != nil {
+		return c, err
+	}
+	if c.Status != StatusCompleted && !time.Now().Before(c.ExpiresAt) {
+		c.Status = StatusExpired
+	}
+	return c, nil
+}
+
+//Pending returns the commands of the device that can be claimed and drops the ones that are done from its queue
+func (q *RedisQueue) Pending(deviceID string) ([]Command, error) {
+	key := deviceKeyPrefix + deviceID
+	ids, err := q.client.LRange(key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var pending []Command
+	for _, id := range ids {
+		c, lease, err := q.get(id)
+		if err == ErrCommandNotFound || (err == nil && (c.Status == StatusCompleted || !now.Before(c.ExpiresAt))) {
+			q.client.LRem(key, 0, id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if claimable(c.Status, c.ExpiresAt, lease, now) {
+			pending = append(pending, c)
+		}
+	}
+	return pending, nil
+}
+
+//Claim marks the command as being delivered for the next lease
+func (q *RedisQueue) Claim(id string, lease time.Duration) error {
+	now := time.Now()
+	return result(claimScript.Run(q.client, []string{commandKeyPrefix + id}, unixMilli(now), unixMilli(now.Add(lease))))
+}
+
+//Release puts a claimed command back in the queue
+func (q *RedisQueue) Release(id string) error {
+	return result(releaseScript.Run(q.client, []string{commandKeyPrefix + id}))
+}
+
+//Complete stores the response of the device to a claimed command
+func (q *RedisQueue) Complete(id string, resultCode int, payload []byte) error {
+	c, _, err := q.get(id)
+	if err == ErrCommandNotFound {
+		return ErrCommandNotPending
+	}
+	if err != nil {
+		return err
+	}
+	return result(completeScript.Run(q.client, []string{commandKeyPrefix + id, deviceKeyPrefix + c.DeviceID},
+		resultCode, payload, unixMilli(time.Now()), int64(q.retention/time.Millisecond), id))
+}
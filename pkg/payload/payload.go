@@ -0,0 +1,172 @@
+/*Package payload translates between the JSON HTTP clients send and expect and the CBOR (application/vnd.ocf+cbor) OCF devices
+speak. JSON numbers without a fraction or an exponent become CBOR integers. CBOR has a few things JSON doesn't, so they're
+translated this way: byte strings become base64 (standard encoding, with padding) strings, map keys that aren't text strings
+(ex: integer keys) become their decimal representation and tags are dropped, keeping the tagged value
+*/
+package payload
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/ugorji/go/codec"
+)
+
+//media types of the payloads
+const (
+	JSON    = "application/json"
+	CBOR    = "application/cbor"
+	OCFCBOR = "application/vnd.ocf+cbor"
+)
+
+//ErrUnsupportedMediaType is returned for payloads that are neither JSON nor CBOR
+var ErrUnsupportedMediaType = errors.New("unsupported media type")
+
+//MediaType returns the media type of a Content-Type header (or of an element of an Accept header) without its parameters
+func MediaType(contentType string) string {
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+//IsCBOR returns whether the media type is one of the CBOR ones
+func IsCBOR(mediaType string) bool {
+	return mediaType == CBOR || mediaType == OCFCBOR
+}
+
+/*ToCBOR returns the body of a request for a device, which has the contentType, as CBOR. JSON is transcoded and CBOR is passed
+through as is. a missing content type is taken as JSON, anything else returns ErrUnsupportedMediaType
+*/
+func ToCBOR(contentType string, b []byte) ([]byte, error) {
+	switch MediaType(contentType) {
+	case "", JSON:
+		return JSONToCBOR(b)
+	case CBOR, OCFCBOR:
+		return b, nil
+	}
+	return nil, ErrUnsupportedMediaType
+}
+
+/*Negotiate returns the media type a CBOR payload should be sent in to a client with the Accept header: JSON, CBOR or OCFCBOR.
+the one with the highest quality wins, the first listed one on a tie. JSON is the default, for wildcards or when none of them
+is listed
+*/
+func Negotiate(accept string) string {
+	best, bestQuality := JSON, 0.0
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, q := MediaType(mediaRange), quality(mediaRange)
+		if q <= bestQuality {
+			continue
+		}
+		switch mediaType {
+		case JSON, CBOR, OCFCBOR:
+			best, bestQuality = mediaType, q
+		case "*/*", "application/*":
+			best, bestQuality = JSON, q
+		}
+	}
+	return best
+}
+
+//quality returns the q parameter of an element of an Accept header, 1 if it has none
+func quality(mediaRange string) float64 {
+	params := strings.Split(mediaRange, ";")
+	for _, param := range params[1:] {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) != "q" {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		if err != nil {
+			return 1
+		}
+		return q
+	}
+	return 1
+}
+
+//FromCBOR returns a CBOR payload in the mediaType returned by Negotiate. CBOR is passed through as is
+func FromCBOR(mediaType string, b []byte) ([]byte, error) {
+	if IsCBOR(mediaType) {
+		return b, nil
+	}
+	return CBORToJSON(b)
+}
+
+//JSONToCBOR re-encodes a json document as canonical CBOR. an empty document stays empty
+func JSONToCBOR(b []byte) ([]byte, error) {
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil, nil
+	}
+	var v interface{}
+	jh := new(codec.JsonHandle)
+	jh.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	err := codec.NewDecoderBytes(b, jh).Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	h := new(codec.CborHandle)
+	h.BasicHandle.Canonical = true
+	err = codec.NewEncoder(buf, h).Encode(v)
+	return buf.Bytes(), err
+}
+
+//CBORToJSON re-encodes a CBOR document as json, with its map keys sorted. an empty document stays empty
+func CBORToJSON(b []byte) ([]byte, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	var v interface{}
+	err := codec.NewDecoderBytes(b, new(codec.CborHandle)).Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	h := new(codec.JsonHandle)
+	h.BasicHandle.Canonical = true
+	err = codec.NewEncoder(buf, h).Encode(jsonValue(v))
+	return buf.Bytes(), err
+}
+
+//jsonValue replaces the parts of a decoded CBOR document that JSON can't represent
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[jsonKey(key)] = jsonValue(value)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, value := range v {
+			a[i] = jsonValue(value)
+		}
+		return a
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v)
+	case codec.RawExt:
+		return jsonValue(v.Value)
+	case *codec.RawExt:
+		return jsonValue(v.Value)
+	}
+	return v
+}
+
+//jsonKey returns the map key as a string
+func jsonKey(key interface{}) string {
+	switch key := key.(type) {
+	case string:
+		return key
+	case []byte:
+		return base64.StdEncoding.EncodeToString(key)
+	}
+	return fmt.Sprint(key)
+}
@@ -0,0 +1,89 @@
+package payload
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ugorji/go/codec"
+)
+
+func cbor(t *testing.T, v interface{}) []byte {
+	buf := new(bytes.Buffer)
+	h := new(codec.CborHandle)
+	h.BasicHandle.Canonical = true
+	err := codec.NewEncoder(buf, h).Encode(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	b, err := JSONToCBOR([]byte(`{"value":true,"dimmingSetting":50,"rt":["oic.r.switch.binary"],"temp":21.5}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, cbor(t, map[string]interface{}{"value": true, "dimmingSetting": 50, "rt": []string{"oic.r.switch.binary"}, "temp": 21.5})) {
+		t.Errorf("numbers without a fraction should be encoded as integers, got %x", b)
+	}
+	j, err := CBORToJSON(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(j) != `{"dimmingSetting":50,"rt":["oic.r.switch.binary"],"temp":21.5,"value":true}` {
+		t.Errorf("unexpected json: %s", j)
+	}
+}
+
+func TestCBORToJSON(t *testing.T) {
+	b := cbor(t, map[interface{}]interface{}{1: "one", "key": []byte{0xde, 0xad, 0xbe, 0xef}, "nested": []interface{}{map[interface{}]interface{}{-2: []byte("hi")}}})
+	j, err := CBORToJSON(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(j) != `{"1":"one","key":"3q2+7w==","nested":[{"-2":"aGk="}]}` {
+		t.Errorf("unexpected json: %s", j)
+	}
+	j, err = CBORToJSON(nil)
+	if err != nil || j != nil {
+		t.Errorf("an empty payload should stay empty, got %s %v", j, err)
+	}
+}
+
+func TestToCBOR(t *testing.T) {
+	raw := cbor(t, map[string]interface{}{"value": true})
+	for _, contentType := range []string{"", "application/json", "application/json; charset=utf-8", "application/cbor", "application/vnd.ocf+cbor"} {
+		body := raw
+		if !IsCBOR(MediaType(contentType)) {
+			body = []byte(`{"value":true}`)
+		}
+		b, err := ToCBOR(contentType, body)
+		if err != nil || !bytes.Equal(b, raw) {
+			t.Errorf("ToCBOR(%q) = %x, %v", contentType, b, err)
+		}
+	}
+	if _, err := ToCBOR("text/plain", []byte("on")); err != ErrUnsupportedMediaType {
+		t.Errorf("text/plain should be unsupported, got %v", err)
+	}
+	if _, err := ToCBOR("application/json", []byte("{")); err == nil {
+		t.Error("invalid json should fail")
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := map[string]string{
+		"":                                   JSON,
+		"*/*":                                JSON,
+		"text/html":                          JSON,
+		"application/cbor":                   CBOR,
+		"Application/Vnd.OCF+CBOR":           OCFCBOR,
+		"application/json, application/cbor": JSON,
+		"application/json;q=0.5, application/vnd.ocf+cbor": OCFCBOR,
+		"application/cbor;q=0, */*":                        JSON,
+	}
+	for accept, want := range tests {
+		if got := Negotiate(accept); got != want {
+			t.Errorf("Negotiate(%q) = %q, want %q", accept, got, want)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/url"
+)
+
+//discoveredDevice is one element of the array returned by FindDevice
+type discoveredDevice struct {
+	DeviceID string            `json:"di"`
+	Links    []json.RawMessage `json:"links"`
+}
+
+//discoveryLink holds the fields of a published link that FindDevice can filter on. the link itself is returned as it was published
+type discoveryLink struct {
+	Href         string   `json:"href"`
+	Anchor       string   `json:"anchor"`
+	ResourceType []string `json:"rt"`
+	Interface    []string `json:"if"`
+}
+
+/*filterLinks implements the GET /oic/res filters for registries that can't filter the json inside the database.
+links maps device UUIDs to the links they published on oic/rd. di, href and anchor have to match one of their values and
+rt and if have to share at least one value with the link. devices without any matching links are left out
+*/
+func filterLinks(links map[string][]json.RawMessage, params url.Values) (string, error) {
+	devices := []discoveredDevice{}
+	for deviceID, published := range links {
+		if !matchesAny(params["di"], deviceID) {
+			continue
+		}
+		device := discoveredDevice{DeviceID: deviceID}
+		for _, raw := range published {
+			var link discoveryLink
+			err := json.Unmarshal(raw, &link)
+			if err != nil {
+				return "", err
+			}
+			if !matchesAny(params["href"], link.Href) || !matchesAny(params["anchor"], link.Anchor) ||
+				!intersects(params["rt"], link.ResourceType) || !intersects(params["if"], link.Interface) {
+				continue
+			}
+			device.Links = append(device.Links, raw)
+		}
+		if len(device.Links) > 0 {
+			devices = append(devices, device)
+		}
+	}
+	out, err := json.Marshal(devices)
+	return string(out), err
+}
+
+//matchesAny reports whether s is one of the filter values. an absent filter matches everything
+func matchesAny(filter []string, s string) bool {
+	return len(filter) == 0 || contains(filter, s)
+}
+
+//intersects reports whether values contains at least one of the filter values. an absent filter matches everything
+func intersects(filter, values []string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if contains(filter, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+)
+
+func TestFilterLinks(t *testing.T) {
+	links := map[string][]json.RawMessage{
+		"device-a": {
+			json.RawMessage(`{"href":"/light","anchor":"ocf://device-a","rt":["oic.r.switch.binary"],"if":["oic.if.a","oic.if.baseline"]}`),
+			json.RawMessage(`{"href":"/temp","rt":["oic.r.temperature"],"if":["oic.if.s"]}`),
+		},
+		"device-b": {json.RawMessage(`{"href":"/light","rt":["oic.r.switch.binary"],"if":["oic.if.a"]}`)},
+		"device-c": nil,
+	}
+	for _, tc := range []struct {
+		params url.Values
+		want   map[string]int //number of links per device
+	}{
+		{url.Values{}, map[string]int{"device-a": 2, "device-b": 1}},
+		{url.Values{"di": {"device-b"}}, map[string]int{"device-b": 1}},
+		{url.Values{"rt": {"oic.r.temperature", "oic.r.unknown"}}, map[string]int{"device-a": 1}},
+		{url.Values{"if": {"oic.if.a"}}, map[string]int{"device-a": 1, "device-b": 1}},
+		{url.Values{"href": {"/light"}, "anchor": {"ocf://device-a"}}, map[string]int{"device-a": 1}},
+		{url.Values{"rt": {"oic.r.switch.binary"}, "if": {"oic.if.s"}}, map[string]int{}},
+	} {
+		out, err := filterLinks(links, tc.params)
+		if err != nil {
+			t.Fatalf("cannot filter %v: %v", tc.params, err)
+		}
+		var devices []discoveredDevice
+		if err := json.Unmarshal([]byte(out), &devices); err != nil {
+			t.Fatalf("invalid json %v: %v", out, err)
+		}
+		if len(devices) != len(tc.want) {
+			t.Fatalf("%v: expected %v devices, got %v", tc.params, len(tc.want), out)
+		}
+		for _, d := range devices {
+			if len(d.Links) != tc.want[d.DeviceID] {
+				t.Fatalf("%v: expected %v links for %v, got %v", tc.params, tc.want[d.DeviceID], d.DeviceID, out)
+			}
+		}
+	}
+}
@@ -0,0 +1,553 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sking2600/coap-gateway/pkg/routing"
+)
+
+var errorDuplicateUser = errors.New("username already registered")
+
+type memUser struct {
+	id           int64
+	username     string
+	authProvider string
+	token        string
+	joinDate     time.Time
+}
+
+type memMediator struct {
+	id     int64
+	userID int64
+	token  string
+}
+
+type memToken struct {
+	accessToken  string
+	refreshToken string
+	expiresIn    time.Time //zero value means the token has not been registered yet (same as a NULL expires_in column)
+}
+
+type memDevice struct {
+	id         int64
+	userID     int64
+	mediatorID int64
+	tokenID    int64
+	uuid       string
+	links      []publishedLink
+	lastIns    int64 //instance ids are never reused, just like AUTO_INCREMENT
+	loggedIn   bool
+}
+
+type memClient struct {
+	id         int64
+	userID     int64
+	mediatorID int64
+	tokenID    int64
+	uuid       string
+}
+
+/*MemoryRegistry implements the registry interface entirely in memory. It is intended for tests and single-node runs where
+standing up MySQL and Redis isn't worth the trouble. Nothing survives a restart.
+The tables mirror the ones built by InitDB so that both implementations behave the same way.
+*/
+type MemoryRegistry struct {
+	mutex     sync.RWMutex
+	lastID    int64
+	users     map[int64]*memUser
+	mediators map[int64]*memMediator
+	tokens    map[int64]*memToken
+	devices   map[int64]*memDevice
+	clients   map[int64]*memClient
+	Routes    routing.RouteTable
+}
+
+//NewMemoryRegistry returns an empty in-memory registry that also keeps its routes in memory
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{
+		Routes:    routing.NewMemoryRouteTable(),
+		users:     make(map[int64]*memUser),
+		mediators: make(map[int64]*memMediator),
+		tokens:    make(map[int64]*memToken),
+		devices:   make(map[int64]*memDevice),
+		clients:   make(map[int64]*memClient),
+	}
+}
+
+//nextID mimics AUTO_INCREMENT. the caller must hold the write lock
+func (db *MemoryRegistry) nextID() int64 {
+	db.lastID++
+	return db.lastID
+}
+
+func (db *MemoryRegistry) userByName(username string) *memUser {
+	for _, u := range db.users {
+		if u.username == username {
+			return u
+		}
+	}
+	return nil
+}
+
+func (db *MemoryRegistry) mediatorByToken(token string) *memMediator {
+	for _, m := range db.mediators {
+		if m.token == token {
+			return m
+		}
+	}
+	return nil
+}
+
+func (db *MemoryRegistry) deviceByUUID(deviceUUID string) *memDevice {
+	for _, d := range db.devices {
+		if d.uuid == deviceUUID {
+			return d
+		}
+	}
+	return nil
+}
+
+func (db *MemoryRegistry) clientByUUID(clientUUID string) *memClient {
+	for _, c := range db.clients {
+		if c.uuid == clientUUID {
+			return c
+		}
+	}
+	return nil
+}
+
+//RegisterUser returns the user token. usernames are unique, just like the UNIQUE KEY on the user table
+func (db *MemoryRegistry) RegisterUser(ctx context.Context, username, authProvider string) (string, error) {
+	token, err := GenerateRandomString(tokenEntropy)
+	if err != nil {
+		return "", err
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.userByName(username) != nil {
+		return "", errorDuplicateUser
+	}
+	id := db.nextID()
+	db.users[id] = &memUser{id: id, username: username, authProvider: authProvider, token: token, joinDate: time.Now()}
+	return token, nil
+}
+
+//ProvisionMediator returns a mediator token if the username and user token match
+func (db *MemoryRegistry) ProvisionMediator(ctx context.Context, username, userToken string) (string, error) {
+	mediatorToken, err := GenerateRandomString(tokenEntropy)
+	if err != nil {
+		return "", err
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	u := db.userByName(username)
+	if u == nil || u.token != userToken {
+		return "", ErrInvalidToken
+	}
+	id := db.nextID()
+	db.mediators[id] = &memMediator{id: id, userID: u.id, token: mediatorToken}
+	return mediatorToken, nil
+}
+
+//provision creates the token shared by ProvisionDevice and ProvisionClient. the caller must hold the write lock
+func (db *MemoryRegistry) provision(mediatorToken string) (m *memMediator, tokenID int64, token string, err error) {
+	m = db.mediatorByToken(mediatorToken)
+	if m == nil {
+		return nil, 0, "", ErrMediatorTokenNotFound
+	}
+	token, err = GenerateRandomString(tokenEntropy)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	tokenID = db.nextID()
+	db.tokens[tokenID] = &memToken{accessToken: token}
+	return m, tokenID, token, nil
+}
+
+//ProvisionDevice returns the one-time device access token to be summarily refreshed by the device.
+//returns ErrDuplicateDevice if the deviceUUID has already been provisioned
+func (db *MemoryRegistry) ProvisionDevice(ctx context.Context, deviceUUID, mediatorToken string) (string, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.deviceByUUID(deviceUUID) != nil {
+		return "", ErrDuplicateDevice
+	}
+	m, tokenID, token, err := db.provision(mediatorToken)
+	if err != nil {
+		return "", err
+	}
+	id := db.nextID()
+	db.devices[id] = &memDevice{id: id, userID: m.userID, mediatorID: m.id, tokenID: tokenID, uuid: deviceUUID}
+	return token, nil
+}
+
+//issueTokens replaces the access and refresh token for tokenID. the caller must hold the write lock
+func (db *MemoryRegistry) issueTokens(tokenID int64) (accessToken, refreshToken string, err error) {
+	accessToken, err = GenerateRandomString(tokenEntropy)
+	if err != nil {
+		return "", "", err
+	}
+	refreshToken, err = GenerateRandomString(tokenEntropy)
+	if err != nil {
+		return "", "", err
+	}
+	t := db.tokens[tokenID]
+	t.accessToken = accessToken
+	t.refreshToken = refreshToken
+	t.expiresIn = time.Now().Add(time.Second * time.Duration(accessTokenTTL))
+	return accessToken, refreshToken, nil
+}
+
+//RegisterDevice handles the UPDATE oic/sec/account request.
+//the mediated token is one-time use, so registering twice returns ErrInvalidToken
+func (db *MemoryRegistry) RegisterDevice(ctx context.Context, deviceUUID, mediatedToken string) (accessToken, userID, refreshToken string, expiresIn int, err error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	d := db.deviceByUUID(deviceUUID)
+	if d == nil {
+		return "", "", "", 0, ErrInvalidToken
+	}
+	u, ok := db.users[d.userID]
+	t := db.tokens[d.tokenID]
+	if !ok || t.refreshToken != "" || t.accessToken != mediatedToken {
+		return "", "", "", 0, ErrInvalidToken
+	}
+	accessToken, refreshToken, err = db.issueTokens(d.tokenID)
+	if err != nil {
+		return "", "", "", 0, err
+	}
+	return accessToken, u.username, refreshToken, accessTokenTTL, nil
+}
+
+//DeleteDevice handles the DELETE oic/sec/account request
+func (db *MemoryRegistry) DeleteDevice(ctx context.Context, deviceUUID, userID, accessToken string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	d := db.deviceByUUID(deviceUUID)
+	if d == nil {
+		return ErrDeviceNotFound
+	}
+	u, ok := db.users[d.userID]
+	if !ok || (userID != "" && userID != u.username) {
+		return ErrInvalidToken
+	}
+	if db.tokens[d.tokenID].accessToken != accessToken && !db.clientOfUser(d.userID, accessToken) {
+		return ErrInvalidToken
+	}
+	delete(db.tokens, d.tokenID)
+	delete(db.devices, d.id)
+	return db.Routes.DeleteRoute(deviceUUID)
+}
+
+//clientOfUser reports whether accessToken belongs to one of the user's clients. the caller must hold the lock
+func (db *MemoryRegistry) clientOfUser(userID int64, accessToken string) bool {
+	for _, c := range db.clients {
+		if c.userID == userID && db.tokens[c.tokenID].accessToken == accessToken {
+			return true
+		}
+	}
+	return false
+}
+
+//ProvisionClient returns one-time client access token to be summarily refreshed by the client
+//returns ErrDuplicateClient if the clientUUID has already been provisioned
+func (db *MemoryRegistry) ProvisionClient(ctx context.Context, clientUUID, mediatorToken string) (string, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.clientByUUID(clientUUID) != nil {
+		return "", ErrDuplicateClient
+	}
+	m, tokenID, token, err := db.provision(mediatorToken)
+	if err != nil {
+		return "", err
+	}
+	id := db.nextID()
+	db.clients[id] = &memClient{id: id, userID: m.userID, mediatorID: m.id, tokenID: tokenID, uuid: clientUUID}
+	return token, nil
+}
+
+//RegisterClient handles the UPDATE oic/sec/account request for clients
+func (db *MemoryRegistry) RegisterClient(ctx context.Context, userID, clientUUID, mediatedToken, authProvider string) (accessToken, refreshToken, redirectURI string, expiresIn int, err error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	c := db.clientByUUID(clientUUID)
+	if c == nil {
+		return "", "", "", 0, ErrInvalidToken
+	}
+	t := db.tokens[c.tokenID]
+	if t.refreshToken != "" || t.accessToken != mediatedToken {
+		return "", "", "", 0, ErrInvalidToken
+	}
+	accessToken, refreshToken, err = db.issueTokens(c.tokenID)
+	if err != nil {
+		return "", "", "", 0, err
+	}
+	return accessToken, refreshToken, "", accessTokenTTL, nil
+}
+
+//DeleteClient handles the DELETE oic/sec/account request
+func (db *MemoryRegistry) DeleteClient(ctx context.Context, clientID, accessToken string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	c := db.clientByUUID(clientID)
+	if c == nil || db.tokens[c.tokenID].accessToken != accessToken {
+		return ErrInvalidToken
+	}
+	delete(db.tokens, c.tokenID)
+	delete(db.clients, c.id)
+	return nil
+}
+
+//UpdateSession returns the access token TTL in seconds and claims the route of the device for the session
+func (db *MemoryRegistry) UpdateSession(ctx context.Context, deviceID, userID, accessToken string, owner routing.Route, loggedIn bool) (int, routing.Route, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	d := db.deviceByUUID(deviceID)
+	if !loggedIn {
+		err := db.Routes.UpdateRoute(deviceID, owner, routing.UnspecifiedAddress, 0)
+		if err == routing.ErrRouteNotOwned {
+			//the device is signed in over a newer session
+			return 0, routing.Route{}, nil
+		}
+		if d != nil {
+			d.loggedIn = false
+		}
+		return 0, routing.Route{}, err
+	}
+	if d == nil {
+		return 0, routing.Route{}, ErrInvalidToken
+	}
+	u, ok := db.users[d.userID]
+	t := db.tokens[d.tokenID]
+	if !ok || u.username != userID || t.accessToken != accessToken || t.expiresIn.IsZero() {
+		return 0, routing.Route{}, ErrInvalidToken
+	}
+	ttl := int(time.Until(t.expiresIn) / time.Second)
+	if ttl <= 0 {
+		return 0, routing.Route{}, ErrTokenExpired
+	}
+	route, err := db.Routes.SetRoute(deviceID, owner.PodAddr, routeTTL)
+	if err != nil {
+		return 0, routing.Route{}, err
+	}
+	d.loggedIn = true
+	return ttl, route, nil
+}
+
+//RefreshToken issues a new access token for the refresh token. the refresh token itself is recycled
+//deviceID is either a device or a client UUID
+func (db *MemoryRegistry) RefreshToken(ctx context.Context, deviceID, userID, refreshToken string) (accessToken string, returnedRefreshToken string, ttl int, err error) {
+	accessToken, err = GenerateRandomString(tokenEntropy)
+	if err != nil {
+		return "", "", 0, err
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	var ownerID, tokenID int64
+	if d := db.deviceByUUID(deviceID); d != nil {
+		ownerID, tokenID = d.userID, d.tokenID
+	} else if c := db.clientByUUID(deviceID); c != nil {
+		ownerID, tokenID = c.userID, c.tokenID
+	} else {
+		return "", "", 0, ErrInvalidToken
+	}
+	u, ok := db.users[ownerID]
+	t := db.tokens[tokenID]
+	if !ok || u.username != userID || t.refreshToken == "" || t.refreshToken != refreshToken {
+		return "", "", 0, ErrInvalidToken
+	}
+	t.accessToken = accessToken
+	t.expiresIn = time.Now().Add(time.Second * time.Duration(accessTokenTTL))
+	return accessToken, refreshToken, accessTokenTTL, nil
+}
+
+//LookupRoute returns the route of the pod that's connected to the device with that UUID.
+//returns routing.ErrRouteNotFound if the device has never signed in (or the route expired)
+func (db *MemoryRegistry) LookupRoute(ctx context.Context, deviceUUID string) (routing.Route, error) {
+	return db.Routes.LookupRoute(deviceUUID)
+}
+
+//ReleaseRoute deletes the route of the device if it's still owner
+func (db *MemoryRegistry) ReleaseRoute(ctx context.Context, deviceID string, owner routing.Route) error {
+	err := db.Routes.DeleteOwnedRoute(deviceID, owner)
+	if err == routing.ErrRouteNotOwned {
+		return nil
+	}
+	return err
+}
+
+//RefreshRoute resets the ttl of the device's route if it's still owner
+func (db *MemoryRegistry) RefreshRoute(ctx context.Context, deviceID string, owner routing.Route) error {
+	return db.Routes.RefreshRoute(deviceID, owner, routeTTL)
+}
+
+//Heartbeat tells the reaper that podAddr is alive
+func (db *MemoryRegistry) Heartbeat(ctx context.Context, podAddr string) error {
+	return db.Routes.Heartbeat(podAddr, HeartbeatTTL)
+}
+
+//ReapStaleRoutes deletes the routes of pods that stopped sending heartbeats and marks their devices as logged out
+func (db *MemoryRegistry) ReapStaleRoutes(ctx context.Context) ([]string, error) {
+	reaped, err := db.Routes.ReapRoutes()
+	if err != nil {
+		return nil, err
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	for _, deviceID := range reaped {
+		if d := db.deviceByUUID(deviceID); d != nil {
+			d.loggedIn = false
+		}
+	}
+	return reaped, nil
+}
+
+//PublishResource adds the links to the device's publication, replacing the links that have the same href
+func (db *MemoryRegistry) PublishResource(ctx context.Context, json, deviceID string) (string, error) {
+	links, err := parsePublication(json)
+	if err != nil {
+		return "", err
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	d := db.deviceByUUID(deviceID)
+	if d == nil {
+		return "", ErrDeviceNotFound
+	}
+	for i := range links {
+		existing := -1
+		for j, l := range d.links {
+			if l.href == links[i].href {
+				existing = j
+			}
+		}
+		if existing == -1 {
+			d.lastIns++
+			err := links[i].setInstanceID(d.lastIns)
+			if err != nil {
+				return "", err
+			}
+			d.links = append(d.links, links[i])
+			continue
+		}
+		err := links[i].setInstanceID(d.links[existing].ins)
+		if err != nil {
+			return "", err
+		}
+		d.links[existing] = links[i]
+	}
+	return marshalPublication(deviceID, links)
+}
+
+//RetrievePublishedResources returns every link the device has published
+func (db *MemoryRegistry) RetrievePublishedResources(ctx context.Context, deviceID string) (string, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	d := db.deviceByUUID(deviceID)
+	if d == nil {
+		return "", ErrDeviceNotFound
+	}
+	return marshalPublication(deviceID, d.links)
+}
+
+//UnpublishResources removes the links with those instance ids, or every link if instanceIDs is empty
+func (db *MemoryRegistry) UnpublishResources(ctx context.Context, deviceID string, instanceIDs []int64) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	d := db.deviceByUUID(deviceID)
+	if d == nil {
+		return ErrDeviceNotFound
+	}
+	var kept []publishedLink
+	if len(instanceIDs) > 0 {
+		for _, l := range d.links {
+			if !containsInstanceID(instanceIDs, l.ins) {
+				kept = append(kept, l)
+			}
+		}
+	}
+	d.links = kept
+	return nil
+}
+
+func containsInstanceID(instanceIDs []int64, ins int64) bool {
+	for _, id := range instanceIDs {
+		if id == ins {
+			return true
+		}
+	}
+	return false
+}
+
+//FindDevice returns a json array with the links published by every device owned by userID
+func (db *MemoryRegistry) FindDevice(ctx context.Context, userID string, params url.Values) (string, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	links := make(map[string][]json.RawMessage)
+	u := db.userByName(userID)
+	if u != nil {
+		for _, d := range db.devices {
+			if d.userID != u.id {
+				continue
+			}
+			for _, l := range d.links {
+				links[d.uuid] = append(links[d.uuid], l.raw)
+			}
+		}
+	}
+	return filterLinks(links, params)
+}
+
+//LookupUser returns the username that owns the client or device with that access token
+func (db *MemoryRegistry) LookupUser(ctx context.Context, accessToken string) (string, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	ownerID := int64(-1)
+	var t *memToken
+	for _, c := range db.clients {
+		if db.tokens[c.tokenID].accessToken == accessToken {
+			ownerID, t = c.userID, db.tokens[c.tokenID]
+		}
+	}
+	for _, d := range db.devices {
+		if db.tokens[d.tokenID].accessToken == accessToken {
+			ownerID, t = d.userID, db.tokens[d.tokenID]
+		}
+	}
+	u, ok := db.users[ownerID]
+	if !ok || t.expiresIn.IsZero() {
+		return "", ErrInvalidToken
+	}
+	if time.Now().After(t.expiresIn) {
+		return "", ErrTokenExpired
+	}
+	return u.username, nil
+}
+
+//LookupMediator returns the id of the mediator with that token and the username that provisioned it
+func (db *MemoryRegistry) LookupMediator(ctx context.Context, mediatorToken string) (string, string, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	m := db.mediatorByToken(mediatorToken)
+	if m == nil {
+		return "", "", ErrMediatorTokenNotFound
+	}
+	return strconv.FormatInt(m.id, 10), db.users[m.userID].username, nil
+}
+
+//DeviceOwner returns the username that owns the device and the id of the mediator that provisioned it
+func (db *MemoryRegistry) DeviceOwner(ctx context.Context, deviceUUID string) (string, string, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	d := db.deviceByUUID(deviceUUID)
+	if d == nil {
+		return "", "", ErrDeviceNotFound
+	}
+	return db.users[d.userID].username, strconv.FormatInt(d.mediatorID, 10), nil
+}
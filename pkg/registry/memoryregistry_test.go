@@ -0,0 +1,356 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/sking2600/coap-gateway/pkg/routing"
+)
+
+func testProvisionedDevice(t *testing.T, db *MemoryRegistry, username, deviceUUID string) (userToken, mediatedToken string) {
+	userToken, err := db.RegisterUser(context.Background(), username, "stub")
+	if err != nil {
+		t.Fatalf("cannot register user: %v", err)
+	}
+	mediatorToken, err := db.ProvisionMediator(context.Background(), username, userToken)
+	if err != nil {
+		t.Fatalf("cannot provision mediator: %v", err)
+	}
+	mediatedToken, err = db.ProvisionDevice(context.Background(), deviceUUID, mediatorToken)
+	if err != nil {
+		t.Fatalf("cannot provision device: %v", err)
+	}
+	return userToken, mediatedToken
+}
+
+func TestMemoryRegistryDeviceLifecycle(t *testing.T) {
+	db := NewMemoryRegistry()
+	_, mediatedToken := testProvisionedDevice(t, db, "satoshi@btc.com", "device-test-uuid")
+
+	accessToken, userID, refreshToken, expiresIn, err := db.RegisterDevice(context.Background(), "device-test-uuid", mediatedToken)
+	if err != nil {
+		t.Fatalf("cannot register device: %v", err)
+	}
+	if accessToken == "" || refreshToken == "" || userID != "satoshi@btc.com" || expiresIn != accessTokenTTL {
+		t.Fatalf("unexpected registration result: %v %v %v %v", accessToken, userID, refreshToken, expiresIn)
+	}
+	//the mediated token is one-time use
+	if _, _, _, _, err := db.RegisterDevice(context.Background(), "device-test-uuid", mediatedToken); err != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken when the mediated token is reused, got %v", err)
+	}
+	pod := routing.Route{PodAddr: "10.0.0.1"}
+	if _, _, err := db.UpdateSession(context.Background(), "device-test-uuid", userID, "wrong token", pod, true); err != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken for a wrong access token, got %v", err)
+	}
+
+	ttl, session, err := db.UpdateSession(context.Background(), "device-test-uuid", userID, accessToken, pod, true)
+	if err != nil {
+		t.Fatalf("cannot update session: %v", err)
+	}
+	if ttl <= 0 || ttl > accessTokenTTL {
+		t.Fatalf("invalid ttl: %v", ttl)
+	}
+	route, err := db.LookupRoute(context.Background(), "device-test-uuid")
+	if err != nil || route != session || route.PodAddr != "10.0.0.1" {
+		t.Fatalf("unexpected route: %v %v", route, err)
+	}
+	//the device reconnects (to the same pod) before the first session ends
+	_, newSession, err := db.UpdateSession(context.Background(), "device-test-uuid", userID, accessToken, pod, true)
+	if err != nil {
+		t.Fatalf("cannot update session: %v", err)
+	}
+	if _, _, err := db.UpdateSession(context.Background(), "device-test-uuid", userID, accessToken, session, false); err != nil {
+		t.Fatalf("cannot log out: %v", err)
+	}
+	if err := db.ReleaseRoute(context.Background(), "device-test-uuid", session); err != nil {
+		t.Fatalf("cannot release route: %v", err)
+	}
+	if route, err := db.LookupRoute(context.Background(), "device-test-uuid"); err != nil || route != newSession {
+		t.Fatalf("the old session clobbered the route: %v %v", route, err)
+	}
+	if _, _, err := db.UpdateSession(context.Background(), "device-test-uuid", userID, accessToken, newSession, false); err != nil {
+		t.Fatalf("cannot log out: %v", err)
+	}
+	route, err = db.LookupRoute(context.Background(), "device-test-uuid")
+	if err != nil || route.PodAddr != routing.UnspecifiedAddress {
+		t.Fatalf("unexpected route after logout: %v %v", route, err)
+	}
+	if err := db.ReleaseRoute(context.Background(), "device-test-uuid", route); err != nil {
+		t.Fatalf("cannot release route: %v", err)
+	}
+	if _, err := db.LookupRoute(context.Background(), "device-test-uuid"); err != routing.ErrRouteNotFound {
+		t.Fatalf("expected the released route to be deleted, got %v", err)
+	}
+	if _, err := db.LookupRoute(context.Background(), "unknown-uuid"); err != routing.ErrRouteNotFound {
+		t.Fatalf("expected ErrRouteNotFound for an unknown device, got %v", err)
+	}
+
+	if _, _, _, err := db.RefreshToken(context.Background(), "device-test-uuid", "hal@btc.com", refreshToken); err != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken for another user's refresh token, got %v", err)
+	}
+	if owner, err := db.LookupUser(context.Background(), accessToken); err != nil || owner != userID {
+		t.Fatalf("unexpected owner of the access token: %v %v", owner, err)
+	}
+	if _, err := db.LookupUser(context.Background(), mediatedToken); err != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken for a used mediated token, got %v", err)
+	}
+	newAccessToken, sameRefreshToken, _, err := db.RefreshToken(context.Background(), "device-test-uuid", userID, refreshToken)
+	if err != nil || newAccessToken == "" || newAccessToken == accessToken || sameRefreshToken != refreshToken {
+		t.Fatalf("unexpected token refresh: %v %v %v", newAccessToken, sameRefreshToken, err)
+	}
+
+	if err := db.DeleteDevice(context.Background(), "device-test-uuid", userID, accessToken); err != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken for a stale access token, got %v", err)
+	}
+	if err := db.DeleteDevice(context.Background(), "device-test-uuid", "hal@btc.com", newAccessToken); err != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken for another user, got %v", err)
+	}
+	if _, _, err := db.UpdateSession(context.Background(), "device-test-uuid", userID, newAccessToken, pod, true); err != nil {
+		t.Fatalf("cannot update session: %v", err)
+	}
+	if err := db.DeleteDevice(context.Background(), "device-test-uuid", userID, newAccessToken); err != nil {
+		t.Fatalf("cannot delete device: %v", err)
+	}
+	if _, err := db.LookupRoute(context.Background(), "device-test-uuid"); err != routing.ErrRouteNotFound {
+		t.Fatalf("route wasn't purged: %v", err)
+	}
+	if err := db.DeleteDevice(context.Background(), "device-test-uuid", userID, newAccessToken); err != ErrDeviceNotFound {
+		t.Fatalf("expected ErrDeviceNotFound, got %v", err)
+	}
+	if _, _, _, _, err := db.RegisterDevice(context.Background(), "device-test-uuid", mediatedToken); err == nil {
+		t.Fatalf("device still exists after deletion")
+	}
+}
+
+func TestMemoryRegistryDuplicateDevice(t *testing.T) {
+	db := NewMemoryRegistry()
+	userToken, _ := testProvisionedDevice(t, db, "satoshi@btc.com", "device-test-uuid")
+	mediatorToken, err := db.ProvisionMediator(context.Background(), "satoshi@btc.com", userToken)
+	if err != nil {
+		t.Fatalf("cannot provision mediator: %v", err)
+	}
+	if _, err := db.ProvisionDevice(context.Background(), "device-test-uuid", mediatorToken); err != ErrDuplicateDevice {
+		t.Fatalf("expected ErrDuplicateDevice, got %v", err)
+	}
+}
+
+func TestMemoryRegistryOwners(t *testing.T) {
+	db := NewMemoryRegistry()
+	userToken, _ := testProvisionedDevice(t, db, "satoshi@btc.com", "device-test-uuid")
+	mediatorToken, _ := db.ProvisionMediator(context.Background(), "satoshi@btc.com", userToken)
+	mediatorID, userID, err := db.LookupMediator(context.Background(), mediatorToken)
+	if err != nil || userID != "satoshi@btc.com" {
+		t.Fatalf("unexpected mediator: %v %v %v", mediatorID, userID, err)
+	}
+	if _, _, err := db.LookupMediator(context.Background(), "wrong token"); err != ErrMediatorTokenNotFound {
+		t.Fatalf("expected ErrMediatorTokenNotFound, got %v", err)
+	}
+	//the device was provisioned by the first mediator
+	userID, deviceMediatorID, err := db.DeviceOwner(context.Background(), "device-test-uuid")
+	if err != nil || userID != "satoshi@btc.com" || deviceMediatorID == mediatorID {
+		t.Fatalf("unexpected owner: %v %v %v", userID, deviceMediatorID, err)
+	}
+	if _, _, err := db.DeviceOwner(context.Background(), "missing"); err != ErrDeviceNotFound {
+		t.Fatalf("expected ErrDeviceNotFound, got %v", err)
+	}
+}
+
+func TestMemoryRegistryClientLifecycle(t *testing.T) {
+	db := NewMemoryRegistry()
+	userToken, err := db.RegisterUser(context.Background(), "satoshi@btc.com", "stub")
+	if err != nil {
+		t.Fatalf("cannot register user: %v", err)
+	}
+	if _, err := db.RegisterUser(context.Background(), "satoshi@btc.com", "stub"); err == nil {
+		t.Fatalf("duplicate username was accepted")
+	}
+	if _, err := db.ProvisionMediator(context.Background(), "satoshi@btc.com", "wrong token"); err != ErrInvalidToken {
+		t.Fatalf("mediator provisioned with an invalid user token")
+	}
+	mediatorToken, err := db.ProvisionMediator(context.Background(), "satoshi@btc.com", userToken)
+	if err != nil {
+		t.Fatalf("cannot provision mediator: %v", err)
+	}
+	if _, err := db.ProvisionClient(context.Background(), "client-test-uuid", "wrong token"); err != ErrMediatorTokenNotFound {
+		t.Fatalf("expected ErrMediatorTokenNotFound, got %v", err)
+	}
+	mediatedToken, err := db.ProvisionClient(context.Background(), "client-test-uuid", mediatorToken)
+	if err != nil {
+		t.Fatalf("cannot provision client: %v", err)
+	}
+	if _, err := db.ProvisionClient(context.Background(), "client-test-uuid", mediatorToken); err != ErrDuplicateClient {
+		t.Fatalf("expected ErrDuplicateClient, got %v", err)
+	}
+	accessToken, refreshToken, _, _, err := db.RegisterClient(context.Background(), "satoshi@btc.com", "client-test-uuid", mediatedToken, "stub")
+	if err != nil || accessToken == "" || refreshToken == "" {
+		t.Fatalf("cannot register client: %v", err)
+	}
+	if err := db.DeleteClient(context.Background(), "client-test-uuid", "wrong token"); err != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken, got %v", err)
+	}
+	if err := db.DeleteClient(context.Background(), "client-test-uuid", accessToken); err != nil {
+		t.Fatalf("cannot delete client: %v", err)
+	}
+}
+
+func TestMemoryRegistryClientDeletesDevice(t *testing.T) {
+	db := NewMemoryRegistry()
+	userToken, _ := testProvisionedDevice(t, db, "satoshi@btc.com", "device-test-uuid")
+	mediatorToken, err := db.ProvisionMediator(context.Background(), "satoshi@btc.com", userToken)
+	if err != nil {
+		t.Fatalf("cannot provision mediator: %v", err)
+	}
+	mediatedToken, err := db.ProvisionClient(context.Background(), "client-test-uuid", mediatorToken)
+	if err != nil {
+		t.Fatalf("cannot provision client: %v", err)
+	}
+	clientToken, _, _, _, err := db.RegisterClient(context.Background(), "satoshi@btc.com", "client-test-uuid", mediatedToken, "stub")
+	if err != nil {
+		t.Fatalf("cannot register client: %v", err)
+	}
+	if err := db.DeleteDevice(context.Background(), "device-test-uuid", "", clientToken); err != nil {
+		t.Fatalf("a client of the owner couldn't delete the device: %v", err)
+	}
+}
+
+func TestMemoryRegistryFindDevice(t *testing.T) {
+	db := NewMemoryRegistry()
+	testProvisionedDevice(t, db, "satoshi@btc.com", "device-a")
+	testProvisionedDevice(t, db, "hal@btc.com", "device-b")
+	if _, err := db.PublishResource(context.Background(), `{"di":"device-a","links":[{"href":"/light"}]}`, "device-a"); err != nil {
+		t.Fatalf("cannot publish resources: %v", err)
+	}
+	if _, err := db.PublishResource(context.Background(), `{"di":"device-b","links":[{"href":"/switch"}]}`, "device-b"); err != nil {
+		t.Fatalf("cannot publish resources: %v", err)
+	}
+
+	out, err := db.FindDevice(context.Background(), "satoshi@btc.com", url.Values{})
+	if err != nil {
+		t.Fatalf("cannot find devices: %v", err)
+	}
+	var publications []struct {
+		DeviceID string `json:"di"`
+	}
+	if err := json.Unmarshal([]byte(out), &publications); err != nil {
+		t.Fatalf("invalid json %v: %v", out, err)
+	}
+	if len(publications) != 1 || publications[0].DeviceID != "device-a" {
+		t.Fatalf("unexpected publications: %v", out)
+	}
+	out, err = db.FindDevice(context.Background(), "satoshi@btc.com", url.Values{"di": []string{"device-b"}})
+	if err != nil || out != "[]" {
+		t.Fatalf("devices of other users must not be returned: %v %v", out, err)
+	}
+}
+
+func TestMemoryRegistryResourceDirectory(t *testing.T) {
+	db := NewMemoryRegistry()
+	testProvisionedDevice(t, db, "satoshi@btc.com", "device-a")
+	type publication struct {
+		Links []struct {
+			Href       string `json:"href"`
+			InstanceID int64  `json:"ins"`
+			Title      string `json:"title"`
+		} `json:"links"`
+	}
+	retrieve := func() publication {
+		out, err := db.RetrievePublishedResources(context.Background(), "device-a")
+		if err != nil {
+			t.Fatalf("cannot retrieve publication: %v", err)
+		}
+		var rp publication
+		if err := json.Unmarshal([]byte(out), &rp); err != nil {
+			t.Fatalf("invalid json %v: %v", out, err)
+		}
+		return rp
+	}
+
+	if _, err := db.PublishResource(context.Background(), `{"di":"device-a","links":[{"href":"/light"},{"href":"/temp"}]}`, "device-a"); err != nil {
+		t.Fatalf("cannot publish resources: %v", err)
+	}
+	//republishing a href keeps its instance id, new hrefs get a new one
+	out, err := db.PublishResource(context.Background(), `{"di":"device-a","links":[{"href":"/light","title":"lamp"},{"href":"/switch"}]}`, "device-a")
+	if err != nil {
+		t.Fatalf("cannot update publication: %v", err)
+	}
+	var updated publication
+	if err := json.Unmarshal([]byte(out), &updated); err != nil || len(updated.Links) != 2 || updated.Links[0].InstanceID != 1 || updated.Links[1].InstanceID != 3 {
+		t.Fatalf("unexpected update result: %v %v", out, err)
+	}
+	rp := retrieve()
+	if len(rp.Links) != 3 || rp.Links[0].Title != "lamp" || rp.Links[1].Href != "/temp" {
+		t.Fatalf("unexpected publication: %+v", rp)
+	}
+
+	if err := db.UnpublishResources(context.Background(), "device-a", []int64{2, 42}); err != nil {
+		t.Fatalf("cannot delete link: %v", err)
+	}
+	if rp := retrieve(); len(rp.Links) != 2 || rp.Links[0].Href != "/light" || rp.Links[1].Href != "/switch" {
+		t.Fatalf("unexpected publication after deleting a link: %+v", rp)
+	}
+	if err := db.UnpublishResources(context.Background(), "device-a", nil); err != nil {
+		t.Fatalf("cannot delete links: %v", err)
+	}
+	if rp := retrieve(); len(rp.Links) != 0 {
+		t.Fatalf("links left after deleting every link: %+v", rp)
+	}
+
+	if _, err := db.PublishResource(context.Background(), `{"di":"device-a","links":[{"rt":["oic.r.light"]}]}`, "device-a"); err != ErrInvalidPublication {
+		t.Fatalf("expected ErrInvalidPublication for a link without href, got %v", err)
+	}
+	if _, err := db.PublishResource(context.Background(), `{"di":"unknown","links":[{"href":"/light"}]}`, "unknown"); err != ErrDeviceNotFound {
+		t.Fatalf("expected ErrDeviceNotFound, got %v", err)
+	}
+	if err := db.UnpublishResources(context.Background(), "unknown", nil); err != ErrDeviceNotFound {
+		t.Fatalf("expected ErrDeviceNotFound, got %v", err)
+	}
+}
+
+func TestMemoryRegistryReapStaleRoutes(t *testing.T) {
+	db := NewMemoryRegistry()
+	_, mediatedToken := testProvisionedDevice(t, db, "satoshi@btc.com", "device-test-uuid")
+	accessToken, userID, _, _, err := db.RegisterDevice(context.Background(), "device-test-uuid", mediatedToken)
+	if err != nil {
+		t.Fatalf("cannot register device: %v", err)
+	}
+	db.Heartbeat(context.Background(), "10.0.0.1")
+	if _, _, err := db.UpdateSession(context.Background(), "device-test-uuid", userID, accessToken, routing.Route{PodAddr: "10.0.0.1"}, true); err != nil {
+		t.Fatalf("cannot update session: %v", err)
+	}
+	if reaped, err := db.ReapStaleRoutes(context.Background()); err != nil || len(reaped) != 0 {
+		t.Fatalf("route of a live pod was reaped: %v %v", reaped, err)
+	}
+	if _, _, err := db.UpdateSession(context.Background(), "device-test-uuid", userID, accessToken, routing.Route{PodAddr: "10.0.0.2"}, true); err != nil {
+		t.Fatalf("cannot update session: %v", err)
+	}
+	reaped, err := db.ReapStaleRoutes(context.Background())
+	if err != nil || len(reaped) != 1 || reaped[0] != "device-test-uuid" {
+		t.Fatalf("expected the route of a pod without heartbeat to be reaped, got %v %v", reaped, err)
+	}
+	if db.deviceByUUID("device-test-uuid").loggedIn {
+		t.Fatalf("reaped device is still logged in")
+	}
+}
+
+func TestMemoryRegistryConcurrentAccess(t *testing.T) {
+	db := NewMemoryRegistry()
+	_, mediatedToken := testProvisionedDevice(t, db, "satoshi@btc.com", "device-test-uuid")
+	accessToken, userID, _, _, err := db.RegisterDevice(context.Background(), "device-test-uuid", mediatedToken)
+	if err != nil {
+		t.Fatalf("cannot register device: %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			db.UpdateSession(context.Background(), "device-test-uuid", userID, accessToken, routing.Route{PodAddr: "10.0.0.1"}, true)
+			db.LookupRoute(context.Background(), "device-test-uuid")
+			db.FindDevice(context.Background(), userID, url.Values{})
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,232 @@
+package registry
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+)
+
+/*Migration is a numbered schema change. Up and Down are lists of statements that are run one at a time, since the mysql driver
+doesn't allow multiple statements per Exec. postgres runs each migration inside a transaction, mysql can't (DDL commits implicitly),
+so mysql migrations should be written so that they can be re-run if they fail halfway through (ex: CREATE TABLE IF NOT EXISTS).
+Versions must be increasing and are never reused once released. a migration that would lose data if it were reverted has no Down
+and says why in Irreversible instead
+*/
+type Migration struct {
+	Version      int
+	Description  string
+	Up           []string
+	Down         []string
+	Irreversible string
+}
+
+var (
+	errorMigrationLockTimeout = errors.New("timed out waiting for the schema migration lock")
+	errorUnknownDriver        = errors.New("no migrations for that sql driver")
+	errorIrreversible         = errors.New("migration can't be reverted")
+)
+
+//schemaDialect holds the driver specific parts of running migrations
+type schemaDialect struct {
+	migrations       []Migration
+	versionTable     string
+	lock             string //must return 1 once the lock is held
+	unlock           string
+	insertVersion    string
+	deleteVersion    string
+	transactionalDDL bool
+}
+
+const (
+	//migrationLockName is the mysql GET_LOCK name used to serialize migrations between pods
+	migrationLockName = "coap_gateway_schema_migrations"
+	//migrationLockKey is the postgres advisory lock key used to serialize migrations between pods. the value is arbitrary
+	migrationLockKey = 8323725200
+	//migrationLockTimeout is how many seconds mysql waits for another pod to finish migrating
+	migrationLockTimeout = 300
+)
+
+var schemaDialects = map[string]schemaDialect{
+	"mysql": {
+		migrations: mysqlMigrations,
+		versionTable: `CREATE TABLE IF NOT EXISTS schema_migrations(
+		 version     bigint unsigned NOT NULL,
+		 description varchar(255) NOT NULL,
+		 applied_at  datetime NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (version)
+		);`,
+		lock:          fmt.Sprintf("SELECT GET_LOCK('%s', %d)", migrationLockName, migrationLockTimeout),
+		unlock:        fmt.Sprintf("SELECT RELEASE_LOCK('%s')", migrationLockName),
+		insertVersion: "INSERT INTO schema_migrations (version, description) VALUES(?,?)",
+		deleteVersion: "DELETE FROM schema_migrations WHERE version = ?",
+	},
+	"postgres": {
+		migrations: postgresMigrations,
+		versionTable: `CREATE TABLE IF NOT EXISTS schema_migrations(
+		 version     bigint NOT NULL,
+		 description varchar(255) NOT NULL,
+		 applied_at  timestamp with time zone NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (version)
+		);`,
+		lock:             fmt.Sprintf("SELECT 1 FROM pg_advisory_lock(%d)", migrationLockKey),
+		unlock:           fmt.Sprintf("SELECT pg_advisory_unlock(%d)", migrationLockKey),
+		insertVersion:    "INSERT INTO schema_migrations (version, description) VALUES($1,$2)",
+		deleteVersion:    "DELETE FROM schema_migrations WHERE version = $1",
+		transactionalDDL: true,
+	},
+}
+
+//statements joins the statements of the steps of a migration
+func statements(steps ...[]string) []string {
+	var stmts []string
+	for _, step := range steps {
+		stmts = append(stmts, step...)
+	}
+	return stmts
+}
+
+/*mysqlIf runs stmt only if condition (usually an EXISTS on information_schema) is true. mysql has no ADD COLUMN IF NOT EXISTS, so the
+statement is prepared from a session variable instead, which works because the migration runs on a single pinned connection
+*/
+func mysqlIf(condition, stmt string) []string {
+	return []string{
+		fmt.Sprintf("SET @migration_step = IF(%s, '%s', 'DO 0')", condition, stmt),
+		"PREPARE migration_step FROM @migration_step",
+		"EXECUTE migration_step",
+		"DEALLOCATE PREPARE migration_step",
+	}
+}
+
+func mysqlColumnExists(table, column string) string {
+	return fmt.Sprintf("EXISTS(SELECT 1 FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = '%s' AND column_name = '%s')", table, column)
+}
+
+//mysqlAddColumn adds the column unless it already exists
+func mysqlAddColumn(table, column, definition string) []string {
+	return mysqlIf("NOT "+mysqlColumnExists(table, column), fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+}
+
+//mysqlAddIndex adds the index (definition is the ADD clause without ADD, ex: "KEY name (column)") unless it already exists
+func mysqlAddIndex(table, index, definition string) []string {
+	exists := fmt.Sprintf("EXISTS(SELECT 1 FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = '%s' AND index_name = '%s')", table, index)
+	return mysqlIf("NOT "+exists, fmt.Sprintf("ALTER TABLE %s ADD %s", table, definition))
+}
+
+//MigrateUp applies every migration newer than the current schema version and returns the version the schema ends up at.
+//driver is the name the *sql.DB was opened with ("mysql" or "postgres")
+func MigrateUp(ctx context.Context, db *sql.DB, driver string) (int, error) {
+	return migrate(ctx, db, driver, func(ctx context.Context, conn *sql.Conn, d schemaDialect, version int) (int, error) {
+		for _, m := range d.migrations {
+			if m.Version <= version {
+				continue
+			}
+			log.Println("applying migration ", m.Version, ": ", m.Description)
+			err := applyMigration(ctx, conn, d, m.Up, d.insertVersion, m.Version, m.Description)
+			if err != nil {
+				return version, fmt.Errorf("migration %d (%s) failed: %v", m.Version, m.Description, err)
+			}
+			version = m.Version
+		}
+		return version, nil
+	})
+}
+
+//MigrateDown reverts migrations, newest first, until the schema is at the target version (0 drops everything)
+func MigrateDown(ctx context.Context, db *sql.DB, driver string, target int) (int, error) {
+	return migrate(ctx, db, driver, func(ctx context.Context, conn *sql.Conn, d schemaDialect, version int) (int, error) {
+		for i := len(d.migrations) - 1; i >= 0; i-- {
+			m := d.migrations[i]
+			if m.Version > version || m.Version <= target {
+				continue
+			}
+			if m.Irreversible != "" {
+				return version, fmt.Errorf("%v: migration %d (%s): %s", errorIrreversible, m.Version, m.Description, m.Irreversible)
+			}
+			log.Println("reverting migration ", m.Version, ": ", m.Description)
+			err := applyMigration(ctx, conn, d, m.Down, d.deleteVersion, m.Version)
+			if err != nil {
+				return version, fmt.Errorf("reverting migration %d (%s) failed: %v", m.Version, m.Description, err)
+			}
+			version = m.Version - 1
+		}
+		return schemaVersion(ctx, conn)
+	})
+}
+
+//SchemaVersion returns the version of the newest applied migration, or 0 if none have been applied
+func SchemaVersion(ctx context.Context, db *sql.DB, driver string) (int, error) {
+	return migrate(ctx, db, driver, func(ctx context.Context, conn *sql.Conn, d schemaDialect, version int) (int, error) {
+		return version, nil
+	})
+}
+
+//migrate pins a single connection (advisory locks belong to the session that took them), takes the migration lock and calls fn
+//with the current schema version
+func migrate(ctx context.Context, db *sql.DB, driver string, fn func(context.Context, *sql.Conn, schemaDialect, int) (int, error)) (int, error) {
+	d, ok := schemaDialects[driver]
+	if !ok {
+		return 0, errorUnknownDriver
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	var locked sql.NullInt64
+	err = conn.QueryRowContext(ctx, d.lock).Scan(&locked)
+	if err != nil {
+		return 0, err
+	}
+	if locked.Int64 != 1 {
+		return 0, errorMigrationLockTimeout
+	}
+	defer func() {
+		_, err := conn.ExecContext(context.Background(), d.unlock)
+		if err != nil {
+			log.Println("err releasing schema migration lock: ", err)
+		}
+	}()
+
+	_, err = conn.ExecContext(ctx, d.versionTable)
+	if err != nil {
+		return 0, err
+	}
+	version, err := schemaVersion(ctx, conn)
+	if err != nil {
+		return 0, err
+	}
+	return fn(ctx, conn, d, version)
+}
+
+func schemaVersion(ctx context.Context, conn *sql.Conn) (int, error) {
+	var version int
+	err := conn.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
+
+//applyMigration runs the statements and then records the change with bookkeeping (the insert or delete on schema_migrations)
+func applyMigration(ctx context.Context, conn *sql.Conn, d schemaDialect, stmts []string, bookkeeping string, args ...interface{}) error {
+	if d.transactionalDDL {
+		return withTx(ctx, conn, func(tx *sql.Tx) error {
+			for _, stmt := range stmts {
+				_, err := tx.ExecContext(ctx, stmt)
+				if err != nil {
+					return err
+				}
+			}
+			_, err := tx.ExecContext(ctx, bookkeeping, args...)
+			return err
+		})
+	}
+	for _, stmt := range stmts {
+		_, err := conn.ExecContext(ctx, stmt)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := conn.ExecContext(ctx, bookkeeping, args...)
+	return err
+}
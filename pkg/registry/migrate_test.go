@@ -0,0 +1,29 @@
+package registry
+
+import "testing"
+
+func TestMigrationVersionsIncrease(t *testing.T) {
+	for driver, d := range schemaDialects {
+		last := 0
+		for _, m := range d.migrations {
+			if m.Version <= last {
+				t.Fatalf("%v migration %v (%v) must have a version greater than %v", driver, m.Version, m.Description, last)
+			}
+			if len(m.Up) == 0 || (len(m.Down) == 0) == (m.Irreversible == "") {
+				t.Fatalf("%v migration %v (%v) must have up statements and either down statements or a reason it's irreversible", driver, m.Version, m.Description)
+			}
+			last = m.Version
+		}
+	}
+}
+
+func TestMysqlAddColumnIsGuarded(t *testing.T) {
+	stmts := mysqlAddColumn("user", "token_hash", "char(44)")
+	want := "SET @migration_step = IF(NOT EXISTS(SELECT 1 FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = 'user' AND column_name = 'token_hash'), 'ALTER TABLE user ADD COLUMN token_hash char(44)', 'DO 0')"
+	if stmts[0] != want {
+		t.Fatalf("unexpected statement: %v", stmts[0])
+	}
+	if stmts[len(stmts)-2] != "EXECUTE migration_step" {
+		t.Fatalf("the guarded statement isn't executed: %v", stmts)
+	}
+}
@@ -3,20 +3,19 @@ package registry
 //mysql -h db4free.net -P 3306 -u ocf_dev -p
 // use ocf_dev to connect to the specific db
 //this^^ is the command to connect mysql client to db4free
-//TODO: normalize permissions and published resources?
-//TODO: improve performance/transactionyness of DB queries
+//TODO: normalize permissions?
 
 import (
 	"context"
 	"crypto/rand"
 	"database/sql"
 	"encoding/base64"
-	"fmt"
+	"encoding/json"
 	"log"
 	"net/url"
-	"time"
+	"strings"
 
-	"github.com/go-redis/redis"
+	"github.com/sking2600/coap-gateway/pkg/routing"
 	//TODO I should probably not init my db in a file other than main
 	_ "github.com/go-sql-driver/mysql"
 )
@@ -48,48 +47,33 @@ func main() {
 	defer db.Close()
 }
 
-
-
-
 select device_uuid from device join token on token.token_id = device.token_id where token.access_token = 'BAsaYxJFmp8FJBFKTceUOYTL26o2na1mBZZN_5P60Ng=';
 
-
 */
 
 //it should be easy to switch out implementations with postgres or some other system
 
 /*MysqlRedisRegistry implements the registry interface, using mysql for storing long-lasting data (ex: register users/clients/devices and published resources) and
-redis for storing ephemeral data (ex: mapping of device-UUID's and the clusterIP of the container that's connected to it) and maybe caching some tokens
+a routing.RouteTable (usually redis) for storing ephemeral data (ex: mapping of device-UUID's and the clusterIP of the container that's connected to it)
 */
 type MysqlRedisRegistry struct {
 	*sql.DB
-	*redis.Client
+	Routes routing.RouteTable
+	//Hasher hashes every token before it's written to or looked up in the db
+	Hasher TokenHasher
 }
 
-//InitDB connects to the db and creates any tables that may not exist
-//TODO: it may not be best practice to have DB initialization in main code instead of init container
-//or maybe the new standard is golang wire library?
-func InitDB(ctx context.Context, db *sql.DB) (*sql.DB, error) {
-
-	err := createUserTable(ctx, db)
-	if err != nil {
-		log.Println("err from createUserTable ", err)
-	}
-	err = createMediatorTable(ctx, db)
+//InitDB brings the schema up to date by running MigrateUp and then HashLegacyTokens. it is kept for callers that don't care about schema versions
+func InitDB(ctx context.Context, db *sql.DB, h TokenHasher) (*sql.DB, error) {
+	_, err := MigrateUp(ctx, db, "mysql")
 	if err != nil {
-		log.Println("err from createMediatorTable ", err)
+		log.Println("err migrating mysql schema: ", err)
+		return db, err
 	}
-	err = createTokenTable(ctx, db)
+	_, err = HashLegacyTokens(ctx, db, "mysql", h)
 	if err != nil {
-		log.Println("err from createTokenTable ", err)
-	}
-	err = createClientTable(ctx, db)
-	if err != nil {
-		log.Println("err from createClientTable ", err)
-	}
-	err = createDeviceTable(ctx, db)
-	if err != nil {
-		log.Println("err from createDeviceTable ", err)
+		log.Println("err hashing legacy tokens: ", err)
+		return db, err
 	}
 	return db, nil
 }
@@ -98,10 +82,12 @@ func InitDB(ctx context.Context, db *sql.DB) (*sql.DB, error) {
 //RegisterUser uses email address for account and uses email provider for authProvider
 //for blockchain, account is wallet address or pubkey and authProvider is the ticker symbol (ex: "ETH" for ethereum and "BTC" for bitcoin)
 //returns the user_id primary key
-func (db MysqlRedisRegistry) RegisterUser(username, authProvider string) (string, error) {
+func (db MysqlRedisRegistry) RegisterUser(ctx context.Context, username, authProvider string) (string, error) {
 	token, err := GenerateRandomString(tokenEntropy)
-
-	_, err = db.Exec("INSERT INTO user (username, authz_provider, token ) VALUES(?,?,?)", username, authProvider, token)
+	if err != nil {
+		return "", err
+	}
+	_, err = db.ExecContext(ctx, "INSERT INTO user (username, authz_provider, token_hash ) VALUES(?,?,?)", username, authProvider, db.Hasher.Hash(token))
 	if err != nil {
 		log.Println("err from inside RegisterUser ", err)
 		return "", err
@@ -111,179 +97,268 @@ func (db MysqlRedisRegistry) RegisterUser(username, authProvider string) (string
 }
 
 //ProvisionMediator uses accessToken which is tied to the OAuth provider, returned string is a mediator token.
-//is there a user token?
-func (db MysqlRedisRegistry) ProvisionMediator(username, userToken string) (string, error) {
+//returns ErrInvalidToken if the username and user token don't match
+func (db MysqlRedisRegistry) ProvisionMediator(ctx context.Context, username, userToken string) (string, error) {
 	var userID sql.NullInt64
+	var tokenHash sql.NullString
 	mediatorToken, err := GenerateRandomString(tokenEntropy)
 	if err != nil {
 		return "", err
 	}
-	err = db.QueryRow("SELECT user_id FROM user WHERE username = ? AND token = ?", username, userToken).Scan(&userID)
+	err = db.QueryRowContext(ctx, "SELECT user_id, token_hash FROM user WHERE username = ?", username).Scan(&userID, &tokenHash)
+	if err == sql.ErrNoRows {
+		return "", ErrInvalidToken
+	}
 	if err != nil {
 		return "", err
 	}
+	if !db.Hasher.Equal(userToken, tokenHash.String) {
+		return "", ErrInvalidToken
+	}
 
-	_, err = db.Exec("INSERT INTO mediator (user_id,mediator_token) VALUES(?,?)", userID, mediatorToken)
+	_, err = db.ExecContext(ctx, "INSERT INTO mediator (user_id,mediator_token_hash) VALUES(?,?)", userID, db.Hasher.Hash(mediatorToken))
 	return mediatorToken, err
 }
 
 //ProvisionDevice returns the one-time device access token to be summarily refreshed by the device.
+//returns ErrMediatorTokenNotFound or ErrDuplicateDevice if the device can't be provisioned
 func (db MysqlRedisRegistry) ProvisionDevice(ctx context.Context, deviceUUID, mediatorToken string) (string, error) {
-	row := db.QueryRowContext(ctx, "SELECT mediator_id, user_id FROM mediator WHERE mediator_token = ?;", mediatorToken)
-
-	var mediatorID, userID sql.NullInt64
-
-	err := row.Scan(&mediatorID, &userID)
+	token, err := GenerateRandomString(tokenEntropy)
 	if err != nil {
-		fmt.Println("err from scan: ", err)
 		return "", err
 	}
-	fmt.Println("mediatorID: ", mediatorID, "\nuserID: ", userID)
-	if mediatorID.Valid {
-		token, err := GenerateRandomString(tokenEntropy)
+	err = withTx(ctx, db.DB, func(tx *sql.Tx) error {
+		var existing int64
+		err := tx.QueryRowContext(ctx, "SELECT device_id FROM device WHERE device_uuid = ? FOR UPDATE;", deviceUUID).Scan(&existing)
+		if err == nil {
+			return ErrDuplicateDevice
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+		mediatorID, userID, tokenID, err := mysqlProvisionToken(ctx, tx, db.Hasher, mediatorToken, token)
 		if err != nil {
-			return "", err
+			return err
 		}
-		//TODO these should probably be rolled into one transaction and be atomic. POTENTIAL BUG
-		result, err := db.ExecContext(ctx, "INSERT INTO token (access_token) VALUES(?);", token)
-		tokenID, err := result.LastInsertId()
-		result, err = db.ExecContext(ctx, "INSERT INTO device (user_id, mediator_id , token_id , device_uuid, logged_in) VALUES(?,?,?,?,?);", userID, mediatorID, tokenID, deviceUUID, false)
-		return token, err
+		_, err = tx.ExecContext(ctx, "INSERT INTO device (user_id, mediator_id , token_id , device_uuid, logged_in) VALUES(?,?,?,?,?);", userID, mediatorID, tokenID, deviceUUID, false)
+		return err
+	})
+	if err != nil {
+		return "", err
 	}
+	return token, nil
+}
 
-	return "", errorMediatorTokenNotfound
+//mysqlProvisionToken looks up the mediator and inserts the one-time token shared by ProvisionDevice and ProvisionClient
+//the mediator is looked up by hash since there is nothing else identifying it
+func mysqlProvisionToken(ctx context.Context, tx *sql.Tx, h TokenHasher, mediatorToken, token string) (mediatorID, userID, tokenID int64, err error) {
+	err = tx.QueryRowContext(ctx, "SELECT mediator_id, user_id FROM mediator WHERE mediator_token_hash = ?;", h.Hash(mediatorToken)).Scan(&mediatorID, &userID)
+	if err == sql.ErrNoRows {
+		return 0, 0, 0, ErrMediatorTokenNotFound
+	}
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	result, err := tx.ExecContext(ctx, "INSERT INTO token (access_token_hash) VALUES(?);", h.Hash(token))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	tokenID, err = result.LastInsertId()
+	return mediatorID, userID, tokenID, err
 }
 
 //RegisterDevice handles the UPDATE oic/sec/account request.
-//TODO: can I return "unauthorized" as an error?
-//mediatedToken is the token returned to mediator when it registers the device
-//TODO double check refresh token field to ensure the device hasn't already been registered
-func (db MysqlRedisRegistry) RegisterDevice(deviceUUID, mediatedToken string) (accessToken, userID, refreshToken string, expiresIn int, err error) {
-	var token, username sql.NullString
-	var tokenID sql.NullInt64
-	err = db.QueryRowContext(context.TODO(), "SELECT device.token_id, user.username, token.access_token FROM device INNER JOIN token ON device.token_id = token.token_id INNER JOIN user ON device.user_id = user.user_id WHERE device.device_uuid = ?;", deviceUUID).Scan(&tokenID, &username, &token)
-	log.Println("deviceUUID: ", deviceUUID, "\nmediatedToken: ", mediatedToken, "\ntokenID: ", tokenID, "\ntoken: ", token)
-
+//mediatedToken is the token returned to mediator when it registers the device. it is replaced by the access token, so it can only be used once
+//returns ErrInvalidToken if the device doesn't exist or the token doesn't match
+func (db MysqlRedisRegistry) RegisterDevice(ctx context.Context, deviceUUID, mediatedToken string) (accessToken, userID, refreshToken string, expiresIn int, err error) {
+	accessToken, err = GenerateRandomString(tokenEntropy)
 	if err != nil {
 		return "", "", "", 0, err
 	}
-	if token.String == mediatedToken && token.Valid && username.Valid {
-		fmt.Println("token.string is mediated token")
-		accessToken, err := GenerateRandomString(tokenEntropy)
-		if err != nil {
-			return "", "", "", 0, err
+	refreshToken, err = GenerateRandomString(tokenEntropy)
+	if err != nil {
+		return "", "", "", 0, err
+	}
+	err = withTx(ctx, db.DB, func(tx *sql.Tx) error {
+		var tokenID int64
+		var tokenHash sql.NullString
+		err := tx.QueryRowContext(ctx, "SELECT device.token_id, user.username, token.access_token_hash FROM device INNER JOIN token ON device.token_id = token.token_id INNER JOIN user ON device.user_id = user.user_id WHERE device.device_uuid = ? AND token.refresh_token_hash IS NULL FOR UPDATE;", deviceUUID).Scan(&tokenID, &userID, &tokenHash)
+		if err == sql.ErrNoRows {
+			return ErrInvalidToken
 		}
-		refreshToken, err := GenerateRandomString(tokenEntropy)
 		if err != nil {
-			return "", "", "", 0, err
+			return err
 		}
-		//ttl := time.Now().UTC().Add(time.Second * time.Duration(accessTokenTTL)).Format(time.RFC3339)
-		_, err = db.ExecContext(context.TODO(), "UPDATE token SET refresh_token = ?, access_token = ?, expires_in = DATE_ADD( CURRENT_TIMESTAMP(), INTERVAL ? SECOND) WHERE token_id = ?;", refreshToken, accessToken, accessTokenTTL, tokenID)
-		fmt.Println("in registerDevice\naccesstoken:", accessToken, "\nusername: ", username.String, "\nrefreshtoken: ", refreshToken, "\nttl: ", accessTokenTTL)
-		return accessToken, username.String, refreshToken, accessTokenTTL, err
-
-	} else {
-		fmt.Println("token.string isn't a mediated token and/or username doesn't exist")
-		return "", "", "", 0, err //TODO i should be returning a useful error like "token not found" although that'd probably be a 403 FORBIDDEN code
+		if !db.Hasher.Equal(mediatedToken, tokenHash.String) {
+			return ErrInvalidToken
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE token SET refresh_token_hash = ?, access_token_hash = ?, expires_in = DATE_ADD( CURRENT_TIMESTAMP(), INTERVAL ? SECOND) WHERE token_id = ?;", db.Hasher.Hash(refreshToken), db.Hasher.Hash(accessToken), accessTokenTTL, tokenID)
+		return err
+	})
+	if err != nil {
+		log.Println("err registering deviceUUID ", deviceUUID, ": ", err)
+		return "", "", "", 0, err
 	}
+	return accessToken, userID, refreshToken, accessTokenTTL, nil
 }
 
 //DeleteDevice handles the DELETE oic/sec/account request
-func (db MysqlRedisRegistry) DeleteDevice(deviceID, accessToken string) error {
-	result, err := db.ExecContext(context.TODO(), "DELETE device , token FROM device JOIN token USING(token_id) WHERE device.device_id = ? AND token.access_token = ?;", deviceID, accessToken)
-	rowsAffected, err := result.RowsAffected()
-	if rowsAffected == 0 {
-		return err //TODO: how to distinguish from incorrect token and non-existent ID?
+func (db MysqlRedisRegistry) DeleteDevice(ctx context.Context, deviceUUID, userID, accessToken string) error {
+	err := withTx(ctx, db.DB, func(tx *sql.Tx) error {
+		var deviceID, tokenID, ownerID int64
+		var username string
+		var tokenHash sql.NullString
+		err := tx.QueryRowContext(ctx, "SELECT device.device_id, device.token_id, user.user_id, user.username, token.access_token_hash FROM device INNER JOIN token ON device.token_id = token.token_id INNER JOIN user ON device.user_id = user.user_id WHERE device.device_uuid = ? FOR UPDATE;", deviceUUID).Scan(&deviceID, &tokenID, &ownerID, &username, &tokenHash)
+		if err == sql.ErrNoRows {
+			return ErrDeviceNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if userID != "" && userID != username {
+			return ErrInvalidToken
+		}
+		if !db.Hasher.Equal(accessToken, tokenHash.String) {
+			//a client of the same user is allowed to remove the device
+			var clientID int64
+			err := tx.QueryRowContext(ctx, "SELECT client.client_id FROM client INNER JOIN token ON client.token_id = token.token_id WHERE client.user_id = ? AND token.access_token_hash = ?;", ownerID, db.Hasher.Hash(accessToken)).Scan(&clientID)
+			if err == sql.ErrNoRows {
+				return ErrInvalidToken
+			}
+			if err != nil {
+				return err
+			}
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM device WHERE device_id = ?;", deviceID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM token WHERE token_id = ?;", tokenID)
+		return err
+	})
+	if err != nil {
+		return err
 	}
-	return err
+	return db.Routes.DeleteRoute(deviceUUID)
 }
 
-//LookupPrivateIP looks up the IP of the pod that's connected to the device with that UUID
-//would returning "",nil work to communicate that there were no errors, but that the device wasn't found?
-//TODO probably needs some rewriting or at the very least renaming
-func (db MysqlRedisRegistry) LookupPrivateIP(deviceUUID string) (string, error) {
-	ip, err := db.Get(deviceUUID).Result()
+//LookupRoute returns the route of the pod that's connected to the device with that UUID.
+//returns routing.ErrRouteNotFound if the device has never signed in (or the route expired)
+func (db MysqlRedisRegistry) LookupRoute(ctx context.Context, deviceUUID string) (routing.Route, error) {
+	return db.Routes.LookupRoute(deviceUUID)
+}
 
-	if err != nil {
-		if err == redis.Nil {
-			//TODO have better error handling. caller should be able to tell the difference between non-existent key and other errors
-			return "", err
-		}
-		return "", err
+//ReleaseRoute deletes the route of the device if it's still owner
+func (db MysqlRedisRegistry) ReleaseRoute(ctx context.Context, deviceID string, owner routing.Route) error {
+	err := db.Routes.DeleteOwnedRoute(deviceID, owner)
+	if err == routing.ErrRouteNotOwned {
+		return nil
 	}
+	return err
+}
+
+//RefreshRoute resets the ttl of the device's route if it's still owner
+func (db MysqlRedisRegistry) RefreshRoute(ctx context.Context, deviceID string, owner routing.Route) error {
+	return db.Routes.RefreshRoute(deviceID, owner, routeTTL)
+}
+
+//Heartbeat tells the reaper that podAddr is alive
+func (db MysqlRedisRegistry) Heartbeat(ctx context.Context, podAddr string) error {
+	return db.Routes.Heartbeat(podAddr, HeartbeatTTL)
+}
 
-	return ip, nil
+//ReapStaleRoutes deletes the routes of pods that stopped sending heartbeats and marks their devices as logged out
+func (db MysqlRedisRegistry) ReapStaleRoutes(ctx context.Context) ([]string, error) {
+	reaped, err := db.Routes.ReapRoutes()
+	if err != nil || len(reaped) == 0 {
+		return reaped, err
+	}
+	args := make([]interface{}, 0, len(reaped))
+	for _, deviceID := range reaped {
+		args = append(args, deviceID)
+	}
+	_, err = db.ExecContext(ctx, "UPDATE device SET logged_in = false WHERE device_uuid IN (?"+strings.Repeat(",?", len(reaped)-1)+")", args...)
+	return reaped, err
 }
 
 //ProvisionClient returns one-time client access token to be summarily refreshed by the client
-//TODO: handle non-existant mediator tokens (use 403 FOBIDDEN code?)
+//returns ErrMediatorTokenNotFound or ErrDuplicateClient if the client can't be provisioned
 func (db MysqlRedisRegistry) ProvisionClient(ctx context.Context, clientUUID, mediatorToken string) (string, error) {
-	row := db.QueryRowContext(ctx, "SELECT mediator_id, user_id FROM mediator WHERE mediator_token = ?;", mediatorToken)
-	var mediatorID, userID sql.NullInt64
-
-	err := row.Scan(&mediatorID, &userID)
+	token, err := GenerateRandomString(tokenEntropy)
 	if err != nil {
 		return "", err
 	}
-	fmt.Println("mediatorID: ", mediatorID, "\nuserID: ", userID)
-	if mediatorID.Valid {
-		token, err := GenerateRandomString(tokenEntropy)
+	err = withTx(ctx, db.DB, func(tx *sql.Tx) error {
+		var existing int64
+		err := tx.QueryRowContext(ctx, "SELECT client_id FROM client WHERE client_uuid = ? FOR UPDATE;", clientUUID).Scan(&existing)
+		if err == nil {
+			return ErrDuplicateClient
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+		mediatorID, userID, tokenID, err := mysqlProvisionToken(ctx, tx, db.Hasher, mediatorToken, token)
 		if err != nil {
-			return "", err
+			return err
 		}
-
-		//these should probably be rolled into one transaction and be atomic. POTENTIAL BUG
-		result, err := db.ExecContext(ctx, "INSERT INTO token (access_token) VALUES(?);", token)
-		tokenID, err := result.LastInsertId()
-		//log.Println("tokenID: ", tokenID, "\nuserID: ", userID, "\nmediatorID: ", mediatorID, "\nclientUUID: ", clientUUID)
-		result, err = db.ExecContext(ctx, "INSERT INTO client (user_id, mediator_id , token_id , client_uuid) VALUES(?,?,?,?);", userID, mediatorID, tokenID, clientUUID)
-		return token, err
+		_, err = tx.ExecContext(ctx, "INSERT INTO client (user_id, mediator_id , token_id , client_uuid) VALUES(?,?,?,?);", userID, mediatorID, tokenID, clientUUID)
+		return err
+	})
+	if err != nil {
+		return "", err
 	}
-	return "", errorMediatorTokenNotfound
-
+	return token, nil
 }
 
-//RegisterClient handles the UPDATE oic/sec/account request. TODO: can I return "unauthorized" as an error? what about "entry already exists"?
-//since the mediatedToken will be overwritten upon registration, it'd be 403 FORBIDDEN
-////mediatedToken is the token returned to mediator when it registers the client
+//RegisterClient handles the UPDATE oic/sec/account request.
+//mediatedToken is the token returned to mediator when it registers the client. it is replaced by the access token, so it can only be used once
+//returns ErrInvalidToken if the client doesn't exist or the token doesn't match
 func (db MysqlRedisRegistry) RegisterClient(ctx context.Context, userID, clientUUID, mediatedToken, authProvider string) (accessToken, refreshToken, redirectURI string, expiresIn int, err error) {
-	var tokenID, userIDNumber sql.NullInt64
-	//todo: do I need to include the mediatedToken in the query?
-	err = db.QueryRowContext(ctx, "SELECT client.token_id, client.user_id FROM client INNER JOIN token ON client.token_id = token.token_id WHERE client.client_uuid = ? AND token.access_token = ?;", clientUUID, mediatedToken).Scan(&tokenID, &userIDNumber)
-	log.Println("clientUUID: ", clientUUID, "\nmediatedToken: ", mediatedToken, "\ntokenID: ", tokenID)
-
+	accessToken, err = GenerateRandomString(tokenEntropy)
 	if err != nil {
-		log.Println("in registerClient. no rows were found that matched the token and clientUUID")
-		if err == sql.ErrNoRows {
-			//todo I should do something special for this. maybe return nil instead of err?
-			return "", "", "", 0, err
-		}
 		return "", "", "", 0, err
 	}
-	fmt.Println("token.string is mediated token")
-	accessToken, err = GenerateRandomString(tokenEntropy)
+	refreshToken, err = GenerateRandomString(tokenEntropy)
 	if err != nil {
 		return "", "", "", 0, err
 	}
-	refreshToken, err = GenerateRandomString(tokenEntropy)
+	err = withTx(ctx, db.DB, func(tx *sql.Tx) error {
+		var tokenID int64
+		var tokenHash sql.NullString
+		err := tx.QueryRowContext(ctx, "SELECT client.token_id, token.access_token_hash FROM client INNER JOIN token ON client.token_id = token.token_id WHERE client.client_uuid = ? AND token.refresh_token_hash IS NULL FOR UPDATE;", clientUUID).Scan(&tokenID, &tokenHash)
+		if err == sql.ErrNoRows {
+			return ErrInvalidToken
+		}
+		if err != nil {
+			return err
+		}
+		if !db.Hasher.Equal(mediatedToken, tokenHash.String) {
+			return ErrInvalidToken
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE token SET refresh_token_hash = ?, access_token_hash = ?, expires_in = DATE_ADD( CURRENT_TIMESTAMP(), INTERVAL ? SECOND) WHERE token_id = ?", db.Hasher.Hash(refreshToken), db.Hasher.Hash(accessToken), accessTokenTTL, tokenID)
+		return err
+	})
 	if err != nil {
+		log.Println("err registering clientUUID ", clientUUID, ": ", err)
 		return "", "", "", 0, err
 	}
-	//ttl := time.Now().UTC().Add(time.Second * time.Duration(accessTokenTTL)).Format(time.RFC3339)
-	_, err = db.ExecContext(ctx, "UPDATE token SET refresh_token = ?, access_token = ?, expires_in = DATE_ADD( CURRENT_TIMESTAMP(), INTERVAL ? SECOND) WHERE token_id = ?", refreshToken, accessToken, accessTokenTTL, tokenID)
-	return accessToken, refreshToken, "", accessTokenTTL, err //TODO should I be calculating the remaining accessTokenTTL?
-
+	return accessToken, refreshToken, "", accessTokenTTL, nil //TODO should I be calculating the remaining accessTokenTTL?
 }
 
-//DeleteClient handles the DELETE oic/sec/account request
+//DeleteClient handles the DELETE oic/sec/account request for clients
 func (db MysqlRedisRegistry) DeleteClient(ctx context.Context, clientID, accessToken string) error {
-
-	result, err := db.ExecContext(ctx, "DELETE client , token FROM client JOIN token USING(token_id) WHERE client.client_id = ? AND token.access_token = ?;", clientID, accessToken)
+	result, err := db.ExecContext(ctx, "DELETE client , token FROM client JOIN token USING(token_id) WHERE client.client_uuid = ? AND token.access_token_hash = ?;", clientID, db.Hasher.Hash(accessToken))
+	if err != nil {
+		return err
+	}
 	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
 	if rowsAffected == 0 {
-		return err //TODO: how to distinguish from incorrect token and non-existent ID?
+		return ErrInvalidToken
 	}
-	return err
+	return nil
 }
 
 //TODO implement this
@@ -293,190 +368,260 @@ func (db MysqlRedisRegistry) DeleteUser(ctx context.Context, userID string) erro
 }
 
 //UpdateSession returns the int which is the access token TTL in seconds. based on UPDATE /oic/sec/session
-//TODO verify the access token
+//signing in returns ErrInvalidToken if the access token doesn't belong to the device or ErrTokenExpired if it needs to be refreshed
 //TODO do I need a "logged in" field in my device table or can I leave that up to redis?
-func (db MysqlRedisRegistry) UpdateSession(deviceID, userID, accessToken, podAddr string, loggedIn bool) (int, error) {
-	//mysql> SELECT UNIX_TIMESTAMP(expires_in) -UNIX_TIMESTAMP(NOW()) TIME FROM token INNER JOIN device ON token.token_id = device.token_id WHERE device.device_uuid = ?;
+func (db MysqlRedisRegistry) UpdateSession(ctx context.Context, deviceID, userID, accessToken string, owner routing.Route, loggedIn bool) (int, routing.Route, error) {
 	if !loggedIn {
-
-		err := db.Set(deviceID, unspecifiedAddress, time.Hour*0).Err()
+		err := db.Routes.UpdateRoute(deviceID, owner, routing.UnspecifiedAddress, 0)
+		if err == routing.ErrRouteNotOwned {
+			//the device is signed in over a newer session
+			return 0, routing.Route{}, nil
+		}
 		if err != nil {
-			return 0, err
+			return 0, routing.Route{}, err
 		}
-		return 0, err
-
+		_, err = db.ExecContext(ctx, "UPDATE device SET logged_in = false WHERE device_uuid = ?", deviceID)
+		return 0, routing.Route{}, err
 	}
 
-	row := db.QueryRowContext(context.TODO(), "SELECT UNIX_TIMESTAMP(expires_in) -UNIX_TIMESTAMP(NOW()) TIME FROM token INNER JOIN device ON token.token_id = device.token_id WHERE device.device_uuid = ?;", deviceID)
+	row := db.QueryRowContext(ctx, "SELECT UNIX_TIMESTAMP(token.expires_in) - UNIX_TIMESTAMP(NOW()), token.access_token_hash FROM token INNER JOIN device ON token.token_id = device.token_id INNER JOIN user ON device.user_id = user.user_id WHERE device.device_uuid = ? AND user.username = ?;", deviceID, userID)
 	var expiresIn sql.NullInt64
-	log.Println("in registry.updatesession. deviceID: ", deviceID)
-	err := row.Scan(&expiresIn)
+	var tokenHash sql.NullString
+	err := row.Scan(&expiresIn, &tokenHash)
+	if err == sql.ErrNoRows {
+		return 0, routing.Route{}, ErrInvalidToken
+	}
 	if err != nil {
-		fmt.Println("err from scan: ", err)
-		return 0, err
+		return 0, routing.Route{}, err
+	}
+	if !db.Hasher.Equal(accessToken, tokenHash.String) {
+		return 0, routing.Route{}, ErrInvalidToken
 	}
 	if !expiresIn.Valid {
-		fmt.Println("no TTL value found") //TODO chances are if no TTL value was found, the device is provisioned but not registered
-		return 0, err
+		//the device is provisioned but not registered, so the access token is still the mediated token
+		return 0, routing.Route{}, ErrInvalidToken
+	}
+	if expiresIn.Int64 <= 0 {
+		return 0, routing.Route{}, ErrTokenExpired
 	}
 
-	fmt.Println("in updateSession. about to SET redis db with deviceID: ", deviceID)
-	err = db.Set(deviceID, podAddr, time.Hour).Err() //TODO handle response in case it's an error
+	_, err = db.ExecContext(ctx, "UPDATE device SET logged_in = true WHERE device_uuid = ?", deviceID)
 	if err != nil {
-		return 0, err
+		return 0, routing.Route{}, err
 	}
-	return int(expiresIn.Int64), err
-
+	route, err := db.Routes.SetRoute(deviceID, owner.PodAddr, routeTTL)
+	if err != nil {
+		return 0, routing.Route{}, err
+	}
+	return int(expiresIn.Int64), route, nil
 }
 
 //RefreshToken refreshes the access token and optionally refreshes the refresh token. returns refreshToken, accessToken, accessToken TTL in seconds, error
-//based on UDPATE oic/sec/tokenrefresh request
+//based on UDPATE oic/sec/tokenrefresh request. deviceID is either a device or a client UUID
+//returns ErrInvalidToken if the refresh token doesn't belong to that device/client and user
 //TODO make it configurable via env vars whether to issue a new refresh token or recycle the old one. making that assumption simplifies the query
-//TODO POTENTIAL BUG: can I assume that the refresh token is unique? collission is very low, but it may be a potential bug
-// TODO do I need to confirm that a given token is associated with a given user/device ID?
-//SELECT user.username, device_uuid,token.refresh_token FROM device INNER JOIN user ON device.user_id = user.user_id INNER JOIN token ON device.token_id = token.token_id;
-//^^ preliminary attempts at a query that checks the device/user ID's
-//TODO just break it out into 2 smaller queries
-func (db MysqlRedisRegistry) RefreshToken(deviceID, userID, refreshToken string) (accessToken string, returnedRefreshToken string, ttl int, err error) {
+func (db MysqlRedisRegistry) RefreshToken(ctx context.Context, deviceID, userID, refreshToken string) (accessToken string, returnedRefreshToken string, ttl int, err error) {
 	accessToken, err = GenerateRandomString(tokenEntropy)
 	if err != nil {
 		log.Println("error trying to generate a new refresh token")
 		return "", "", 0, err
 	}
-
-	result, err := db.ExecContext(context.TODO(), `UPDATE token SET access_token = ?, expires_in = DATE_ADD( CURRENT_TIMESTAMP(), INTERVAL ? SECOND) WHERE refresh_token = ?;`, //TODO: verify validity of deviceID and userID in relation to tokens
-		accessToken, accessTokenTTL, refreshToken)
-	numAffectedRows, err := result.RowsAffected()
+	err = withTx(ctx, db.DB, func(tx *sql.Tx) error {
+		var tokenID int64
+		var tokenHash sql.NullString
+		err := tx.QueryRowContext(ctx, `SELECT token.token_id, token.refresh_token_hash FROM token
+			LEFT JOIN device ON device.token_id = token.token_id
+			LEFT JOIN client ON client.token_id = token.token_id
+			INNER JOIN user ON user.user_id = COALESCE(device.user_id, client.user_id)
+			WHERE user.username = ? AND (device.device_uuid = ? OR client.client_uuid = ?) FOR UPDATE;`,
+			userID, deviceID, deviceID).Scan(&tokenID, &tokenHash)
+		if err == sql.ErrNoRows {
+			return ErrInvalidToken
+		}
+		if err != nil {
+			return err
+		}
+		if !tokenHash.Valid || !db.Hasher.Equal(refreshToken, tokenHash.String) {
+			return ErrInvalidToken
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE token SET access_token_hash = ?, expires_in = DATE_ADD( CURRENT_TIMESTAMP(), INTERVAL ? SECOND) WHERE token_id = ?;`, db.Hasher.Hash(accessToken), accessTokenTTL, tokenID)
+		return err
+	})
 	if err != nil {
 		log.Println("err in mysqlregistry.RefreshToken(): ", err)
 		return "", "", 0, err
 	}
-	if numAffectedRows == 0 {
-		return "", "", 0, nil
-	}
 	return accessToken, refreshToken, accessTokenTTL, nil
 }
 
-/*IF EXISTS (SELECT user.username, token.token_id, device.device_uuid,token.refresh_token
-FROM device INNER JOIN user ON device.user_id = user.user_id
-INNER JOIN token ON device.token_id = token.token_id WHERE device_uuid = ? AND user.username = ?)
-
-^^this is a portion of the refreshtoken() query that I removed pending debugging
-*/
-
 //SET  @token_id =(SELECT token.token_id FROM device INNER JOIN user ON device.user_id = user.user_id INNER JOIN token ON device.token_id = token.token_id WHERE device_uuid = "device-test-uuid" AND user.username = "MW1VqsF1oPLIKw==");
-//TODO: implement RETRIEVE/UPDATE oic/rd
 
 //TODO: implement RETRIEVE oic/res/{device_UUID} gotta make sure this is how you discover the resources. maybe it's {device_UUID}/oic/res
 
-//TODO confirm this is the correct function signature
-//TODO should i check the result from ExecContext or leave it blank?
-func (db MysqlRedisRegistry) PublishResource(json, deviceID string) error {
-	result, err := db.ExecContext(context.TODO(), `update device set published_resources =  ? where device.device_uuid = ?;`, json, deviceID)
-	num, err := result.RowsAffected()
-	if num == 0 {
-		log.Println("zero rows affected by resource publication request")
+//PublishResource upserts every link of the publication into the link table. the device row is locked so that concurrent
+//publications can't hand out the same instance id
+func (db MysqlRedisRegistry) PublishResource(ctx context.Context, json, deviceID string) (string, error) {
+	links, err := parsePublication(json)
+	if err != nil {
+		return "", err
 	}
-	return err
+	err = withTx(ctx, db.DB, func(tx *sql.Tx) error {
+		var id, lastIns int64
+		err := tx.QueryRowContext(ctx, "SELECT device_id FROM device WHERE device_uuid = ? FOR UPDATE;", deviceID).Scan(&id)
+		if err == sql.ErrNoRows {
+			return ErrDeviceNotFound
+		}
+		if err != nil {
+			return err
+		}
+		err = tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(ins), 0) FROM link WHERE device_id = ?;", id).Scan(&lastIns)
+		if err != nil {
+			return err
+		}
+		for i := range links {
+			var ins int64
+			err := tx.QueryRowContext(ctx, "SELECT ins FROM link WHERE device_id = ? AND href = ?;", id, links[i].href).Scan(&ins)
+			if err == sql.ErrNoRows {
+				lastIns++
+				ins = lastIns
+			} else if err != nil {
+				return err
+			}
+			err = links[i].setInstanceID(ins)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, "INSERT INTO link (device_id, ins, href, link) VALUES(?,?,?,?) ON DUPLICATE KEY UPDATE link = VALUES(link);", id, ins, links[i].href, string(links[i].raw))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return marshalPublication(deviceID, links)
 }
 
-//this query should be relevant: SELECT JSON_CONTAINS(@j1, '["oic.r.switch.binary"]', '$.links[0].rt');
-//how do I loop over every link in the query?
-/*
-these queries will need modification, but hopefully point in the right direction
-SET @j1 = (SELECT published_resources from device);
-select json_extract(@j1, '$.links[*].rt');
-select * from device where json_extract(@j1, '$.links[*].rt') like '%"oic.r.switch.binary"%';
-select json_extract((select published_resources from device),'$.links[*].rt');
-
-is it inefficient to call json_extract twice instead of saving the result?
-select * from device where (json_extract(@j1, '$.links[*].rt') like '%"oic.r.switch.binar"%' OR json_extract(@j1, '$.links[*].rt') like '%"oic.r.switch.binary"%');
-
-set @j2 = (select json_extract((select published_resources from device),'$.links[*].rt'));
-db.Query(`select published_resources from device inner join user on user.user_id = device.user_id where user.username = ?;` , userID)
-
-maybe use the IN keyword instead of LIKE?
-
-*/
-
-//TODO implement this
-func (db MysqlRedisRegistry) FindDevice(userID string, params url.Values) (string, error) {
-	//break out params into separate arrays based on field
-	//build sql query that includes all params
-	//anchor, href, rt, if, endpoints, policy/bitmask
-	//(I don't think I should implement anything but rt initially
-
-	//ifParams, ifOK := params["if"]
-	//anchorParams, anchorOK := params["anchor"]
-	//hrefParams, hrefOK := params["href"]
-
-	//rtParams, rtOK := params["rt"]
-	links := "[]"[:]
-	var tempStr string
-	//TODO fully parse this stuff
-	rows, err := db.Query(`select published_resources from device inner join user on user.user_id = device.user_id where user.username = ?;`, userID)
+//RetrievePublishedResources returns every link the device has published, ordered by instance id
+func (db MysqlRedisRegistry) RetrievePublishedResources(ctx context.Context, deviceID string) (string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT link.ins, link.link FROM device LEFT JOIN link ON link.device_id = device.device_id WHERE device.device_uuid = ? ORDER BY link.ins;", deviceID)
 	if err != nil {
 		return "", err
 	}
-	//This loop is a hot mess. gotta fix it
-	//good inspiration: https://play.golang.org/p/9JZqzccu8Y5
+	defer rows.Close()
+	found := false
+	var links []publishedLink
 	for rows.Next() {
-		err := rows.Scan(&tempStr)
-		links = links[:len(links)-2] + "," + tempStr + links[len(links)-1:]
+		found = true
+		var ins sql.NullInt64
+		var link sql.NullString
+		err := rows.Scan(&ins, &link)
 		if err != nil {
 			return "", err
 		}
+		if link.Valid {
+			links = append(links, publishedLink{ins: ins.Int64, raw: []byte(link.String)})
+		}
 	}
-	//iterate through rows, create a JSON payload then return that JSON
-
-	return "", nil
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	if !found {
+		return "", ErrDeviceNotFound
+	}
+	return marshalPublication(deviceID, links)
 }
 
-//TODO implement adding the user token collumn
-func createUserTable(ctx context.Context, db *sql.DB) error {
-	fmt.Println("in createUserTable")
-	stmt, err := db.Prepare("CREATE TABLE IF NOT EXISTS user( user_id bigint unsigned NOT NULL AUTO_INCREMENT, joinDate datetime NOT NULL DEFAULT NOW(), authz_provider varchar(45) , username varchar(45) NOT NULL ,token varchar(45),PRIMARY KEY (user_id),UNIQUE KEY Ind_58 (username)) AUTO_INCREMENT=1 ;")
+//UnpublishResources removes the links with those instance ids, or every link of the device if instanceIDs is empty
+func (db MysqlRedisRegistry) UnpublishResources(ctx context.Context, deviceID string, instanceIDs []int64) error {
+	var id int64
+	err := db.QueryRowContext(ctx, "SELECT device_id FROM device WHERE device_uuid = ?;", deviceID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return ErrDeviceNotFound
+	}
 	if err != nil {
 		return err
 	}
-	_, err = stmt.Exec()
-
+	query := "DELETE FROM link WHERE device_id = ?"
+	args := []interface{}{id}
+	if len(instanceIDs) > 0 {
+		query += " AND ins IN (?" + strings.Repeat(",?", len(instanceIDs)-1) + ")"
+		for _, ins := range instanceIDs {
+			args = append(args, ins)
+		}
+	}
+	_, err = db.ExecContext(ctx, query, args...)
 	return err
 }
 
-func createMediatorTable(ctx context.Context, db *sql.DB) error {
-	log.Println("creating mediator table")
-	_, err := db.ExecContext(ctx, `
-		CREATE TABLE IF NOT EXISTS  mediator(
-	mediator_id    bigint unsigned NOT NULL AUTO_INCREMENT,
-	user_id        bigint unsigned NOT NULL ,
-	permission     json ,
-	mediator_token varchar(45) NOT NULL ,
-	PRIMARY KEY (mediator_id),
-	UNIQUE KEY (mediator_token),
-	KEY fkIdx_9 (user_id),
-	CONSTRAINT FK_9 FOREIGN KEY fkIdx_9 (user_id) REFERENCES user (user_id)
-	) AUTO_INCREMENT=1;
-	`)
+//FindDevice returns a json array with the links published by every device owned by userID.
+//mysql's JSON functions can't filter array elements, so the links are filtered after they've been fetched
+func (db MysqlRedisRegistry) FindDevice(ctx context.Context, userID string, params url.Values) (string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT device.device_uuid, link.link FROM link INNER JOIN device ON device.device_id = link.device_id INNER JOIN user ON user.user_id = device.user_id WHERE user.username = ? ORDER BY device.device_uuid, link.ins;`, userID)
 	if err != nil {
-		log.Fatal("couldn't create mediator table because: ", err)
+		return "", err
 	}
-	return err
+	defer rows.Close()
+	links := make(map[string][]json.RawMessage)
+	for rows.Next() {
+		var deviceID, link string
+		err := rows.Scan(&deviceID, &link)
+		if err != nil {
+			return "", err
+		}
+		links[deviceID] = append(links[deviceID], json.RawMessage(link))
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	return filterLinks(links, params)
 }
 
-func createTokenTable(ctx context.Context, db *sql.DB) error {
-	_, err := db.ExecContext(ctx, `
-	CREATE TABLE IF NOT EXISTS token(
-	 token_id      bigint unsigned NOT NULL AUTO_INCREMENT ,
-	 refresh_token varchar(45) ,
-	 access_token  varchar(45) NOT NULL ,
-	 expires_in    datetime ,
-	PRIMARY KEY (token_id),
-	KEY access_token_index (access_token),
-	KEY refresh_token_index (refresh_token)
-	) AUTO_INCREMENT=1;
-	`)
-	return err
+//LookupUser returns the username that owns the client or device with that access token
+func (db MysqlRedisRegistry) LookupUser(ctx context.Context, accessToken string) (string, error) {
+	var userID string
+	var expiresIn sql.NullInt64
+	err := db.QueryRowContext(ctx, `SELECT user.username, UNIX_TIMESTAMP(token.expires_in) - UNIX_TIMESTAMP(NOW()) FROM token
+		LEFT JOIN device ON device.token_id = token.token_id
+		LEFT JOIN client ON client.token_id = token.token_id
+		INNER JOIN user ON user.user_id = COALESCE(device.user_id, client.user_id)
+		WHERE token.access_token_hash = ?;`, db.Hasher.Hash(accessToken)).Scan(&userID, &expiresIn)
+	if err == sql.ErrNoRows {
+		return "", ErrInvalidToken
+	}
+	if err != nil {
+		return "", err
+	}
+	if !expiresIn.Valid {
+		//a mediated token that hasn't been registered yet
+		return "", ErrInvalidToken
+	}
+	if expiresIn.Int64 <= 0 {
+		return "", ErrTokenExpired
+	}
+	return userID, nil
+}
+
+//LookupMediator returns the id of the mediator with that token and the username that provisioned it
+func (db MysqlRedisRegistry) LookupMediator(ctx context.Context, mediatorToken string) (string, string, error) {
+	var mediatorID, userID string
+	err := db.QueryRowContext(ctx, "SELECT mediator.mediator_id, user.username FROM mediator INNER JOIN user ON mediator.user_id = user.user_id WHERE mediator.mediator_token_hash = ?;", db.Hasher.Hash(mediatorToken)).Scan(&mediatorID, &userID)
+	if err == sql.ErrNoRows {
+		return "", "", ErrMediatorTokenNotFound
+	}
+	return mediatorID, userID, err
+}
+
+//DeviceOwner returns the username that owns the device and the id of the mediator that provisioned it
+func (db MysqlRedisRegistry) DeviceOwner(ctx context.Context, deviceUUID string) (string, string, error) {
+	var userID, mediatorID string
+	err := db.QueryRowContext(ctx, "SELECT user.username, device.mediator_id FROM device INNER JOIN user ON device.user_id = user.user_id WHERE device.device_uuid = ?;", deviceUUID).Scan(&userID, &mediatorID)
+	if err == sql.ErrNoRows {
+		return "", "", ErrDeviceNotFound
+	}
+	return userID, mediatorID, err
 }
 
 // GenerateRandomString returns a URL-safe, base64 encoded
@@ -494,47 +639,126 @@ func GenerateRandomString(s int) (string, error) {
 	return base64.URLEncoding.EncodeToString(b), err
 }
 
-func createClientTable(ctx context.Context, db *sql.DB) error {
-	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS client
-(
- client_id   bigint unsigned NOT NULL AUTO_INCREMENT ,
- user_id    bigint unsigned NOT NULL ,
- mediator_id bigint unsigned NOT NULL ,
- token_id    bigint unsigned NOT NULL ,
- client_uuid char(36) NOT NULL ,
-PRIMARY KEY (client_id),
-KEY client_uuid_index (client_uuid),
-KEY fkIdx_18 (user_id),
-CONSTRAINT FK_18 FOREIGN KEY fkIdx_18 (user_id) REFERENCES user (user_id),
-KEY fkIdx_50 (mediator_id),
-CONSTRAINT FK_50 FOREIGN KEY fkIdx_50 (mediator_id) REFERENCES mediator (mediator_id),
-KEY fkIdx_69 (token_id),
-CONSTRAINT FK_69 FOREIGN KEY fkIdx_69 (token_id) REFERENCES token (token_id)
-) AUTO_INCREMENT=1;
-`)
-	return err
-}
-
-func createDeviceTable(ctx context.Context, db *sql.DB) error {
-	_, err := db.ExecContext(ctx, `
-		CREATE TABLE IF NOT EXISTS device
-		(
-		 device_id           bigint unsigned NOT NULL AUTO_INCREMENT ,
-		 user_id             bigint unsigned NOT NULL ,
-		 published_resources json ,
-		 logged_in           tinyint unsigned NOT NULL ,
-		 mediator_id         bigint unsigned NOT NULL ,
-		 token_id            bigint unsigned NOT NULL ,
-		 device_uuid         char(36) NOT NULL ,
-		PRIMARY KEY (device_id),
-		KEY device_uuid_index (device_uuid),
-		KEY fkIdx_26 (user_id),
-		CONSTRAINT FK_26 FOREIGN KEY fkIdx_26 (user_id) REFERENCES user (user_id),
-		KEY fkIdx_53 (mediator_id),
-		CONSTRAINT FK_53 FOREIGN KEY fkIdx_53 (mediator_id) REFERENCES mediator (mediator_id),
-		KEY fkIdx_66 (token_id),
-		CONSTRAINT FK_66 FOREIGN KEY fkIdx_66 (token_id) REFERENCES token (token_id)
-		) AUTO_INCREMENT=1;
-		`)
-	return err
+//mysqlMigrations are applied in order by MigrateUp. never edit a released migration, add a new one instead
+var mysqlMigrations = []Migration{
+	{
+		Version:     1,
+		Description: "create user, mediator, token, client and device tables",
+		Up: []string{`
+	CREATE TABLE IF NOT EXISTS user(
+	 user_id        bigint unsigned NOT NULL AUTO_INCREMENT,
+	 joinDate       datetime NOT NULL DEFAULT NOW(),
+	 authz_provider varchar(45),
+	 username       varchar(45) NOT NULL,
+	 token          varchar(45),
+	PRIMARY KEY (user_id),
+	UNIQUE KEY Ind_58 (username)
+	) AUTO_INCREMENT=1;`, `
+	CREATE TABLE IF NOT EXISTS mediator(
+	 mediator_id    bigint unsigned NOT NULL AUTO_INCREMENT,
+	 user_id        bigint unsigned NOT NULL,
+	 permission     json,
+	 mediator_token varchar(45) NOT NULL,
+	PRIMARY KEY (mediator_id),
+	UNIQUE KEY (mediator_token),
+	KEY fkIdx_9 (user_id),
+	CONSTRAINT FK_9 FOREIGN KEY fkIdx_9 (user_id) REFERENCES user (user_id)
+	) AUTO_INCREMENT=1;`, `
+	CREATE TABLE IF NOT EXISTS token(
+	 token_id      bigint unsigned NOT NULL AUTO_INCREMENT,
+	 refresh_token varchar(45),
+	 access_token  varchar(45) NOT NULL,
+	 expires_in    datetime,
+	PRIMARY KEY (token_id),
+	KEY access_token_index (access_token),
+	KEY refresh_token_index (refresh_token)
+	) AUTO_INCREMENT=1;`, `
+	CREATE TABLE IF NOT EXISTS client(
+	 client_id   bigint unsigned NOT NULL AUTO_INCREMENT,
+	 user_id     bigint unsigned NOT NULL,
+	 mediator_id bigint unsigned NOT NULL,
+	 token_id    bigint unsigned NOT NULL,
+	 client_uuid char(36) NOT NULL,
+	PRIMARY KEY (client_id),
+	KEY client_uuid_index (client_uuid),
+	KEY fkIdx_18 (user_id),
+	CONSTRAINT FK_18 FOREIGN KEY fkIdx_18 (user_id) REFERENCES user (user_id),
+	KEY fkIdx_50 (mediator_id),
+	CONSTRAINT FK_50 FOREIGN KEY fkIdx_50 (mediator_id) REFERENCES mediator (mediator_id),
+	KEY fkIdx_69 (token_id),
+	CONSTRAINT FK_69 FOREIGN KEY fkIdx_69 (token_id) REFERENCES token (token_id)
+	) AUTO_INCREMENT=1;`, `
+	CREATE TABLE IF NOT EXISTS device(
+	 device_id           bigint unsigned NOT NULL AUTO_INCREMENT,
+	 user_id             bigint unsigned NOT NULL,
+	 published_resources json,
+	 logged_in           tinyint unsigned NOT NULL,
+	 mediator_id         bigint unsigned NOT NULL,
+	 token_id            bigint unsigned NOT NULL,
+	 device_uuid         char(36) NOT NULL,
+	PRIMARY KEY (device_id),
+	KEY device_uuid_index (device_uuid),
+	KEY fkIdx_26 (user_id),
+	CONSTRAINT FK_26 FOREIGN KEY fkIdx_26 (user_id) REFERENCES user (user_id),
+	KEY fkIdx_53 (mediator_id),
+	CONSTRAINT FK_53 FOREIGN KEY fkIdx_53 (mediator_id) REFERENCES mediator (mediator_id),
+	KEY fkIdx_66 (token_id),
+	CONSTRAINT FK_66 FOREIGN KEY fkIdx_66 (token_id) REFERENCES token (token_id)
+	) AUTO_INCREMENT=1;`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS device",
+			"DROP TABLE IF EXISTS client",
+			"DROP TABLE IF EXISTS token",
+			"DROP TABLE IF EXISTS mediator",
+			"DROP TABLE IF EXISTS user",
+		},
+	},
+	{
+		//the plaintext columns are kept, but HashLegacyTokens empties them so there's nothing to roll back to
+		Version:     2,
+		Description: "store tokens as keyed hashes",
+		Up: statements(
+			mysqlAddColumn("user", "token_hash", "char(44)"),
+			mysqlAddColumn("mediator", "mediator_token_hash", "char(44)"),
+			[]string{"ALTER TABLE mediator MODIFY mediator_token varchar(45) NULL"},
+			mysqlAddIndex("mediator", "mediator_token_hash_index", "UNIQUE KEY mediator_token_hash_index (mediator_token_hash)"),
+			mysqlAddColumn("token", "access_token_hash", "char(44)"),
+			mysqlAddColumn("token", "refresh_token_hash", "char(44)"),
+			[]string{"ALTER TABLE token MODIFY access_token varchar(45) NULL"},
+			mysqlAddIndex("token", "access_token_hash_index", "KEY access_token_hash_index (access_token_hash)"),
+			mysqlAddIndex("token", "refresh_token_hash_index", "KEY refresh_token_hash_index (refresh_token_hash)"),
+		),
+		Irreversible: "HashLegacyTokens empties the plaintext token columns, so dropping the hash columns would delete every credential",
+	},
+	{
+		//published_resources is no longer written, but it's kept so that this migration can be rolled back.
+		//the backfill uses JSON_TABLE, which needs mysql 8.0
+		Version:     3,
+		Description: "normalize published resources into the link table",
+		Up: []string{`
+	CREATE TABLE IF NOT EXISTS link(
+	 link_id   bigint unsigned NOT NULL AUTO_INCREMENT,
+	 device_id bigint unsigned NOT NULL,
+	 ins       bigint unsigned NOT NULL,
+	 href      varchar(255) NOT NULL,
+	 link      json NOT NULL,
+	PRIMARY KEY (link_id),
+	UNIQUE KEY link_href_index (device_id, href),
+	UNIQUE KEY link_ins_index (device_id, ins),
+	CONSTRAINT FK_link_device FOREIGN KEY (device_id) REFERENCES device (device_id) ON DELETE CASCADE
+	) AUTO_INCREMENT=1;`, `
+	INSERT IGNORE INTO link (device_id, ins, href, link)
+	SELECT device.device_id, links.ins, links.href, JSON_SET(links.link, '$.ins', links.ins)
+	FROM device, JSON_TABLE(device.published_resources, '$.links[*]' COLUMNS(
+	 ins  FOR ORDINALITY,
+	 href varchar(255) PATH '$.href',
+	 link json PATH '$'
+	)) AS links
+	WHERE links.href IS NOT NULL;`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS link",
+		},
+	},
 }
@@ -0,0 +1,674 @@
+package registry
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+
+	"github.com/lib/pq"
+	"github.com/sking2600/coap-gateway/pkg/routing"
+)
+
+/*PostgresRedisRegistry implements the registry interface using postgres for long-lasting data and a routing.RouteTable (usually redis) for ephemeral data.
+the schema is the same as the mysql one, except that published links are stored as JSONB so that FindDevice can filter
+links inside the database and the uuid columns are varchar instead of char so postgres doesn't pad them with spaces.
+*/
+type PostgresRedisRegistry struct {
+	*sql.DB
+	Routes routing.RouteTable
+	//Hasher hashes every token before it's written to or looked up in the db
+	Hasher TokenHasher
+}
+
+//PostgresURI builds a lib/pq connection URI. address is host[:port]
+func PostgresURI(username, password, address, dbName, sslMode string) string {
+	if sslMode == "" {
+		sslMode = "require"
+	}
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(username, password),
+		Host:     address,
+		Path:     dbName,
+		RawQuery: url.Values{"sslmode": []string{sslMode}}.Encode(),
+	}
+	return u.String()
+}
+
+//InitPostgresDB brings the schema up to date by running MigrateUp and then HashLegacyTokens. it is the postgres equivalent of InitDB
+func InitPostgresDB(ctx context.Context, db *sql.DB, h TokenHasher) (*sql.DB, error) {
+	_, err := MigrateUp(ctx, db, "postgres")
+	if err != nil {
+		log.Println("err migrating postgres schema: ", err)
+		return db, err
+	}
+	_, err = HashLegacyTokens(ctx, db, "postgres", h)
+	if err != nil {
+		log.Println("err hashing legacy tokens: ", err)
+		return db, err
+	}
+	return db, nil
+}
+
+//RegisterUser returns the user token
+func (db PostgresRedisRegistry) RegisterUser(ctx context.Context, username, authProvider string) (string, error) {
+	token, err := GenerateRandomString(tokenEntropy)
+	if err != nil {
+		return "", err
+	}
+	_, err = db.ExecContext(ctx, `INSERT INTO "user" (username, authz_provider, token_hash) VALUES($1,$2,$3)`, username, authProvider, db.Hasher.Hash(token))
+	if err != nil {
+		log.Println("err from inside RegisterUser ", err)
+		return "", err
+	}
+	return token, nil
+}
+
+//ProvisionMediator returns a mediator token if the username and user token match, ErrInvalidToken otherwise
+func (db PostgresRedisRegistry) ProvisionMediator(ctx context.Context, username, userToken string) (string, error) {
+	mediatorToken, err := GenerateRandomString(tokenEntropy)
+	if err != nil {
+		return "", err
+	}
+	var userID int64
+	var tokenHash sql.NullString
+	err = db.QueryRowContext(ctx, `SELECT user_id, token_hash FROM "user" WHERE username = $1`, username).Scan(&userID, &tokenHash)
+	if err == sql.ErrNoRows {
+		return "", ErrInvalidToken
+	}
+	if err != nil {
+		return "", err
+	}
+	if !db.Hasher.Equal(userToken, tokenHash.String) {
+		return "", ErrInvalidToken
+	}
+	_, err = db.ExecContext(ctx, "INSERT INTO mediator (user_id, mediator_token_hash) VALUES($1,$2)", userID, db.Hasher.Hash(mediatorToken))
+	return mediatorToken, err
+}
+
+//ProvisionDevice returns the one-time device access token to be summarily refreshed by the device.
+//returns ErrMediatorTokenNotFound or ErrDuplicateDevice if the device can't be provisioned
+func (db PostgresRedisRegistry) ProvisionDevice(ctx context.Context, deviceUUID, mediatorToken string) (string, error) {
+	token, err := GenerateRandomString(tokenEntropy)
+	if err != nil {
+		return "", err
+	}
+	err = withTx(ctx, db.DB, func(tx *sql.Tx) error {
+		var existing int64
+		err := tx.QueryRowContext(ctx, "SELECT device_id FROM device WHERE device_uuid = $1 FOR UPDATE", deviceUUID).Scan(&existing)
+		if err == nil {
+			return ErrDuplicateDevice
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+		mediatorID, userID, tokenID, err := postgresProvisionToken(ctx, tx, db.Hasher, mediatorToken, token)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO device (user_id, mediator_id, token_id, device_uuid, logged_in) VALUES($1,$2,$3,$4,false)", userID, mediatorID, tokenID, deviceUUID)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+//postgresProvisionToken looks up the mediator and inserts the one-time token shared by ProvisionDevice and ProvisionClient
+//the mediator is looked up by hash since there is nothing else identifying it
+func postgresProvisionToken(ctx context.Context, tx *sql.Tx, h TokenHasher, mediatorToken, token string) (mediatorID, userID, tokenID int64, err error) {
+	err = tx.QueryRowContext(ctx, "SELECT mediator_id, user_id FROM mediator WHERE mediator_token_hash = $1", h.Hash(mediatorToken)).Scan(&mediatorID, &userID)
+	if err == sql.ErrNoRows {
+		return 0, 0, 0, ErrMediatorTokenNotFound
+	}
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	err = tx.QueryRowContext(ctx, "INSERT INTO token (access_token_hash) VALUES($1) RETURNING token_id", h.Hash(token)).Scan(&tokenID)
+	return mediatorID, userID, tokenID, err
+}
+
+//RegisterDevice handles the UPDATE oic/sec/account request.
+//returns ErrInvalidToken if the device doesn't exist or the mediated token doesn't match
+func (db PostgresRedisRegistry) RegisterDevice(ctx context.Context, deviceUUID, mediatedToken string) (accessToken, userID, refreshToken string, expiresIn int, err error) {
+	accessToken, err = GenerateRandomString(tokenEntropy)
+	if err != nil {
+		return "", "", "", 0, err
+	}
+	refreshToken, err = GenerateRandomString(tokenEntropy)
+	if err != nil {
+		return "", "", "", 0, err
+	}
+	err = withTx(ctx, db.DB, func(tx *sql.Tx) error {
+		var tokenID int64
+		var tokenHash sql.NullString
+		err := tx.QueryRowContext(ctx, `SELECT device.token_id, "user".username, token.access_token_hash FROM device INNER JOIN token ON device.token_id = token.token_id INNER JOIN "user" ON device.user_id = "user".user_id WHERE device.device_uuid = $1 AND token.refresh_token_hash IS NULL FOR UPDATE OF token`, deviceUUID).Scan(&tokenID, &userID, &tokenHash)
+		if err == sql.ErrNoRows {
+			return ErrInvalidToken
+		}
+		if err != nil {
+			return err
+		}
+		if !db.Hasher.Equal(mediatedToken, tokenHash.String) {
+			return ErrInvalidToken
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE token SET refresh_token_hash = $1, access_token_hash = $2, expires_in = NOW() + make_interval(secs => $3) WHERE token_id = $4", db.Hasher.Hash(refreshToken), db.Hasher.Hash(accessToken), accessTokenTTL, tokenID)
+		return err
+	})
+	if err != nil {
+		return "", "", "", 0, err
+	}
+	return accessToken, userID, refreshToken, accessTokenTTL, nil
+}
+
+//DeleteDevice handles the DELETE oic/sec/account request
+func (db PostgresRedisRegistry) DeleteDevice(ctx context.Context, deviceUUID, userID, accessToken string) error {
+	err := withTx(ctx, db.DB, func(tx *sql.Tx) error {
+		var deviceID, tokenID, ownerID int64
+		var username string
+		var tokenHash sql.NullString
+		err := tx.QueryRowContext(ctx, `SELECT device.device_id, device.token_id, "user".user_id, "user".username, token.access_token_hash FROM device INNER JOIN token ON device.token_id = token.token_id INNER JOIN "user" ON device.user_id = "user".user_id WHERE device.device_uuid = $1 FOR UPDATE OF device, token`, deviceUUID).Scan(&deviceID, &tokenID, &ownerID, &username, &tokenHash)
+		if err == sql.ErrNoRows {
+			return ErrDeviceNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if userID != "" && userID != username {
+			return ErrInvalidToken
+		}
+		if !db.Hasher.Equal(accessToken, tokenHash.String) {
+			//a client of the same user is allowed to remove the device
+			var clientID int64
+			err := tx.QueryRowContext(ctx, "SELECT client.client_id FROM client INNER JOIN token ON client.token_id = token.token_id WHERE client.user_id = $1 AND token.access_token_hash = $2", ownerID, db.Hasher.Hash(accessToken)).Scan(&clientID)
+			if err == sql.ErrNoRows {
+				return ErrInvalidToken
+			}
+			if err != nil {
+				return err
+			}
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM device WHERE device_id = $1", deviceID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM token WHERE token_id = $1", tokenID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return db.Routes.DeleteRoute(deviceUUID)
+}
+
+//LookupRoute returns the route of the pod that's connected to the device with that UUID.
+//returns routing.ErrRouteNotFound if the device has never signed in (or the route expired)
+func (db PostgresRedisRegistry) LookupRoute(ctx context.Context, deviceUUID string) (routing.Route, error) {
+	return db.Routes.LookupRoute(deviceUUID)
+}
+
+//ReleaseRoute deletes the route of the device if it's still owner
+func (db PostgresRedisRegistry) ReleaseRoute(ctx context.Context, deviceID string, owner routing.Route) error {
+	err := db.Routes.DeleteOwnedRoute(deviceID, owner)
+	if err == routing.ErrRouteNotOwned {
+		return nil
+	}
+	return err
+}
+
+//RefreshRoute resets the ttl of the device's route if it's still owner
+func (db PostgresRedisRegistry) RefreshRoute(ctx context.Context, deviceID string, owner routing.Route) error {
+	return db.Routes.RefreshRoute(deviceID, owner, routeTTL)
+}
+
+//Heartbeat tells the reaper that podAddr is alive
+func (db PostgresRedisRegistry) Heartbeat(ctx context.Context, podAddr string) error {
+	return db.Routes.Heartbeat(podAddr, HeartbeatTTL)
+}
+
+//ReapStaleRoutes deletes the routes of pods that stopped sending heartbeats and marks their devices as logged out
+func (db PostgresRedisRegistry) ReapStaleRoutes(ctx context.Context) ([]string, error) {
+	reaped, err := db.Routes.ReapRoutes()
+	if err != nil || len(reaped) == 0 {
+		return reaped, err
+	}
+	_, err = db.ExecContext(ctx, "UPDATE device SET logged_in = false WHERE device_uuid = ANY($1)", pq.Array(reaped))
+	return reaped, err
+}
+
+//ProvisionClient returns one-time client access token to be summarily refreshed by the client
+//returns ErrMediatorTokenNotFound or ErrDuplicateClient if the client can't be provisioned
+func (db PostgresRedisRegistry) ProvisionClient(ctx context.Context, clientUUID, mediatorToken string) (string, error) {
+	token, err := GenerateRandomString(tokenEntropy)
+	if err != nil {
+		return "", err
+	}
+	err = withTx(ctx, db.DB, func(tx *sql.Tx) error {
+		var existing int64
+		err := tx.QueryRowContext(ctx, "SELECT client_id FROM client WHERE client_uuid = $1 FOR UPDATE", clientUUID).Scan(&existing)
+		if err == nil {
+			return ErrDuplicateClient
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+		mediatorID, userID, tokenID, err := postgresProvisionToken(ctx, tx, db.Hasher, mediatorToken, token)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO client (user_id, mediator_id, token_id, client_uuid) VALUES($1,$2,$3,$4)", userID, mediatorID, tokenID, clientUUID)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+//RegisterClient handles the UPDATE oic/sec/account request for clients
+//returns ErrInvalidToken if the client doesn't exist or the mediated token doesn't match
+func (db PostgresRedisRegistry) RegisterClient(ctx context.Context, userID, clientUUID, mediatedToken, authProvider string) (accessToken, refreshToken, redirectURI string, expiresIn int, err error) {
+	accessToken, err = GenerateRandomString(tokenEntropy)
+	if err != nil {
+		return "", "", "", 0, err
+	}
+	refreshToken, err = GenerateRandomString(tokenEntropy)
+	if err != nil {
+		return "", "", "", 0, err
+	}
+	err = withTx(ctx, db.DB, func(tx *sql.Tx) error {
+		var tokenID int64
+		var tokenHash sql.NullString
+		err := tx.QueryRowContext(ctx, "SELECT client.token_id, token.access_token_hash FROM client INNER JOIN token ON client.token_id = token.token_id WHERE client.client_uuid = $1 AND token.refresh_token_hash IS NULL FOR UPDATE OF token", clientUUID).Scan(&tokenID, &tokenHash)
+		if err == sql.ErrNoRows {
+			return ErrInvalidToken
+		}
+		if err != nil {
+			return err
+		}
+		if !db.Hasher.Equal(mediatedToken, tokenHash.String) {
+			return ErrInvalidToken
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE token SET refresh_token_hash = $1, access_token_hash = $2, expires_in = NOW() + make_interval(secs => $3) WHERE token_id = $4", db.Hasher.Hash(refreshToken), db.Hasher.Hash(accessToken), accessTokenTTL, tokenID)
+		return err
+	})
+	if err != nil {
+		return "", "", "", 0, err
+	}
+	return accessToken, refreshToken, "", accessTokenTTL, nil
+}
+
+//DeleteClient handles the DELETE oic/sec/account request
+func (db PostgresRedisRegistry) DeleteClient(ctx context.Context, clientID, accessToken string) error {
+	result, err := db.ExecContext(ctx, `
+		WITH c AS (DELETE FROM client USING token WHERE client.token_id = token.token_id AND client.client_uuid = $1 AND token.access_token_hash = $2 RETURNING client.token_id)
+		DELETE FROM token WHERE token_id IN (SELECT token_id FROM c)`, clientID, db.Hasher.Hash(accessToken))
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+//UpdateSession returns the int which is the access token TTL in seconds. based on UPDATE /oic/sec/session
+//signing in returns ErrInvalidToken if the access token doesn't belong to the device or ErrTokenExpired if it needs to be refreshed
+func (db PostgresRedisRegistry) UpdateSession(ctx context.Context, deviceID, userID, accessToken string, owner routing.Route, loggedIn bool) (int, routing.Route, error) {
+	if !loggedIn {
+		err := db.Routes.UpdateRoute(deviceID, owner, routing.UnspecifiedAddress, 0)
+		if err == routing.ErrRouteNotOwned {
+			//the device is signed in over a newer session
+			return 0, routing.Route{}, nil
+		}
+		if err != nil {
+			return 0, routing.Route{}, err
+		}
+		_, err = db.ExecContext(ctx, "UPDATE device SET logged_in = false WHERE device_uuid = $1", deviceID)
+		return 0, routing.Route{}, err
+	}
+	var expiresIn sql.NullInt64
+	var tokenHash sql.NullString
+	err := db.QueryRowContext(ctx, `SELECT EXTRACT(EPOCH FROM token.expires_in - NOW())::bigint, token.access_token_hash FROM token INNER JOIN device ON token.token_id = device.token_id INNER JOIN "user" ON device.user_id = "user".user_id WHERE device.device_uuid = $1 AND "user".username = $2`, deviceID, userID).Scan(&expiresIn, &tokenHash)
+	if err == sql.ErrNoRows {
+		return 0, routing.Route{}, ErrInvalidToken
+	}
+	if err != nil {
+		return 0, routing.Route{}, err
+	}
+	if !db.Hasher.Equal(accessToken, tokenHash.String) {
+		return 0, routing.Route{}, ErrInvalidToken
+	}
+	if !expiresIn.Valid {
+		//the device is provisioned but not registered, so the access token is still the mediated token
+		return 0, routing.Route{}, ErrInvalidToken
+	}
+	if expiresIn.Int64 <= 0 {
+		return 0, routing.Route{}, ErrTokenExpired
+	}
+	_, err = db.ExecContext(ctx, "UPDATE device SET logged_in = true WHERE device_uuid = $1", deviceID)
+	if err != nil {
+		return 0, routing.Route{}, err
+	}
+	route, err := db.Routes.SetRoute(deviceID, owner.PodAddr, routeTTL)
+	if err != nil {
+		return 0, routing.Route{}, err
+	}
+	return int(expiresIn.Int64), route, nil
+}
+
+//RefreshToken issues a new access token for the refresh token. the refresh token itself is recycled
+//deviceID is either a device or a client UUID. returns ErrInvalidToken if the refresh token doesn't belong to that device/client and user
+func (db PostgresRedisRegistry) RefreshToken(ctx context.Context, deviceID, userID, refreshToken string) (accessToken string, returnedRefreshToken string, ttl int, err error) {
+	accessToken, err = GenerateRandomString(tokenEntropy)
+	if err != nil {
+		return "", "", 0, err
+	}
+	err = withTx(ctx, db.DB, func(tx *sql.Tx) error {
+		var tokenID int64
+		var tokenHash sql.NullString
+		err := tx.QueryRowContext(ctx, `SELECT token.token_id, token.refresh_token_hash FROM token
+			LEFT JOIN device ON device.token_id = token.token_id
+			LEFT JOIN client ON client.token_id = token.token_id
+			INNER JOIN "user" ON "user".user_id = COALESCE(device.user_id, client.user_id)
+			WHERE "user".username = $1 AND (device.device_uuid = $2 OR client.client_uuid = $2)
+			FOR UPDATE OF token`, userID, deviceID).Scan(&tokenID, &tokenHash)
+		if err == sql.ErrNoRows {
+			return ErrInvalidToken
+		}
+		if err != nil {
+			return err
+		}
+		if !tokenHash.Valid || !db.Hasher.Equal(refreshToken, tokenHash.String) {
+			return ErrInvalidToken
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE token SET access_token_hash = $1, expires_in = NOW() + make_interval(secs => $2) WHERE token_id = $3", db.Hasher.Hash(accessToken), accessTokenTTL, tokenID)
+		return err
+	})
+	if err != nil {
+		log.Println("err in postgresregistry.RefreshToken(): ", err)
+		return "", "", 0, err
+	}
+	return accessToken, refreshToken, accessTokenTTL, nil
+}
+
+//PublishResource upserts every link of the publication into the link table. the device row is locked so that concurrent
+//publications can't hand out the same instance id
+func (db PostgresRedisRegistry) PublishResource(ctx context.Context, json, deviceID string) (string, error) {
+	links, err := parsePublication(json)
+	if err != nil {
+		return "", err
+	}
+	err = withTx(ctx, db.DB, func(tx *sql.Tx) error {
+		var id, lastIns int64
+		err := tx.QueryRowContext(ctx, "SELECT device_id FROM device WHERE device_uuid = $1 FOR UPDATE", deviceID).Scan(&id)
+		if err == sql.ErrNoRows {
+			return ErrDeviceNotFound
+		}
+		if err != nil {
+			return err
+		}
+		err = tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(ins), 0) FROM link WHERE device_id = $1", id).Scan(&lastIns)
+		if err != nil {
+			return err
+		}
+		for i := range links {
+			var ins int64
+			err := tx.QueryRowContext(ctx, "SELECT ins FROM link WHERE device_id = $1 AND href = $2", id, links[i].href).Scan(&ins)
+			if err == sql.ErrNoRows {
+				lastIns++
+				ins = lastIns
+			} else if err != nil {
+				return err
+			}
+			err = links[i].setInstanceID(ins)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, `INSERT INTO link (device_id, ins, href, link) VALUES($1, $2, $3, $4::jsonb)
+				ON CONFLICT (device_id, href) DO UPDATE SET link = EXCLUDED.link`, id, ins, links[i].href, string(links[i].raw))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return marshalPublication(deviceID, links)
+}
+
+//RetrievePublishedResources returns every link the device has published, ordered by instance id
+func (db PostgresRedisRegistry) RetrievePublishedResources(ctx context.Context, deviceID string) (string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT link.ins, link.link FROM device LEFT JOIN link ON link.device_id = device.device_id WHERE device.device_uuid = $1 ORDER BY link.ins", deviceID)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	found := false
+	var links []publishedLink
+	for rows.Next() {
+		found = true
+		var ins sql.NullInt64
+		var link sql.NullString
+		err := rows.Scan(&ins, &link)
+		if err != nil {
+			return "", err
+		}
+		if link.Valid {
+			links = append(links, publishedLink{ins: ins.Int64, raw: []byte(link.String)})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	if !found {
+		return "", ErrDeviceNotFound
+	}
+	return marshalPublication(deviceID, links)
+}
+
+//UnpublishResources removes the links with those instance ids, or every link of the device if instanceIDs is empty
+func (db PostgresRedisRegistry) UnpublishResources(ctx context.Context, deviceID string, instanceIDs []int64) error {
+	var id int64
+	err := db.QueryRowContext(ctx, "SELECT device_id FROM device WHERE device_uuid = $1", deviceID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return ErrDeviceNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if instanceIDs == nil {
+		instanceIDs = []int64{}
+	}
+	_, err = db.ExecContext(ctx, "DELETE FROM link WHERE device_id = $1 AND (cardinality($2::bigint[]) = 0 OR ins = ANY($2::bigint[]))", id, pq.Array(instanceIDs))
+	return err
+}
+
+//FindDevice returns a json array with the links published by every device owned by userID.
+//the links are filtered inside the database. multiple values of the same param match any of them
+func (db PostgresRedisRegistry) FindDevice(ctx context.Context, userID string, params url.Values) (string, error) {
+	var links string
+	err := db.QueryRowContext(ctx, `
+		SELECT COALESCE(json_agg(json_build_object('di', di, 'links', links)), '[]')
+		FROM (
+			SELECT device.device_uuid AS di, jsonb_agg(link.link ORDER BY link.ins) AS links
+			FROM link
+			INNER JOIN device ON device.device_id = link.device_id
+			INNER JOIN "user" ON "user".user_id = device.user_id
+			WHERE "user".username = $1
+			AND (cardinality($2::text[]) = 0 OR device.device_uuid = ANY($2::text[]))
+			AND (cardinality($3::text[]) = 0 OR link.link->'rt' ?| $3::text[])
+			AND (cardinality($4::text[]) = 0 OR link.link->'if' ?| $4::text[])
+			AND (cardinality($5::text[]) = 0 OR link.href = ANY($5::text[]))
+			AND (cardinality($6::text[]) = 0 OR link.link->>'anchor' = ANY($6::text[]))
+			GROUP BY device.device_uuid
+		) AS publications`, userID, pq.Array(nonNil(params["di"])), pq.Array(nonNil(params["rt"])), pq.Array(nonNil(params["if"])),
+		pq.Array(nonNil(params["href"])), pq.Array(nonNil(params["anchor"]))).Scan(&links)
+	if err != nil {
+		return "", fmt.Errorf("cannot find devices of %v: %v", userID, err)
+	}
+	return links, nil
+}
+
+//LookupUser returns the username that owns the client or device with that access token
+func (db PostgresRedisRegistry) LookupUser(ctx context.Context, accessToken string) (string, error) {
+	var userID string
+	var expiresIn sql.NullInt64
+	err := db.QueryRowContext(ctx, `SELECT "user".username, EXTRACT(EPOCH FROM token.expires_in - NOW())::bigint FROM token
+		LEFT JOIN device ON device.token_id = token.token_id
+		LEFT JOIN client ON client.token_id = token.token_id
+		INNER JOIN "user" ON "user".user_id = COALESCE(device.user_id, client.user_id)
+		WHERE token.access_token_hash = $1`, db.Hasher.Hash(accessToken)).Scan(&userID, &expiresIn)
+	if err == sql.ErrNoRows {
+		return "", ErrInvalidToken
+	}
+	if err != nil {
+		return "", err
+	}
+	if !expiresIn.Valid {
+		//a mediated token that hasn't been registered yet
+		return "", ErrInvalidToken
+	}
+	if expiresIn.Int64 <= 0 {
+		return "", ErrTokenExpired
+	}
+	return userID, nil
+}
+
+//LookupMediator returns the id of the mediator with that token and the username that provisioned it
+func (db PostgresRedisRegistry) LookupMediator(ctx context.Context, mediatorToken string) (string, string, error) {
+	var mediatorID, userID string
+	err := db.QueryRowContext(ctx, `SELECT mediator.mediator_id, "user".username FROM mediator INNER JOIN "user" ON mediator.user_id = "user".user_id WHERE mediator.mediator_token_hash = $1`, db.Hasher.Hash(mediatorToken)).Scan(&mediatorID, &userID)
+	if err == sql.ErrNoRows {
+		return "", "", ErrMediatorTokenNotFound
+	}
+	return mediatorID, userID, err
+}
+
+//DeviceOwner returns the username that owns the device and the id of the mediator that provisioned it
+func (db PostgresRedisRegistry) DeviceOwner(ctx context.Context, deviceUUID string) (string, string, error) {
+	var userID, mediatorID string
+	err := db.QueryRowContext(ctx, `SELECT "user".username, device.mediator_id FROM device INNER JOIN "user" ON device.user_id = "user".user_id WHERE device.device_uuid = $1`, deviceUUID).Scan(&userID, &mediatorID)
+	if err == sql.ErrNoRows {
+		return "", "", ErrDeviceNotFound
+	}
+	return userID, mediatorID, err
+}
+
+//nonNil makes sure that an absent query param is sent as an empty array rather than NULL
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
+
+//postgresMigrations are applied in order by MigrateUp. never edit a released migration, add a new one instead
+var postgresMigrations = []Migration{
+	{
+		Version:     1,
+		Description: "create user, mediator, token, client and device tables",
+		Up: []string{`
+	CREATE TABLE IF NOT EXISTS "user"(
+	 user_id        bigserial NOT NULL,
+	 joinDate       timestamp NOT NULL DEFAULT NOW(),
+	 authz_provider varchar(45),
+	 username       varchar(45) NOT NULL,
+	 token          varchar(45),
+	PRIMARY KEY (user_id),
+	UNIQUE (username)
+	);`, `
+	CREATE TABLE IF NOT EXISTS mediator(
+	 mediator_id    bigserial NOT NULL,
+	 user_id        bigint NOT NULL REFERENCES "user" (user_id),
+	 permission     jsonb,
+	 mediator_token varchar(45) NOT NULL,
+	PRIMARY KEY (mediator_id),
+	UNIQUE (mediator_token)
+	);
+	CREATE INDEX IF NOT EXISTS mediator_user_index ON mediator (user_id);`, `
+	CREATE TABLE IF NOT EXISTS token(
+	 token_id      bigserial NOT NULL,
+	 refresh_token varchar(45),
+	 access_token  varchar(45) NOT NULL,
+	 expires_in    timestamp with time zone,
+	PRIMARY KEY (token_id)
+	);
+	CREATE INDEX IF NOT EXISTS access_token_index ON token (access_token);
+	CREATE INDEX IF NOT EXISTS refresh_token_index ON token (refresh_token);`, `
+	CREATE TABLE IF NOT EXISTS client(
+	 client_id   bigserial NOT NULL,
+	 user_id     bigint NOT NULL REFERENCES "user" (user_id),
+	 mediator_id bigint NOT NULL REFERENCES mediator (mediator_id),
+	 token_id    bigint NOT NULL REFERENCES token (token_id),
+	 client_uuid varchar(36) NOT NULL,
+	PRIMARY KEY (client_id)
+	);
+	CREATE INDEX IF NOT EXISTS client_uuid_index ON client (client_uuid);`, `
+	CREATE TABLE IF NOT EXISTS device(
+	 device_id           bigserial NOT NULL,
+	 user_id             bigint NOT NULL REFERENCES "user" (user_id),
+	 published_resources jsonb,
+	 logged_in           boolean NOT NULL,
+	 mediator_id         bigint NOT NULL REFERENCES mediator (mediator_id),
+	 token_id            bigint NOT NULL REFERENCES token (token_id),
+	 device_uuid         varchar(36) NOT NULL,
+	PRIMARY KEY (device_id)
+	);
+	CREATE INDEX IF NOT EXISTS device_uuid_index ON device (device_uuid);
+	CREATE INDEX IF NOT EXISTS device_user_index ON device (user_id);`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS device",
+			"DROP TABLE IF EXISTS client",
+			"DROP TABLE IF EXISTS token",
+			"DROP TABLE IF EXISTS mediator",
+			`DROP TABLE IF EXISTS "user"`,
+		},
+	},
+	{
+		//the plaintext columns are kept, but HashLegacyTokens empties them so there's nothing to roll back to
+		Version:     2,
+		Description: "store tokens as keyed hashes",
+		Up: []string{
+			`ALTER TABLE "user" ADD COLUMN token_hash char(44)`,
+			"ALTER TABLE mediator ADD COLUMN mediator_token_hash char(44), ALTER COLUMN mediator_token DROP NOT NULL",
+			"CREATE UNIQUE INDEX mediator_token_hash_index ON mediator (mediator_token_hash)",
+			"ALTER TABLE token ADD COLUMN access_token_hash char(44), ADD COLUMN refresh_token_hash char(44), ALTER COLUMN access_token DROP NOT NULL",
+			"CREATE INDEX access_token_hash_index ON token (access_token_hash)",
+			"CREATE INDEX refresh_token_hash_index ON token (refresh_token_hash)",
+		},
+		Irreversible: "HashLegacyTokens empties the plaintext token columns, so dropping the hash columns would delete every credential",
+	},
+	{
+		//published_resources is no longer written, but it's kept so that this migration can be rolled back
+		Version:     3,
+		Description: "normalize published resources into the link table",
+		Up: []string{`
+	CREATE TABLE IF NOT EXISTS link(
+	 link_id   bigserial NOT NULL,
+	 device_id bigint NOT NULL REFERENCES device (device_id) ON DELETE CASCADE,
+	 ins       bigint NOT NULL,
+	 href      varchar(255) NOT NULL,
+	 link      jsonb NOT NULL,
+	PRIMARY KEY (link_id),
+	UNIQUE (device_id, href),
+	UNIQUE (device_id, ins)
+	);`, `
+	INSERT INTO link (device_id, ins, href, link)
+	SELECT device.device_id, links.ins, links.link->>'href', links.link || jsonb_build_object('ins', links.ins)
+	FROM device
+	CROSS JOIN LATERAL jsonb_array_elements(device.published_resources->'links') WITH ORDINALITY AS links(link, ins)
+	WHERE links.link->>'href' IS NOT NULL
+	ON CONFLICT DO NOTHING;`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS link",
+		},
+	},
+}
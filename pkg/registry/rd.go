@@ -0,0 +1,70 @@
+package registry
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+//publishedLink is one link of an oic/rd publication. links are identified by their href within a device and are given an
+//instance id ("ins") the first time they're published so that they can be deleted individually
+type publishedLink struct {
+	ins  int64
+	href string
+	raw  json.RawMessage
+}
+
+//parsePublication returns the links of a json encoded publication {"di", "links"}. every link must have an href.
+//if the same href is published twice, the last link wins
+func parsePublication(publication string) ([]publishedLink, error) {
+	var rp struct {
+		Links []json.RawMessage `json:"links"`
+	}
+	err := json.Unmarshal([]byte(publication), &rp)
+	if err != nil {
+		return nil, ErrInvalidPublication
+	}
+	links := make([]publishedLink, 0, len(rp.Links))
+	index := make(map[string]int)
+	for _, raw := range rp.Links {
+		var link struct {
+			Href string `json:"href"`
+		}
+		err := json.Unmarshal(raw, &link)
+		if err != nil || link.Href == "" {
+			return nil, ErrInvalidPublication
+		}
+		if i, ok := index[link.Href]; ok {
+			links[i].raw = raw
+			continue
+		}
+		index[link.Href] = len(links)
+		links = append(links, publishedLink{href: link.Href, raw: raw})
+	}
+	return links, nil
+}
+
+//setInstanceID assigns ins to the link and writes it into the link's json, replacing whatever "ins" the device sent
+func (l *publishedLink) setInstanceID(ins int64) error {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(l.raw, &fields)
+	if err != nil {
+		return ErrInvalidPublication
+	}
+	fields["ins"] = json.RawMessage(strconv.FormatInt(ins, 10))
+	raw, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	l.ins, l.raw = ins, raw
+	return nil
+}
+
+//marshalPublication encodes the links of a device the same way they are published: {"di", "links"}
+func marshalPublication(deviceID string, links []publishedLink) (string, error) {
+	rp := discoveredDevice{DeviceID: deviceID, Links: []json.RawMessage{}}
+	for _, l := range links {
+		rp.Links = append(rp.Links, l.raw)
+	}
+	out, err := json.Marshal(rp)
+	return string(out), err
+}
@@ -2,41 +2,123 @@ package registry
 
 import (
 	"context"
+	"database/sql"
 	"errors"
+	"log"
 	"net/url"
+	"time"
+
+	"github.com/sking2600/coap-gateway/pkg/routing"
 )
 
-//TODO figure out how to properly communicate to the client that the device is registered, but not connected (using ::/128 address?)
+//devices that are registered, but not connected are routed to routing.UnspecifiedAddress
 //TODO how do i enforce uniqueness of tokens? should I enforce that uniqueness?
 
+//errors returned by Registry implementations so that handlers can map them to HTTP/CoAP response codes
 var (
-	errorMediatorTokenNotfound = errors.New("mediator token not found")
-	unspecifiedAddress         = "::/128"
-	tokenEntropy               = 32   //the actual tokens will be longer due to base64 encoding
-	accessTokenTTL             = 6000 //TTL is seconds. TODO: make this configurable
+	//ErrMediatorTokenNotFound means the mediator token used for provisioning doesn't exist
+	ErrMediatorTokenNotFound = errors.New("mediator token not found")
+	//ErrDuplicateDevice means a device with the same UUID has already been provisioned
+	ErrDuplicateDevice = errors.New("device already provisioned")
+	//ErrDuplicateClient means a client with the same UUID has already been provisioned
+	ErrDuplicateClient = errors.New("client already provisioned")
+	//ErrInvalidToken means the token doesn't exist or doesn't belong to the given device/client/user
+	ErrInvalidToken = errors.New("invalid token")
+	//ErrTokenExpired means the access token is valid but has to be refreshed with oic/sec/tokenrefresh
+	ErrTokenExpired = errors.New("token expired")
+	//ErrDeviceNotFound means no device with that UUID has been provisioned
+	ErrDeviceNotFound = errors.New("device not found")
+	//ErrInvalidPublication means an oic/rd publication isn't valid json or has a link without an href
+	ErrInvalidPublication = errors.New("invalid resource publication")
+)
+
+var (
+	tokenEntropy   = 32   //the actual tokens will be longer due to base64 encoding
+	accessTokenTTL = 6000 //TTL is seconds. TODO: make this configurable
+	//routeTTL is how long a route lives without being refreshed by the keepalive of its session
+	routeTTL = 2 * time.Hour
+	//HeartbeatTTL is how long a pod is considered alive after its last heartbeat. pods should send a few heartbeats per HeartbeatTTL
+	HeartbeatTTL = 30 * time.Second
 )
 
 type Registry interface {
-	RegisterUser(username, authProvider string) (string, error)
-	ProvisionMediator(username, token string) (string, error)
+	RegisterUser(ctx context.Context, username, authProvider string) (string, error)
+	ProvisionMediator(ctx context.Context, username, token string) (string, error)
 	ProvisionDevice(ctx context.Context, deviceUUID, mediatorToken string) (string, error)
-	RegisterDevice(deviceUUID, mediatedToken string) (accessToken, userID, refreshToken string, expiresIn int, err error)
-	DeleteDevice(deviceID, accessToken string) error
+	RegisterDevice(ctx context.Context, deviceUUID, mediatedToken string) (accessToken, userID, refreshToken string, expiresIn int, err error)
+	//DeleteDevice deregisters the device and purges its route. accessToken is either the device's own access token or the access token
+	//of a client owned by the same user. userID is optional, but has to own the device if it's set.
+	//returns ErrDeviceNotFound or ErrInvalidToken
+	DeleteDevice(ctx context.Context, deviceUUID, userID, accessToken string) error
 	ProvisionClient(ctx context.Context, clientUUID, mediatorToken string) (string, error)
 	//redirectURI is optional so you should always check if redirectURI == ""
 	RegisterClient(ctx context.Context, userID, clientUUID, mediatedToken, authProvider string) (accessToken, refreshToken, redirectURI string, expiresIn int, err error)
+	//DeleteClient deregisters the client. returns ErrInvalidToken if the client doesn't exist or the token doesn't match
 	DeleteClient(ctx context.Context, clientID, accessToken string) error
-	UpdateSession(deviceID, userID, accessToken, podAddr string, loggedIn bool) (int, error)
-	RefreshToken(deviceID, userID, refreshToken string) (accessToken string, optionallyNewRefreshToken string, ttl int, err error)
-	//LookupPrivateIP looks up the IP of the pod that's connected to the device with that UUID
-	//I should probably change this method name
-	LookupPrivateIP(deviceUUID string) (string, error)
-
-	//PublishResource handles the db side of POST /oic/rd {deviceID, []Link}
-	PublishResource(json, deviceID string) error
-	//FindDevice takes the parameters from a GET /oic/res request and returns the published resources matching all params
-	//TODO figure out exactly which params to support, and then write the db queries
-	//for the time being, only support querying by device UUID? maybe resource types?
-	//TODO use the url.Values type from net/url instead of string. look into url.ParseQuery()
-	FindDevice(userID string, params url.Values) (publishedResources string, err error)
+	//UpdateSession handles UPDATE /oic/sec/session. signing in claims the device's route for owner.PodAddr and returns the new route,
+	//whose epoch identifies the session. signing out points the route at routing.UnspecifiedAddress, unless another session claimed it
+	//since owner (the route returned when the session signed in) in which case only the session's own state is cleared
+	UpdateSession(ctx context.Context, deviceID, userID, accessToken string, owner routing.Route, loggedIn bool) (expiresIn int, route routing.Route, err error)
+	RefreshToken(ctx context.Context, deviceID, userID, refreshToken string) (accessToken string, optionallyNewRefreshToken string, ttl int, err error)
+	//LookupRoute returns the route (pod IP and epoch) of the pod that's connected to the device with that UUID.
+	//returns routing.ErrRouteNotFound for unknown devices
+	LookupRoute(ctx context.Context, deviceUUID string) (routing.Route, error)
+	//ReleaseRoute deletes the route of the device if it's still owner, so that a pod that is shutting down doesn't
+	//remove the route of a device that already reconnected
+	ReleaseRoute(ctx context.Context, deviceID string, owner routing.Route) error
+	//RefreshRoute resets the ttl of the device's route. called by the keepalive of the session.
+	//returns routing.ErrRouteNotOwned if another session claimed the route since owner
+	RefreshRoute(ctx context.Context, deviceID string, owner routing.Route) error
+	//Heartbeat tells the reaper that podAddr is alive for the next HeartbeatTTL
+	Heartbeat(ctx context.Context, podAddr string) error
+	//ReapStaleRoutes deletes the routes of pods that stopped sending heartbeats and marks their devices as logged out.
+	//returns the reaped devices
+	ReapStaleRoutes(ctx context.Context) (deviceIDs []string, err error)
+
+	//PublishResource handles the db side of UPDATE /oic/rd {deviceID, []Link}. links are matched on their href: links that were
+	//already published are replaced and new ones are added. returns the publication with every link's instance id ("ins") set.
+	//returns ErrDeviceNotFound or ErrInvalidPublication
+	PublishResource(ctx context.Context, json, deviceID string) (published string, err error)
+	//RetrievePublishedResources returns {"di", "links"} with every link the device has published. returns ErrDeviceNotFound
+	RetrievePublishedResources(ctx context.Context, deviceID string) (publication string, err error)
+	//UnpublishResources handles DELETE /oic/rd. it removes the links with those instance ids, or every link of the device
+	//if instanceIDs is empty. unknown instance ids are ignored. returns ErrDeviceNotFound
+	UnpublishResources(ctx context.Context, deviceID string, instanceIDs []int64) error
+	//LookupUser returns the userID that owns the client or device with that access token. used to authorize GET /oic/res
+	//returns ErrInvalidToken or ErrTokenExpired
+	LookupUser(ctx context.Context, accessToken string) (userID string, err error)
+	//FindDevice takes the parameters from a GET /oic/res request and returns a json array of {"di", "links"} with the links of userID's devices.
+	//the di, rt, if, href and anchor params filter the links and multiple values of the same param match any of them
+	FindDevice(ctx context.Context, userID string, params url.Values) (publishedResources string, err error)
+	//LookupMediator returns the id of the mediator with that token and the userID that provisioned it. returns ErrMediatorTokenNotFound
+	LookupMediator(ctx context.Context, mediatorToken string) (mediatorID, userID string, err error)
+	//DeviceOwner returns the userID that owns the device and the id of the mediator that provisioned it. returns ErrDeviceNotFound
+	DeviceOwner(ctx context.Context, deviceUUID string) (userID, mediatorID string, err error)
+}
+
+//txBeginner is satisfied by both *sql.DB and *sql.Conn
+type txBeginner interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+//withTx runs fn inside a transaction which is rolled back if fn returns an error (or panics) and committed otherwise
+func withTx(ctx context.Context, db txBeginner, fn func(*sql.Tx) error) (err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Println("err rolling back transaction: ", rollbackErr)
+			}
+			return
+		}
+		err = tx.Commit()
+	}()
+	return fn(tx)
 }
@@ -0,0 +1,112 @@
+package registry
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+/*TokenHasher turns tokens into keyed hashes (HMAC-SHA256) so that the database never stores a usable credential.
+the pepper is a server side secret that must be the same for every pod and must never be stored in the database,
+otherwise a leaked database is enough to brute force the hashes.
+*/
+type TokenHasher struct {
+	pepper []byte
+}
+
+//NewTokenHasher returns a TokenHasher keyed with pepper
+func NewTokenHasher(pepper []byte) TokenHasher {
+	return TokenHasher{pepper: pepper}
+}
+
+//Hash returns the base64 encoded HMAC of token. the result is always 44 characters long
+func (h TokenHasher) Hash(token string) string {
+	mac := hmac.New(sha256.New, h.pepper)
+	mac.Write([]byte(token))
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+//Equal reports whether token hashes to hash. the comparison takes constant time
+func (h TokenHasher) Equal(token, hash string) bool {
+	return hmac.Equal([]byte(h.Hash(token)), []byte(hash))
+}
+
+//legacyTokenColumns are the plaintext columns (and the hash columns replacing them) from before migration 2
+var legacyTokenColumns = []struct {
+	table, id, plaintext, hash string
+}{
+	{"user", "user_id", "token", "token_hash"},
+	{"mediator", "mediator_id", "mediator_token", "mediator_token_hash"},
+	{"token", "token_id", "access_token", "access_token_hash"},
+	{"token", "token_id", "refresh_token", "refresh_token_hash"},
+}
+
+/*HashLegacyTokens hashes every token that is still stored in plaintext and then clears the plaintext column.
+it is safe to run repeatedly (rows that were already hashed are skipped) and is run right after MigrateUp, since SQL alone
+can't compute the keyed hash. returns the number of tokens that were hashed
+*/
+func HashLegacyTokens(ctx context.Context, db *sql.DB, driver string, h TokenHasher) (int, error) {
+	hashed := 0
+	for _, c := range legacyTokenColumns {
+		table := c.table
+		if driver == "postgres" && table == "user" {
+			table = `"user"`
+		}
+		err := withTx(ctx, db, func(tx *sql.Tx) error {
+			rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT %s, %s FROM %s WHERE %s IS NOT NULL FOR UPDATE", c.id, c.plaintext, table, c.plaintext))
+			if err != nil {
+				return err
+			}
+			tokens := make(map[int64]string)
+			for rows.Next() {
+				var id int64
+				var token string
+				err := rows.Scan(&id, &token)
+				if err != nil {
+					rows.Close()
+					return err
+				}
+				tokens[id] = token
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			update := rebind(driver, fmt.Sprintf("UPDATE %s SET %s = ?, %s = NULL WHERE %s = ?", table, c.hash, c.plaintext, c.id))
+			for id, token := range tokens {
+				_, err := tx.ExecContext(ctx, update, h.Hash(token), id)
+				if err != nil {
+					return err
+				}
+			}
+			hashed += len(tokens)
+			return nil
+		})
+		if err != nil {
+			return hashed, fmt.Errorf("cannot hash %s.%s: %v", c.table, c.plaintext, err)
+		}
+	}
+	return hashed, nil
+}
+
+//rebind replaces the ? placeholders with $1, $2... when driver is postgres
+func rebind(driver, query string) string {
+	if driver != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
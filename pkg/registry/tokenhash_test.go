@@ -0,0 +1,30 @@
+package registry
+
+import "testing"
+
+func TestTokenHasher(t *testing.T) {
+	h := NewTokenHasher([]byte("pepper"))
+	hash := h.Hash("token")
+	if len(hash) != 44 {
+		t.Fatalf("hash must fit the char(44) columns, got %v characters", len(hash))
+	}
+	if hash == "token" || hash != h.Hash("token") {
+		t.Fatalf("hash isn't deterministic: %v", hash)
+	}
+	if !h.Equal("token", hash) || h.Equal("other token", hash) {
+		t.Fatalf("Equal doesn't match the hash")
+	}
+	if NewTokenHasher([]byte("other pepper")).Equal("token", hash) {
+		t.Fatalf("hashes with different peppers must not match")
+	}
+}
+
+func TestRebind(t *testing.T) {
+	query := "UPDATE token SET access_token_hash = ?, access_token = NULL WHERE token_id = ?"
+	if got := rebind("mysql", query); got != query {
+		t.Fatalf("mysql query was modified: %v", got)
+	}
+	if got := rebind("postgres", query); got != "UPDATE token SET access_token_hash = $1, access_token = NULL WHERE token_id = $2" {
+		t.Fatalf("unexpected postgres query: %v", got)
+	}
+}
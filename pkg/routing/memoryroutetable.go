@@ -0,0 +1,132 @@
+package routing
+
+import (
+	"sync"
+	"time"
+)
+
+type memRoute struct {
+	Route
+	expires time.Time //zero value means the route never expires
+}
+
+func (r memRoute) expired() bool {
+	return !r.expires.IsZero() && time.Now().After(r.expires)
+}
+
+func expiry(ttl time.Duration) time.Time {
+	if ttl > 0 {
+		return time.Now().Add(ttl)
+	}
+	return time.Time{}
+}
+
+//MemoryRouteTable keeps routes in a map. it's only useful when every service runs in the same process (ex: tests)
+type MemoryRouteTable struct {
+	routes     map[string]memRoute
+	epochs     map[string]int64     //device -> epoch of its latest route
+	heartbeats map[string]time.Time //pod address -> when its heartbeat expires
+	mutex      sync.RWMutex
+}
+
+//NewMemoryRouteTable returns an empty in-memory RouteTable
+func NewMemoryRouteTable() *MemoryRouteTable {
+	return &MemoryRouteTable{routes: make(map[string]memRoute), epochs: make(map[string]int64), heartbeats: make(map[string]time.Time)}
+}
+
+//SetRoute claims the route of the device for podAddr
+func (r *MemoryRouteTable) SetRoute(deviceID, podAddr string, ttl time.Duration) (Route, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.epochs[deviceID]++
+	route := Route{PodAddr: podAddr, Epoch: r.epochs[deviceID]}
+	r.routes[deviceID] = memRoute{Route: route, expires: expiry(ttl)}
+	return route, nil
+}
+
+//LookupRoute returns the route of the device
+func (r *MemoryRouteTable) LookupRoute(deviceID string) (Route, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	route, ok := r.routes[deviceID]
+	if !ok || route.expired() {
+		return Route{}, ErrRouteNotFound
+	}
+	return route.Route, nil
+}
+
+//owned returns the route of the device if it's owner. the caller must hold the lock
+func (r *MemoryRouteTable) owned(deviceID string, owner Route) (memRoute, bool) {
+	route, ok := r.routes[deviceID]
+	return route, ok && !route.expired() && route.Route == owner
+}
+
+//UpdateRoute points the route at podAddr if it's still owner
+func (r *MemoryRouteTable) UpdateRoute(deviceID string, owner Route, podAddr string, ttl time.Duration) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.owned(deviceID, owner); !ok {
+		return ErrRouteNotOwned
+	}
+	r.routes[deviceID] = memRoute{Route: Route{PodAddr: podAddr, Epoch: owner.Epoch}, expires: expiry(ttl)}
+	return nil
+}
+
+//DeleteOwnedRoute removes the route if it's still owner
+func (r *MemoryRouteTable) DeleteOwnedRoute(deviceID string, owner Route) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.owned(deviceID, owner); !ok {
+		return ErrRouteNotOwned
+	}
+	delete(r.routes, deviceID)
+	return nil
+}
+
+//DeleteRoute removes the route of the device. its epoch is kept so that a stale owner can't match a route claimed later
+func (r *MemoryRouteTable) DeleteRoute(deviceID string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.routes, deviceID)
+	return nil
+}
+
+//RefreshRoute resets the ttl of the route if it's still owner
+func (r *MemoryRouteTable) RefreshRoute(deviceID string, owner Route, ttl time.Duration) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	route, ok := r.owned(deviceID, owner)
+	if !ok {
+		return ErrRouteNotOwned
+	}
+	route.expires = expiry(ttl)
+	r.routes[deviceID] = route
+	return nil
+}
+
+//Heartbeat records that podAddr is alive for the next ttl
+func (r *MemoryRouteTable) Heartbeat(podAddr string, ttl time.Duration) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.heartbeats[podAddr] = time.Now().Add(ttl)
+	return nil
+}
+
+//ReapRoutes deletes the routes that point at a pod without a live heartbeat
+func (r *MemoryRouteTable) ReapRoutes() ([]string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	var reaped []string
+	for deviceID, route := range r.routes {
+		if route.PodAddr == UnspecifiedAddress || route.expired() {
+			continue
+		}
+		if expires, ok := r.heartbeats[route.PodAddr]; ok && now.Before(expires) {
+			continue
+		}
+		delete(r.routes, deviceID)
+		reaped = append(reaped, deviceID)
+	}
+	return reaped, nil
+}
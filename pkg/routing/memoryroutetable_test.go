@@ -0,0 +1,124 @@
+package routing
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryRouteTable(t *testing.T) {
+	r := NewMemoryRouteTable()
+	if _, err := r.LookupRoute("device-test-uuid"); err != ErrRouteNotFound {
+		t.Fatalf("expected ErrRouteNotFound, got %v", err)
+	}
+	if _, err := r.SetRoute("device-test-uuid", "10.0.0.1", 0); err != nil {
+		t.Fatalf("cannot set route: %v", err)
+	}
+	route, err := r.LookupRoute("device-test-uuid")
+	if err != nil || route.PodAddr != "10.0.0.1" {
+		t.Fatalf("unexpected route: %v %v", route, err)
+	}
+	if _, err := r.SetRoute("device-test-uuid", "10.0.0.2", time.Nanosecond); err != nil {
+		t.Fatalf("cannot set route: %v", err)
+	}
+	time.Sleep(time.Millisecond)
+	if _, err := r.LookupRoute("device-test-uuid"); err != ErrRouteNotFound {
+		t.Fatalf("expired route was returned: %v", err)
+	}
+	r.SetRoute("device-test-uuid", "10.0.0.1", 0)
+	if err := r.DeleteRoute("device-test-uuid"); err != nil {
+		t.Fatalf("cannot delete route: %v", err)
+	}
+	if _, err := r.LookupRoute("device-test-uuid"); err != ErrRouteNotFound {
+		t.Fatalf("deleted route was returned: %v", err)
+	}
+}
+
+func TestMemoryRouteTableOwnership(t *testing.T) {
+	r := NewMemoryRouteTable()
+	old, _ := r.SetRoute("device-test-uuid", "10.0.0.1", time.Hour)
+	//the device reconnected to the same pod before the old session ended
+	current, _ := r.SetRoute("device-test-uuid", "10.0.0.1", time.Hour)
+	if current.Epoch <= old.Epoch {
+		t.Fatalf("epoch didn't increase: %v %v", old, current)
+	}
+	if err := r.UpdateRoute("device-test-uuid", old, UnspecifiedAddress, 0); err != ErrRouteNotOwned {
+		t.Fatalf("old session updated the route: %v", err)
+	}
+	if err := r.DeleteOwnedRoute("device-test-uuid", old); err != ErrRouteNotOwned {
+		t.Fatalf("old session deleted the route: %v", err)
+	}
+	if err := r.RefreshRoute("device-test-uuid", old, time.Hour); err != ErrRouteNotOwned {
+		t.Fatalf("old session refreshed the route: %v", err)
+	}
+	if route, err := r.LookupRoute("device-test-uuid"); err != nil || route != current {
+		t.Fatalf("route was clobbered: %v %v", route, err)
+	}
+	if err := r.UpdateRoute("device-test-uuid", current, UnspecifiedAddress, 0); err != nil {
+		t.Fatalf("cannot sign out: %v", err)
+	}
+	signedOut := Route{PodAddr: UnspecifiedAddress, Epoch: current.Epoch}
+	if route, err := r.LookupRoute("device-test-uuid"); err != nil || route != signedOut {
+		t.Fatalf("unexpected route after sign out: %v %v", route, err)
+	}
+	if err := r.DeleteOwnedRoute("device-test-uuid", signedOut); err != nil {
+		t.Fatalf("cannot delete own route: %v", err)
+	}
+}
+
+func TestMemoryRouteTableReaper(t *testing.T) {
+	r := NewMemoryRouteTable()
+	r.Heartbeat("10.0.0.1", time.Minute)
+	r.SetRoute("device-a", "10.0.0.1", time.Hour)
+	r.SetRoute("device-b", "10.0.0.2", time.Hour)
+	r.SetRoute("device-c", UnspecifiedAddress, 0)
+	reaped, err := r.ReapRoutes()
+	if err != nil || len(reaped) != 1 || reaped[0] != "device-b" {
+		t.Fatalf("expected only device-b to be reaped, got %v %v", reaped, err)
+	}
+	if _, err := r.LookupRoute("device-b"); err != ErrRouteNotFound {
+		t.Fatalf("reaped route was returned: %v", err)
+	}
+	for _, deviceID := range []string{"device-a", "device-c"} {
+		if _, err := r.LookupRoute(deviceID); err != nil {
+			t.Fatalf("route of %v was reaped: %v", deviceID, err)
+		}
+	}
+
+	route, _ := r.SetRoute("device-a", "10.0.0.1", time.Millisecond)
+	if err := r.RefreshRoute("device-a", route, time.Hour); err != nil {
+		t.Fatalf("cannot refresh route: %v", err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if _, err := r.LookupRoute("device-a"); err != nil {
+		t.Fatalf("refreshed route expired: %v", err)
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	for _, route := range []Route{{"10.0.0.1", 3}, {UnspecifiedAddress, 0}, {"fd00::1", 42}} {
+		if parsed := parseRoute(route.String()); parsed != route {
+			t.Fatalf("%v was parsed as %v", route, parsed)
+		}
+	}
+	if parsed := parseRoute("10.0.0.1"); parsed != (Route{PodAddr: "10.0.0.1"}) {
+		t.Fatalf("legacy route was parsed as %v", parsed)
+	}
+}
+
+func TestMemoryRouteTableDeleteKeepsEpoch(t *testing.T) {
+	r := NewMemoryRouteTable()
+	old, _ := r.SetRoute("device-test-uuid", "10.0.0.1", time.Hour)
+	if err := r.DeleteRoute("device-test-uuid"); err != nil {
+		t.Fatalf("cannot delete route: %v", err)
+	}
+	current, _ := r.SetRoute("device-test-uuid", "10.0.0.1", time.Hour)
+	if current.Epoch <= old.Epoch {
+		t.Fatalf("epoch didn't increase after delete: %v %v", old, current)
+	}
+	if err := r.UpdateRoute("device-test-uuid", old, UnspecifiedAddress, 0); err != ErrRouteNotOwned {
+		t.Fatalf("stale session updated the route: %v", err)
+	}
+	if route, err := r.LookupRoute("device-test-uuid"); err != nil || route != current {
+		t.Fatalf("route was clobbered: %v %v", route, err)
+	}
+}
@@ -0,0 +1,46 @@
+package routing
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+//uuidPattern matches the textual representation of a UUID (RFC 4122), which is what OCF device ids look like
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+/*SplitDevicePath splits the path of a request for a device resource, /<deviceUUID>/<href>, into the device id and the href.
+the href can have any number of segments (ex: a/light/1) and is returned without its leading slash. ok is false if the first
+segment isn't a UUID or the href is empty
+*/
+func SplitDevicePath(path string) (deviceID, href string, ok bool) {
+	path = strings.TrimPrefix(path, "/")
+	i := strings.Index(path, "/")
+	if i < 0 {
+		return "", "", false
+	}
+	deviceID, href = path[:i], path[i+1:]
+	if href == "" || !uuidPattern.MatchString(deviceID) {
+		return "", "", false
+	}
+	return deviceID, href, true
+}
+
+/*DeviceMux sends the requests for device resources (see SplitDevicePath) to the handler of their method, or answers 405 Method
+Not Allowed if there is none. every other request goes to fallback. device ids are UUIDs so they can't be confused with the
+other routes, whose first segment is a word (ex: /oic/res or /webhooks/<id>)
+*/
+func DeviceMux(fallback http.Handler, methods map[string]http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := SplitDevicePath(r.URL.Path); !ok {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		h, ok := methods[r.Method]
+		if !ok {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
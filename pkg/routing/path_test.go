@@ -0,0 +1,24 @@
+package routing
+
+import "testing"
+
+func TestSplitDevicePath(t *testing.T) {
+	tests := []struct {
+		path, deviceID, href string
+		ok                   bool
+	}{
+		{"/e61c3e6b-9c54-4b4b-9338-2c6f8a8d2a1c/myhref", "e61c3e6b-9c54-4b4b-9338-2c6f8a8d2a1c", "myhref", true},
+		{"/e61c3e6b-9c54-4b4b-9338-2c6f8a8d2a1c/a/light/1", "e61c3e6b-9c54-4b4b-9338-2c6f8a8d2a1c", "a/light/1", true},
+		{"/E61C3E6B-9C54-4B4B-9338-2C6F8A8D2A1C/oic/d", "E61C3E6B-9C54-4B4B-9338-2C6F8A8D2A1C", "oic/d", true},
+		{"/e61c3e6b-9c54-4b4b-9338-2c6f8a8d2a1c/", "", "", false},
+		{"/e61c3e6b-9c54-4b4b-9338-2c6f8a8d2a1c", "", "", false},
+		{"/oic/sec/account", "", "", false},
+		{"/device-test-uuid/myhref", "", "", false},
+	}
+	for _, test := range tests {
+		deviceID, href, ok := SplitDevicePath(test.path)
+		if deviceID != test.deviceID || href != test.href || ok != test.ok {
+			t.Errorf("SplitDevicePath(%q) = %q, %q, %v", test.path, deviceID, href, ok)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package routing
+
+import (
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+//keys used next to the routes. routes themselves are stored under the plain device UUID
+const (
+	podsKey             = "pods"        //set of every pod that has routes or heartbeats
+	heartbeatKeyPrefix  = "heartbeat:"  //heartbeat:<podAddr> exists while the pod is alive
+	podDevicesKeyPrefix = "pod-routes:" //pod-routes:<podAddr> is the set of devices that are routed to the pod
+	epochKeyPrefix      = "epoch:"      //epoch:<deviceID> is the epoch of the device's latest route
+)
+
+//unindexLua defines unindex(route), which removes the device KEYS[1] from the pod-routes set of the pod a stored route points at.
+//it's prepended to the scripts that replace or delete a route, so a device is only in the set of the pod it's routed to
+const unindexLua = `
+local function unindex(route)
+	if not route then
+		return
+	end
+	local pod = string.match(route, "^(.*)|%d+$") or route
+	redis.call("SREM", "` + podDevicesKeyPrefix + `" .. pod, KEYS[1])
+end
+`
+
+var (
+	//setRouteScript stores a new route for ARGV[1] with the next epoch and a ttl of ARGV[2] ms (0 means no ttl).
+	//KEYS: route, epoch counter, pod-routes set, pods set
+	setRouteScript = redis.NewScript(unindexLua + `
+unindex(redis.call("GET", KEYS[1]))
+local epoch = redis.call("INCR", KEYS[2])
+local route = ARGV[1] .. "|" .. epoch
+if tonumber(ARGV[2]) > 0 then
+	redis.call("SET", KEYS[1], route, "PX", ARGV[2])
+else
+	redis.call("SET", KEYS[1], route)
+end
+if ARGV[1] ~= ARGV[3] then
+	redis.call("SADD", KEYS[3], KEYS[1])
+	redis.call("SADD", KEYS[4], ARGV[1])
+end
+return epoch`)
+	//updateRouteScript replaces the route with ARGV[2] (pod ARGV[4], ttl ARGV[3] ms, 0 means no ttl) if it's still ARGV[1].
+	//KEYS: route, pod-routes set of ARGV[4], pods set
+	updateRouteScript = redis.NewScript(unindexLua + `
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+if tonumber(ARGV[3]) > 0 then
+	redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+else
+	redis.call("SET", KEYS[1], ARGV[2])
+end
+unindex(ARGV[1])
+if ARGV[4] ~= ARGV[5] then
+	redis.call("SADD", KEYS[2], KEYS[1])
+	redis.call("SADD", KEYS[3], ARGV[4])
+end
+return 1`)
+	//refreshRouteScript resets the ttl (ARGV[2], in ms) of the route if it's still ARGV[1]
+	refreshRouteScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+	//deleteOwnedRouteScript deletes the route if it's still ARGV[1]
+	deleteOwnedRouteScript = redis.NewScript(unindexLua + `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	unindex(ARGV[1])
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+	//deleteRouteScript deletes the route whoever owns it
+	deleteRouteScript = redis.NewScript(unindexLua + `
+unindex(redis.call("GET", KEYS[1]))
+return redis.call("DEL", KEYS[1])`)
+	//reapRouteScript deletes the route if it points at the pod ARGV[1], whatever its epoch
+	reapRouteScript = redis.NewScript(`
+local route = redis.call("GET", KEYS[1])
+if route and (route == ARGV[1] or string.sub(route, 1, string.len(ARGV[1]) + 1) == ARGV[1] .. "|") then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+)
+
+//RedisRouteTable stores routes as plain redis keys (device UUID -> <pod address>|<epoch>). looking up a single key is O(1) which is what
+//makes this scale. every compare-and-set is a lua script so it's atomic
+type RedisRouteTable struct {
+	client *redis.Client
+}
+
+//NewRedisRouteTable returns a RouteTable backed by the given redis client
+func NewRedisRouteTable(client *redis.Client) *RedisRouteTable {
+	return &RedisRouteTable{client: client}
+}
+
+func milliseconds(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+//SetRoute claims the route of the device for podAddr. the device is also added to the pod's set so that its route can be reaped
+//if the pod dies
+func (r *RedisRouteTable) SetRoute(deviceID, podAddr string, ttl time.Duration) (Route, error) {
+	keys := []string{deviceID, epochKeyPrefix + deviceID, podDevicesKeyPrefix + podAddr, podsKey}
+	epoch, err := setRouteScript.Run(r.client, keys, podAddr, milliseconds(ttl), UnspecifiedAddress).Int64()
+	if err != nil {
+		return Route{}, err
+	}
+	return Route{PodAddr: podAddr, Epoch: epoch}, nil
+}
+
+//LookupRoute returns the route of the device
+func (r *RedisRouteTable) LookupRoute(deviceID string) (Route, error) {
+	route, err := r.client.Get(deviceID).Result()
+	if err == redis.Nil {
+		return Route{}, ErrRouteNotFound
+	}
+	if err != nil {
+		return Route{}, err
+	}
+	return parseRoute(route), nil
+}
+
+//UpdateRoute points the route at podAddr if it's still owner
+func (r *RedisRouteTable) UpdateRoute(deviceID string, owner Route, podAddr string, ttl time.Duration) error {
+	route := Route{PodAddr: podAddr, Epoch: owner.Epoch}
+	keys := []string{deviceID, podDevicesKeyPrefix + podAddr, podsKey}
+	return ownedResult(updateRouteScript.Run(r.client, keys, owner.String(), route.String(), milliseconds(ttl), podAddr, UnspecifiedAddress))
+}
+
+//DeleteOwnedRoute removes the route if it's still owner
+func (r *RedisRouteTable) DeleteOwnedRoute(deviceID string, owner Route) error {
+	return ownedResult(deleteOwnedRouteScript.Run(r.client, []string{deviceID}, owner.String()))
+}
+
+//DeleteRoute removes the route of the device. its epoch is kept so that a stale owner can't match a route claimed later
+func (r *RedisRouteTable) DeleteRoute(deviceID string) error {
+	return deleteRouteScript.Run(r.client, []string{deviceID}).Err()
+}
+
+//RefreshRoute resets the ttl of the route if it's still owner. ttl must be positive
+func (r *RedisRouteTable) RefreshRoute(deviceID string, owner Route, ttl time.Duration) error {
+	return ownedResult(refreshRouteScript.Run(r.client, []string{deviceID}, owner.String(), milliseconds(ttl)))
+}
+
+//ownedResult maps the result of a compare-and-set script to ErrRouteNotOwned
+func ownedResult(cmd *redis.Cmd) error {
+	n, err := cmd.Int64()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrRouteNotOwned
+	}
+	return nil
+}
+
+//Heartbeat records that podAddr is alive for the next ttl
+func (r *RedisRouteTable) Heartbeat(podAddr string, ttl time.Duration) error {
+	_, err := r.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set(heartbeatKeyPrefix+podAddr, time.Now().Unix(), ttl)
+		pipe.SAdd(podsKey, podAddr)
+		return nil
+	})
+	return err
+}
+
+//ReapRoutes deletes the routes of every pod whose heartbeat key expired. routes of devices that have since moved to another pod are left alone
+func (r *RedisRouteTable) ReapRoutes() ([]string, error) {
+	pods, err := r.client.SMembers(podsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	var reaped []string
+	for _, podAddr := range pods {
+		alive, err := r.client.Exists(heartbeatKeyPrefix + podAddr).Result()
+		if err != nil {
+			return reaped, err
+		}
+		if alive > 0 {
+			continue
+		}
+		deviceIDs, err := r.client.SMembers(podDevicesKeyPrefix + podAddr).Result()
+		if err != nil {
+			return reaped, err
+		}
+		for _, deviceID := range deviceIDs {
+			deleted, err := reapRouteScript.Run(r.client, []string{deviceID}, podAddr).Int64()
+			if err != nil {
+				return reaped, err
+			}
+			if deleted > 0 {
+				reaped = append(reaped, deviceID)
+			}
+		}
+		_, err = r.client.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.Del(podDevicesKeyPrefix + podAddr)
+			pipe.SRem(podsKey, podAddr)
+			return nil
+		})
+		if err != nil {
+			return reaped, err
+		}
+	}
+	return reaped, nil
+}
@@ -0,0 +1,67 @@
+package routing
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	//ErrRouteNotFound is returned when no pod is known to be connected to the device
+	ErrRouteNotFound = errors.New("route not found")
+	//ErrRouteNotOwned is returned when a route can't be changed because another session claimed it since
+	ErrRouteNotOwned = errors.New("route is owned by another session")
+)
+
+//UnspecifiedAddress is stored for devices that are registered but signed out
+const UnspecifiedAddress = "::/128"
+
+//Route is where a device is connected. Epoch is incremented every time a session claims the route, so a pod can tell its
+//own session's route apart from one that a newer session (on the same or another pod) has claimed since
+type Route struct {
+	PodAddr string
+	Epoch   int64
+}
+
+//String encodes the route the way it's stored: <podAddr>|<epoch>
+func (r Route) String() string {
+	return r.PodAddr + "|" + strconv.FormatInt(r.Epoch, 10)
+}
+
+//parseRoute decodes a stored route. routes stored before epochs were introduced are just the pod address and get epoch 0
+func parseRoute(s string) Route {
+	i := strings.LastIndex(s, "|")
+	if i < 0 {
+		return Route{PodAddr: s}
+	}
+	epoch, err := strconv.ParseInt(s[i+1:], 10, 64)
+	if err != nil {
+		return Route{PodAddr: s}
+	}
+	return Route{PodAddr: s[:i], Epoch: epoch}
+}
+
+//RouteTable owns the mapping between a device UUID and the address of the pod that maintains its long-lived connection.
+//it is kept separate from the registry so that the routing layer can be swapped (ex: redis cluster or etcd) without touching account storage.
+//a route that was claimed with SetRoute can only be changed by the session that owns it (compare-and-set on the route's epoch)
+type RouteTable interface {
+	//SetRoute claims the route of the device for podAddr and returns it. the new route has a higher epoch than any previous
+	//route of the device. a ttl of 0 means the route never expires
+	SetRoute(deviceID, podAddr string, ttl time.Duration) (Route, error)
+	//LookupRoute returns the route of the device or ErrRouteNotFound
+	LookupRoute(deviceID string) (Route, error)
+	//UpdateRoute points the route at podAddr (keeping its epoch) if it's still owner. returns ErrRouteNotOwned otherwise
+	UpdateRoute(deviceID string, owner Route, podAddr string, ttl time.Duration) error
+	//DeleteOwnedRoute removes the route if it's still owner. returns ErrRouteNotOwned otherwise
+	DeleteOwnedRoute(deviceID string, owner Route) error
+	//DeleteRoute removes the route of the device whoever owns it. deleting a missing route is not an error
+	DeleteRoute(deviceID string) error
+	//RefreshRoute resets the ttl of the route if it's still owner. returns ErrRouteNotOwned otherwise
+	RefreshRoute(deviceID string, owner Route, ttl time.Duration) error
+	//Heartbeat records that podAddr is alive for the next ttl
+	Heartbeat(podAddr string, ttl time.Duration) error
+	//ReapRoutes deletes the routes that point at a pod without a live heartbeat (ex: a node failed before the pod could delete
+	//its routes) and returns the devices they belonged to
+	ReapRoutes() (deviceIDs []string, err error)
+}
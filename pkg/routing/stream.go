@@ -0,0 +1,170 @@
+package routing
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+/*requests can be routed to the coap-interface pods through redis streams instead of pod DNS: every pod consumes the stream
+requests:<podAddr> and the northbound-interface waits for the reply on a stream of its own, matching it to the request with a
+correlation id
+*/
+
+const (
+	requestStreamPrefix = "requests:"
+	replyStreamPrefix   = "replies:"
+	//streamMaxLen caps the streams, old entries are trimmed since nobody is waiting for them anymore
+	streamMaxLen = 10000
+	//streamTTL is how long a stream outlives its last entry, so that the streams of pods that went away don't pile up
+	streamTTL = time.Hour
+)
+
+//RequestStream returns the stream that the pod with that address consumes requests from
+func RequestStream(podAddr string) string {
+	return requestStreamPrefix + podAddr
+}
+
+//ReplyStream returns the stream that a northbound-interface instance reads its replies from
+func ReplyStream(instanceID string) string {
+	return replyStreamPrefix + instanceID
+}
+
+//StreamRequest is a request for a device, sent to the pod that's connected to it
+type StreamRequest struct {
+	ID          string //correlation id, copied into the reply
+	ReplyTo     string //the stream the reply is sent to
+	Method      string //an HTTP method
+	DeviceID    string
+	Href        string
+	Query       string //raw query string, forwarded as uri-query options
+	Epoch       int64  //epoch of the route the request was sent with, 0 if unknown
+	ContentType string //of Body
+	Accept      string //media types the client accepts for the response
+	Body        []byte
+}
+
+//StreamReply is the response to a StreamRequest
+type StreamReply struct {
+	ID              string
+	Status          int  //an HTTP status code
+	DeviceResponded bool //false if the status is the pod's, ex: the device isn't connected to it
+	ContentType     string
+	Body            []byte
+}
+
+//PublishRequest sends the request to the pod with that address
+func PublishRequest(client *redis.Client, podAddr string, req StreamRequest) error {
+	return publish(client, &redis.XAddArgs{
+		Stream:       RequestStream(podAddr),
+		MaxLenApprox: streamMaxLen,
+		Values: map[string]interface{}{
+			"id":          req.ID,
+			"reply":       req.ReplyTo,
+			"method":      req.Method,
+			"di":          req.DeviceID,
+			"href":        req.Href,
+			"query":       req.Query,
+			"epoch":       req.Epoch,
+			"contenttype": req.ContentType,
+			"accept":      req.Accept,
+			"body":        req.Body,
+		},
+	})
+}
+
+//PublishReply sends the reply to the stream the request asked for
+func PublishReply(client *redis.Client, stream string, reply StreamReply) error {
+	return publish(client, &redis.XAddArgs{
+		Stream:       stream,
+		MaxLenApprox: streamMaxLen,
+		Values: map[string]interface{}{
+			"id":          reply.ID,
+			"status":      reply.Status,
+			"responded":   reply.DeviceResponded,
+			"contenttype": reply.ContentType,
+			"body":        reply.Body,
+		},
+	})
+}
+
+func publish(client *redis.Client, args *redis.XAddArgs) error {
+	_, err := client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.XAdd(args)
+		pipe.Expire(args.Stream, streamTTL)
+		return nil
+	})
+	return err
+}
+
+//readStream returns the entries of the stream after lastID, waiting up to block for new ones. an empty result isn't an error
+func readStream(client *redis.Client, stream, lastID string, block time.Duration) ([]redis.XMessage, error) {
+	streams, err := client.XRead(&redis.XReadArgs{Streams: []string{stream, lastID}, Count: 100, Block: block}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil || len(streams) == 0 {
+		return nil, err
+	}
+	return streams[0].Messages, nil
+}
+
+func stringValue(values map[string]interface{}, key string) string {
+	s, _ := values[key].(string)
+	return s
+}
+
+//StreamIDAt returns the id of a stream entry added at t. reading after it returns the entries added since then
+func StreamIDAt(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10) + "-0"
+}
+
+/*ReadRequests returns the requests published to the pod after lastID, waiting up to block.
+it also returns the id to pass as lastID next time
+*/
+func ReadRequests(client *redis.Client, podAddr, lastID string, block time.Duration) ([]StreamRequest, string, error) {
+	messages, err := readStream(client, RequestStream(podAddr), lastID, block)
+	if err != nil {
+		return nil, lastID, err
+	}
+	requests := make([]StreamRequest, 0, len(messages))
+	for _, m := range messages {
+		epoch, _ := strconv.ParseInt(stringValue(m.Values, "epoch"), 10, 64)
+		requests = append(requests, StreamRequest{
+			ID:          stringValue(m.Values, "id"),
+			ReplyTo:     stringValue(m.Values, "reply"),
+			Method:      stringValue(m.Values, "method"),
+			DeviceID:    stringValue(m.Values, "di"),
+			Href:        stringValue(m.Values, "href"),
+			Query:       stringValue(m.Values, "query"),
+			Epoch:       epoch,
+			ContentType: stringValue(m.Values, "contenttype"),
+			Accept:      stringValue(m.Values, "accept"),
+			Body:        []byte(stringValue(m.Values, "body")),
+		})
+		lastID = m.ID
+	}
+	return requests, lastID, nil
+}
+
+//ReadReplies returns the replies published to the stream after lastID, waiting up to block. it also returns the id to pass as lastID next time
+func ReadReplies(client *redis.Client, stream, lastID string, block time.Duration) ([]StreamReply, string, error) {
+	messages, err := readStream(client, stream, lastID, block)
+	if err != nil {
+		return nil, lastID, err
+	}
+	replies := make([]StreamReply, 0, len(messages))
+	for _, m := range messages {
+		status, _ := strconv.Atoi(stringValue(m.Values, "status"))
+		replies = append(replies, StreamReply{
+			ID:              stringValue(m.Values, "id"),
+			Status:          status,
+			DeviceResponded: stringValue(m.Values, "responded") == "1",
+			ContentType:     stringValue(m.Values, "contenttype"),
+			Body:            []byte(stringValue(m.Values, "body")),
+		})
+		lastID = m.ID
+	}
+	return replies, lastID, nil
+}
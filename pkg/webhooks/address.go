@@ -0,0 +1,94 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	//ErrInvalidURL is returned for subscription urls that aren't absolute http or https urls
+	ErrInvalidURL = errors.New("url must be an absolute http or https url")
+	//ErrForbiddenAddress is returned for subscription urls whose host is inside the cluster or otherwise not public. deliveries are
+	//sent from inside the cluster, so they could otherwise reach endpoints that are only meant for other pods (ex: /admin/release)
+	ErrForbiddenAddress = errors.New("url must not point at a loopback, private, link-local or cluster address")
+)
+
+//sharedAddressSpace is 100.64.0.0/10 (RFC 6598), which some clusters use for pods and services
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+//forbiddenIP reports whether deliveries to ip are refused
+func forbiddenIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || sharedAddressSpace.Contains(ip)
+}
+
+//forbiddenHost reports whether the host name is local to the machine or the cluster
+func forbiddenHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, name := range []string{"localhost", "cluster.local"} {
+		if host == name || strings.HasSuffix(host, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+/*ValidateURL checks that rawURL is an absolute http or https url whose host is public: it isn't localhost or *.cluster.local and
+every address it resolves to is public. the addresses are checked again when events are delivered (see NewClient), since the
+host may resolve to another one by then
+*/
+func ValidateURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return ErrInvalidURL
+	}
+	host := u.Hostname()
+	if forbiddenHost(host) {
+		return ErrForbiddenAddress
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if forbiddenIP(ip) {
+			return ErrForbiddenAddress
+		}
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if forbiddenIP(addr.IP) {
+			return ErrForbiddenAddress
+		}
+	}
+	return nil
+}
+
+//refuseForbidden is the Control hook of the dialer of NewClient. it runs once the address is resolved, right before connecting
+func refuseForbidden(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || forbiddenIP(ip) {
+		return ErrForbiddenAddress
+	}
+	return nil
+}
+
+//NewClient returns the http client deliveries are sent with. it doesn't use a proxy and refuses to connect to the addresses
+//ValidateURL refuses, including after a redirect
+func NewClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: refuseForbidden}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: timeout},
+	}
+}
@@ -0,0 +1,157 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+//SignatureHeader carries "sha256=<hex encoded HMAC-SHA256 of the body>" keyed with the subscription's secret
+const SignatureHeader = "X-Webhook-Signature"
+
+/*Dispatcher delivers events to the subscriptions of the device's owner. every delivery is retried up to MaxAttempts times,
+waiting Backoff before the first retry and twice as long before each of the next ones. events that still couldn't be delivered
+are stored as dead letters. retries are kept in memory, so the ones that are pending when the process exits are lost
+*/
+type Dispatcher struct {
+	Store       Store
+	Owners      OwnerLookup
+	Source      string //CloudEvents source of the emitted events, ex: /coap-interface
+	Client      *http.Client
+	MaxAttempts int
+	Backoff     time.Duration
+}
+
+//NewDispatcher returns a dispatcher that tries each delivery 6 times over about 30 seconds. deliveries to addresses inside the
+//cluster are refused (see NewClient)
+func NewDispatcher(store Store, owners OwnerLookup, source string) *Dispatcher {
+	return &Dispatcher{
+		Store:       store,
+		Owners:      owners,
+		Source:      source,
+		Client:      NewClient(10 * time.Second),
+		MaxAttempts: 6,
+		Backoff:     time.Second,
+	}
+}
+
+//Emit delivers an event about the device to every matching subscription in the background. a nil dispatcher emits nothing.
+//errors are only logged since an event that can't be emitted shouldn't fail what caused it
+func (d *Dispatcher) Emit(ctx context.Context, eventType, deviceID string, data interface{}) {
+	if d == nil {
+		return
+	}
+	userID, mediatorID, err := d.Owners.DeviceOwner(ctx, deviceID)
+	if err != nil {
+		log.Println("err looking up the owner of ", deviceID, " to emit ", eventType, ": ", err)
+		return
+	}
+	subscriptions, err := d.Store.Subscriptions(userID)
+	if err != nil {
+		log.Println("err getting the webhooks of ", userID, ": ", err)
+		return
+	}
+	var e Event
+	for _, s := range subscriptions {
+		if !s.matches(eventType, mediatorID) {
+			continue
+		}
+		if e.ID == "" {
+			e, err = NewEvent(d.Source, eventType, deviceID, data)
+			if err != nil {
+				log.Println("err creating ", eventType, " event: ", err)
+				return
+			}
+		}
+		go d.deliver(s, e)
+	}
+}
+
+//deliver sends the event until the subscriber accepts it or MaxAttempts is reached, in which case it becomes a dead letter
+func (d *Dispatcher) deliver(s Subscription, e Event) {
+	var err error
+	attempt := 1
+	for ; ; attempt++ {
+		err = d.send(s, e)
+		if err == nil {
+			return
+		}
+		if attempt >= d.MaxAttempts {
+			break
+		}
+		time.Sleep(d.Backoff << uint(attempt-1))
+	}
+	log.Println("giving up on delivering event ", e.ID, " to webhook ", s.ID, ": ", err)
+	err = d.Store.AddDeadLetter(DeadLetter{SubscriptionID: s.ID, Event: e, Attempts: attempt, LastError: err.Error(), FailedAt: time.Now().UTC()})
+	if err != nil {
+		log.Println("err storing dead letter of event ", e.ID, ": ", err)
+	}
+}
+
+//send makes a single delivery attempt. any 2xx response means the event was accepted
+func (d *Dispatcher) send(s Subscription, e Event) error {
+	req, err := NewRequest(s, e)
+	if err != nil {
+		return err
+	}
+	res, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %v", res.Status)
+	}
+	return nil
+}
+
+//NewRequest encodes the event for the subscription, in structured or binary content mode, and signs it
+func NewRequest(s Subscription, e Event) (*http.Request, error) {
+	var body []byte
+	header := http.Header{}
+	if s.Mode == ModeBinary {
+		body = e.Data
+		header.Set("Content-Type", e.DataContentType)
+		header.Set("ce-specversion", e.SpecVersion)
+		header.Set("ce-id", e.ID)
+		header.Set("ce-source", e.Source)
+		header.Set("ce-type", e.Type)
+		header.Set("ce-time", e.Time.Format(time.RFC3339Nano))
+		if e.Subject != "" {
+			header.Set("ce-subject", e.Subject)
+		}
+	} else {
+		var err error
+		body, err = json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		header.Set("Content-Type", "application/cloudevents+json; charset=utf-8")
+	}
+	if s.Secret != "" {
+		header.Set(SignatureHeader, "sha256="+Sign(s.Secret, body))
+	}
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+	return req, nil
+}
+
+//Sign returns the hex encoded HMAC-SHA256 of the body. subscribers compare it with the signature header
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
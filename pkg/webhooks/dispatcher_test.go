@@ -0,0 +1,134 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type owners map[string][2]string
+
+func (o owners) DeviceOwner(ctx context.Context, deviceUUID string) (string, string, error) {
+	owner := o[deviceUUID]
+	return owner[0], owner[1], nil
+}
+
+func TestDispatcher(t *testing.T) {
+	received := make(chan *http.Request, 4)
+	bodies := make(chan []byte, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		received <- r
+		bodies <- b
+	}))
+	defer server.Close()
+	store := NewMemoryStore()
+	store.AddSubscription(Subscription{ID: "structured", UserID: "satoshi", URL: server.URL, Secret: "s3cret", Mode: ModeStructured})
+	store.AddSubscription(Subscription{ID: "binary", UserID: "satoshi", MediatorID: "1", URL: server.URL, Mode: ModeBinary, Types: []string{DeviceSignedIn}})
+	//neither the type nor the mediator match
+	store.AddSubscription(Subscription{ID: "other", UserID: "satoshi", MediatorID: "2", URL: server.URL})
+	d := NewDispatcher(store, owners{"device-test-uuid": {"satoshi", "1"}}, "/test")
+	//the test server listens on loopback, which the default client refuses
+	d.Client = server.Client()
+	d.Emit(context.Background(), DeviceSignedIn, "device-test-uuid", map[string]string{"di": "device-test-uuid"})
+
+	for i := 0; i < 2; i++ {
+		r, body := <-received, <-bodies
+		if r.Header.Get("ce-specversion") != "" {
+			if r.Header.Get("ce-type") != DeviceSignedIn || r.Header.Get("ce-subject") != "device-test-uuid" || string(body) != `{"di":"device-test-uuid"}` {
+				t.Fatalf("unexpected binary event: %v %s", r.Header, body)
+			}
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal(body, &e); err != nil || e.Type != DeviceSignedIn || e.SpecVersion != "1.0" {
+			t.Fatalf("unexpected structured event: %s %v", body, err)
+		}
+		if r.Header.Get(SignatureHeader) != "sha256="+Sign("s3cret", body) {
+			t.Fatalf("unexpected signature: %v", r.Header.Get(SignatureHeader))
+		}
+	}
+	select {
+	case r := <-received:
+		t.Fatalf("unexpected delivery: %v", r.Header)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDispatcherDeadLetter(t *testing.T) {
+	attempts := make(chan struct{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts <- struct{}{}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	store := NewMemoryStore()
+	store.AddSubscription(Subscription{ID: "failing", UserID: "satoshi", URL: server.URL})
+	d := NewDispatcher(store, owners{"device-test-uuid": {"satoshi", "1"}}, "/test")
+	//the test server listens on loopback, which the default client refuses
+	d.Client = server.Client()
+	d.MaxAttempts, d.Backoff = 3, time.Millisecond
+	d.Emit(context.Background(), CommandCompleted, "device-test-uuid", nil)
+	for i := 0; i < 3; i++ {
+		<-attempts
+	}
+	var letters []DeadLetter
+	for deadline := time.Now().Add(time.Second); len(letters) == 0 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		letters, _ = store.DeadLetters("failing")
+	}
+	if len(letters) != 1 || letters[0].Attempts != 3 || letters[0].Event.Type != CommandCompleted {
+		t.Fatalf("unexpected dead letters: %+v", letters)
+	}
+}
+
+func TestCommandResultPayload(t *testing.T) {
+	for _, tc := range []struct {
+		payload []byte
+		want    string
+	}{
+		{[]byte(`{"on":true}`), `{"id":"1","di":"d","href":"light","result":200,"payload":{"on":true}}`},
+		{[]byte("on"), `{"id":"1","di":"d","href":"light","result":200,"payload":"on"}`},
+		{nil, `{"id":"1","di":"d","href":"light","result":200}`},
+	} {
+		b, err := json.Marshal(CommandResult{ID: "1", DeviceID: "d", Href: "light", Result: 200, Payload: JSONPayload(tc.payload)})
+		if err != nil || string(b) != tc.want {
+			t.Fatalf("unexpected json: %s %v", b, err)
+		}
+	}
+}
+
+func TestValidateURL(t *testing.T) {
+	for _, tc := range []struct {
+		url  string
+		want error
+	}{
+		{"https://93.184.216.34/events", nil},
+		{"ftp://93.184.216.34/events", ErrInvalidURL},
+		{"/events", ErrInvalidURL},
+		{"http://localhost:8080/events", ErrForbiddenAddress},
+		{"http://127.0.0.1/events", ErrForbiddenAddress},
+		{"http://[::1]/events", ErrForbiddenAddress},
+		{"http://10.1.2.3:8081/admin/release", ErrForbiddenAddress},
+		{"http://169.254.169.254/latest/meta-data", ErrForbiddenAddress},
+		{"http://10-1-2-3.default.pod.cluster.local:8081/admin/release?count=100", ErrForbiddenAddress},
+	} {
+		if err := ValidateURL(context.Background(), tc.url); err != tc.want {
+			t.Fatalf("%v: expected %v, got %v", tc.url, tc.want, err)
+		}
+	}
+}
+
+func TestClientRefusesLoopback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("a delivery reached a loopback address")
+	}))
+	defer server.Close()
+	_, err := NewClient(time.Second).Post(server.URL, "application/json", nil)
+	if err == nil {
+		t.Fatalf("the client connected to a loopback address")
+	}
+}
@@ -0,0 +1,75 @@
+package webhooks
+
+import "sync"
+
+//MemoryStore keeps subscriptions in a map. it's only useful when every service runs in the same process (ex: tests)
+type MemoryStore struct {
+	subscriptions map[string]Subscription
+	deadLetters   map[string][]DeadLetter
+	mutex         sync.RWMutex
+}
+
+//NewMemoryStore returns an empty in-memory Store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{subscriptions: make(map[string]Subscription), deadLetters: make(map[string][]DeadLetter)}
+}
+
+//AddSubscription stores the subscription
+func (m *MemoryStore) AddSubscription(s Subscription) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.subscriptions[s.ID] = s
+	return nil
+}
+
+//Subscription returns the subscription
+func (m *MemoryStore) Subscription(id string) (Subscription, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	s, ok := m.subscriptions[id]
+	if !ok {
+		return Subscription{}, ErrSubscriptionNotFound
+	}
+	return s, nil
+}
+
+//DeleteSubscription removes the subscription and its dead letters
+func (m *MemoryStore) DeleteSubscription(id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.subscriptions, id)
+	delete(m.deadLetters, id)
+	return nil
+}
+
+//Subscriptions returns every subscription of the user
+func (m *MemoryStore) Subscriptions(userID string) ([]Subscription, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var subscriptions []Subscription
+	for _, s := range m.subscriptions {
+		if s.UserID == userID {
+			subscriptions = append(subscriptions, s)
+		}
+	}
+	return subscriptions, nil
+}
+
+//AddDeadLetter stores an event that couldn't be delivered, at most maxDeadLetters per subscription
+func (m *MemoryStore) AddDeadLetter(d DeadLetter) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	letters := append([]DeadLetter{d}, m.deadLetters[d.SubscriptionID]...)
+	if len(letters) > maxDeadLetters {
+		letters = letters[:maxDeadLetters]
+	}
+	m.deadLetters[d.SubscriptionID] = letters
+	return nil
+}
+
+//DeadLetters returns the dead letters of the subscription, newest first
+func (m *MemoryStore) DeadLetters(subscriptionID string) ([]DeadLetter, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return append([]DeadLetter{}, m.deadLetters[subscriptionID]...), nil
+}
@@ -0,0 +1,124 @@
+package webhooks
+
+import (
+	"encoding/json"
+
+	"github.com/go-redis/redis"
+)
+
+//subscriptions are stored as json under webhook:<id>, the ids of a user's subscriptions in the set webhooks:<userID>
+//and the dead letters of a subscription as a list of json under webhook-dead-letters:<id>
+const (
+	subscriptionKeyPrefix = "webhook:"
+	userKeyPrefix         = "webhooks:"
+	deadLetterKeyPrefix   = "webhook-dead-letters:"
+	//maxDeadLetters is how many dead letters are kept per subscription, the oldest are dropped
+	maxDeadLetters = 1000
+)
+
+//RedisStore keeps subscriptions and dead letters in redis
+type RedisStore struct {
+	client *redis.Client
+}
+
+//NewRedisStore returns a Store backed by the redis client
+func NewRedisStore(client *redis.Client) *RedisStore {
+	return &RedisStore{client: client}
+}
+
+//AddSubscription stores the subscription
+func (r *RedisStore) AddSubscription(s Subscription) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	_, err = r.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set(subscriptionKeyPrefix+s.ID, b, 0)
+		pipe.SAdd(userKeyPrefix+s.UserID, s.ID)
+		return nil
+	})
+	return err
+}
+
+//Subscription returns the subscription
+func (r *RedisStore) Subscription(id string) (Subscription, error) {
+	var s Subscription
+	b, err := r.client.Get(subscriptionKeyPrefix + id).Bytes()
+	if err == redis.Nil {
+		return s, ErrSubscriptionNotFound
+	}
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(b, &s)
+	return s, err
+}
+
+//DeleteSubscription removes the subscription and its dead letters
+func (r *RedisStore) DeleteSubscription(id string) error {
+	s, err := r.Subscription(id)
+	if err == ErrSubscriptionNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = r.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(subscriptionKeyPrefix+id, deadLetterKeyPrefix+id)
+		pipe.SRem(userKeyPrefix+s.UserID, id)
+		return nil
+	})
+	return err
+}
+
+//Subscriptions returns every subscription of the user
+func (r *RedisStore) Subscriptions(userID string) ([]Subscription, error) {
+	ids, err := r.client.SMembers(userKeyPrefix + userID).Result()
+	if err != nil {
+		return nil, err
+	}
+	var subscriptions []Subscription
+	for _, id := range ids {
+		s, err := r.Subscription(id)
+		if err == ErrSubscriptionNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, s)
+	}
+	return subscriptions, nil
+}
+
+//AddDeadLetter stores an event that couldn't be delivered, at most maxDeadLetters per subscription
+func (r *RedisStore) AddDeadLetter(d DeadLetter) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	_, err = r.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.LPush(deadLetterKeyPrefix+d.SubscriptionID, b)
+		pipe.LTrim(deadLetterKeyPrefix+d.SubscriptionID, 0, maxDeadLetters-1)
+		return nil
+	})
+	return err
+}
+
+//DeadLetters returns the dead letters of the subscription, newest first
+func (r *RedisStore) DeadLetters(subscriptionID string) ([]DeadLetter, error) {
+	values, err := r.client.LRange(deadLetterKeyPrefix+subscriptionID, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	letters := make([]DeadLetter, 0, len(values))
+	for _, v := range values {
+		var d DeadLetter
+		err := json.Unmarshal([]byte(v), &d)
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, d)
+	}
+	return letters, nil
+}
@@ -0,0 +1,146 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var (
+	//ErrSubscriptionNotFound is returned for unknown subscriptions
+	ErrSubscriptionNotFound = errors.New("subscription not found")
+)
+
+//types of the events emitted by the gateway
+const (
+	DeviceRegistered     = "org.openconnectivity.cloud.device.registered"
+	DeviceSignedIn       = "org.openconnectivity.cloud.device.signedin"
+	DeviceSignedOut      = "org.openconnectivity.cloud.device.signedout"
+	ResourcesPublished   = "org.openconnectivity.cloud.device.resources.published"
+	ResourceNotification = "org.openconnectivity.cloud.device.resource.notification"
+	CommandCompleted     = "org.openconnectivity.cloud.command.completed"
+)
+
+//content modes of the CloudEvents HTTP binding
+const (
+	//ModeStructured sends the whole event as the json body (application/cloudevents+json)
+	ModeStructured = "structured"
+	//ModeBinary sends the data as the body and the other attributes as ce-* headers
+	ModeBinary = "binary"
+)
+
+//Event is a CloudEvents 1.0 event with json data
+type Event struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"` //the device the event is about
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+}
+
+//NewEvent returns an event with a random id and data encoded as json
+func NewEvent(source, eventType, subject string, data interface{}) (Event, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return Event{}, err
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return Event{}, err
+	}
+	return Event{
+		SpecVersion:     "1.0",
+		ID:              hex.EncodeToString(b),
+		Source:          source,
+		Type:            eventType,
+		Subject:         subject,
+		Time:            time.Now().UTC(),
+		DataContentType: "application/json",
+		Data:            payload,
+	}, nil
+}
+
+/*Subscription delivers the events of a user's devices to URL. subscriptions registered by a mediator (MediatorID is set) only get
+the events of the devices that mediator provisioned. an empty Types gets every event type
+*/
+type Subscription struct {
+	ID         string   `json:"id"`
+	UserID     string   `json:"uid"`
+	MediatorID string   `json:"mediatorid,omitempty"`
+	URL        string   `json:"url"`
+	Secret     string   `json:"secret,omitempty"` //key of the HMAC-SHA256 signature of every request
+	Mode       string   `json:"mode"`
+	Types      []string `json:"types,omitempty"`
+}
+
+//matches reports whether the event of a device provisioned by mediatorID has to be delivered to the subscription
+func (s Subscription) matches(eventType, mediatorID string) bool {
+	if s.MediatorID != "" && s.MediatorID != mediatorID {
+		return false
+	}
+	if len(s.Types) == 0 {
+		return true
+	}
+	for _, t := range s.Types {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+//CommandResult is the data of CommandCompleted events. Payload is set with JSONPayload
+type CommandResult struct {
+	ID       string      `json:"id"`
+	DeviceID string      `json:"di"`
+	Href     string      `json:"href"`
+	Result   int         `json:"result"`
+	Payload  interface{} `json:"payload,omitempty"`
+}
+
+//JSONPayload embeds a json payload of a device as is (rather than base64 like a []byte). anything else (ex: a content format that
+//isn't converted) is embedded as a string, and an empty payload is left out
+func JSONPayload(b []byte) interface{} {
+	if len(b) == 0 {
+		return nil
+	}
+	if json.Valid(b) {
+		return json.RawMessage(b)
+	}
+	return string(b)
+}
+
+//DeadLetter is an event that couldn't be delivered to a subscription after every retry
+type DeadLetter struct {
+	SubscriptionID string    `json:"subscriptionid"`
+	Event          Event     `json:"event"`
+	Attempts       int       `json:"attempts"`
+	LastError      string    `json:"lasterror"`
+	FailedAt       time.Time `json:"failedat"`
+}
+
+//Store keeps the subscriptions and the events that couldn't be delivered
+type Store interface {
+	AddSubscription(s Subscription) error
+	//Subscription returns the subscription or ErrSubscriptionNotFound
+	Subscription(id string) (Subscription, error)
+	//DeleteSubscription removes the subscription and its dead letters. deleting a missing subscription is not an error
+	DeleteSubscription(id string) error
+	//Subscriptions returns every subscription of the user, including the ones registered by its mediators
+	Subscriptions(userID string) ([]Subscription, error)
+	AddDeadLetter(d DeadLetter) error
+	//DeadLetters returns the dead letters of the subscription, newest first
+	DeadLetters(subscriptionID string) ([]DeadLetter, error)
+}
+
+//OwnerLookup returns who owns a device. it's satisfied by registry.Registry
+type OwnerLookup interface {
+	DeviceOwner(ctx context.Context, deviceUUID string) (userID, mediatorID string, err error)
+}